@@ -0,0 +1,401 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero-plugin-example/internal/plugin"
+)
+
+// commands are operator commands that the plugin binary runs, instead of
+// serving plugins to Velero, when the command name is its first argument.
+// They are meant to be run in the Velero pod, e.g.
+// "kubectl -n velero exec deploy/velero -- /plugins/velero-plugin-example trash list --bucket velero".
+var commands = map[string]func(args []string) error{
+	"serve-signed-urls": runServeSignedURLs,
+	"snapshots":         runSnapshots,
+	"trash":             runTrash,
+	"verify":            runVerify,
+}
+
+func newCommandLogger() logrus.FieldLogger {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+	return logger
+}
+
+// fileObjectStoreFlags are the flags that select the FileObjectStore location a command works on.
+type fileObjectStoreFlags struct {
+	root, bucket, prefix string
+}
+
+func (f *fileObjectStoreFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&f.root, "root", "", "root directory of the store (defaults to $ARK_FILE_OBJECT_STORE_ROOT or /tmp/backups)")
+	flags.StringVar(&f.bucket, "bucket", "", "bucket of the backup storage location (required)")
+	flags.StringVar(&f.prefix, "prefix", "", "prefix of the backup storage location")
+}
+
+func (f *fileObjectStoreFlags) open() (*plugin.FileObjectStore, error) {
+	if f.bucket == "" {
+		return nil, errors.New("--bucket is required")
+	}
+
+	return plugin.OpenFileObjectStore(newCommandLogger(), map[string]string{
+		"bucket": f.bucket,
+		"prefix": f.prefix,
+		"root":   f.root,
+	})
+}
+
+// backupKeyPrefix returns the prefix of the keys Velero stores a backup's files under.
+func (f *fileObjectStoreFlags) backupKeyPrefix(backup string) string {
+	return path.Join(f.prefix, "backups", backup) + "/"
+}
+
+// backupName returns the name of the backup a key belongs to, or "" if it is not part of a backup.
+func (f *fileObjectStoreFlags) backupName(key string) string {
+	rest := strings.TrimPrefix(key, path.Join(f.prefix, "backups")+"/")
+	if rest == key {
+		return ""
+	}
+	name, _, _ := strings.Cut(rest, "/")
+	return name
+}
+
+const trashUsage = `Usage:
+  trash list [flags]                      list the objects in the trash
+  trash restore --backup NAME [flags]     restore the files of a deleted backup
+  trash restore --key PREFIX [flags]      restore the objects whose key starts with PREFIX
+
+Flags:`
+
+// runTrash lists and restores objects deleted from a FileObjectStore with versioning enabled.
+func runTrash(args []string) error {
+	if len(args) == 0 || (args[0] != "list" && args[0] != "restore") {
+		fmt.Fprintln(os.Stderr, trashUsage)
+		return errors.New("expected list or restore")
+	}
+
+	var location fileObjectStoreFlags
+	var backup, key string
+	flags := flag.NewFlagSet("trash "+args[0], flag.ContinueOnError)
+	location.register(flags)
+	flags.StringVar(&backup, "backup", "", "name of a backup, to restrict the command to its files")
+	flags.StringVar(&key, "key", "", "key prefix, to restrict the command to matching objects")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), trashUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+		return err
+	}
+
+	if backup != "" && key != "" {
+		return errors.New("only one of --backup and --key can be given")
+	}
+	if args[0] == "restore" && backup == "" && key == "" {
+		return errors.New("one of --backup and --key is required")
+	}
+	if backup != "" {
+		key = location.backupKeyPrefix(backup)
+	} else if key == "" {
+		key = location.prefix
+	}
+
+	store, err := location.open()
+	if err != nil {
+		return err
+	}
+
+	if args[0] == "restore" {
+		restored, err := store.RestoreTrash(location.bucket, key)
+		for _, k := range restored {
+			fmt.Println("Restored", k)
+		}
+		return err
+	}
+
+	trashed, err := store.ListTrash(location.bucket, key)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DELETED AT\tBACKUP\tSIZE\tKEY")
+	for _, object := range trashed {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", object.DeletedAt.Local().Format(time.RFC3339), location.backupName(object.Key), object.Size, object.Key)
+	}
+	return w.Flush()
+}
+
+const serveSignedURLsUsage = `Usage:
+  serve-signed-urls [flags]        serve the signed URLs of file object store locations
+
+Flags:`
+
+// runServeSignedURLs serves the signed URLs that the FileObjectStore issues,
+// until it is killed. Velero only runs the plugin for the duration of each
+// call, so this runs alongside it, e.g. as another container in the Velero
+// pod, with the same store roots and signing key files mounted.
+func runServeSignedURLs(args []string) error {
+	var address, roots string
+	flags := flag.NewFlagSet("serve-signed-urls", flag.ContinueOnError)
+	flags.StringVar(&address, "address", ":8085", "address to listen on")
+	flags.StringVar(&roots, "roots", "", "comma-separated root directories of the stores to serve (defaults to $ARK_FILE_OBJECT_STORE_ROOT or /tmp/backups)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), serveSignedURLsUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+		return err
+	}
+	if flags.NArg() > 0 {
+		return errors.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+
+	var rootList []string
+	if roots != "" {
+		rootList = strings.Split(roots, ",")
+	}
+
+	log := logrus.New()
+	server := &http.Server{
+		Addr:              address,
+		Handler:           plugin.NewSignedURLServer(log, rootList),
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	log.WithField("address", address).Infof("Serving signed URLs")
+	return server.ListenAndServe()
+}
+
+const verifyUsage = `Usage:
+  verify [flags]                   verify every snapshot of the volume snapshotter
+  verify --snapshot ID [flags]     verify one snapshot
+
+Flags:`
+
+// runVerify rechecks the data of volume snapshots against the content recorded
+// when they were taken, and fails if any of it is missing or corrupted.
+func runVerify(args []string) error {
+	var stateFile, keyFile, snapshotID string
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	flags.StringVar(&stateFile, "state-file", "", "state file of the volume snapshotter (defaults to its default)")
+	flags.StringVar(&keyFile, "encryption-key-file", "", "encryption keyring of the volume snapshotter, to verify encrypted snapshots")
+	flags.StringVar(&snapshotID, "snapshot", "", "ID of a snapshot, to only verify it")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), verifyUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+		return err
+	}
+	if flags.NArg() > 0 {
+		return errors.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+
+	snapshotter := plugin.NewNoOpVolumeSnapshotter(newCommandLogger())
+	config := map[string]string{
+		"stateFile":         stateFile,
+		"encryptionKeyFile": keyFile,
+	}
+	if err := snapshotter.Init(config); err != nil {
+		return err
+	}
+
+	results, err := snapshotter.VerifySnapshots(snapshotID)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SNAPSHOT\tVOLUME\tCREATED AT\tFILES\tCHUNKS\tSTATUS")
+	for _, result := range results {
+		status := "OK"
+		switch {
+		case len(result.Problems) > 0:
+			status = fmt.Sprintf("FAILED (%d problems)", len(result.Problems))
+			failed++
+		case result.Skipped != "":
+			status = "SKIPPED"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", result.SnapshotID, result.VolumeID, result.CreatedAt.Local().Format(time.RFC3339), result.Files, result.Chunks, status)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		if result.Skipped != "" && len(result.Problems) == 0 {
+			fmt.Printf("\n%s was skipped: %s\n", result.SnapshotID, result.Skipped)
+		}
+		if len(result.Problems) > 0 {
+			fmt.Printf("\n%s:\n", result.SnapshotID)
+			for _, problem := range result.Problems {
+				fmt.Println("  " + problem)
+			}
+		}
+	}
+
+	if failed > 0 {
+		return errors.Errorf("%d of %d snapshots have missing or corrupted content", failed, len(results))
+	}
+	return nil
+}
+
+// parseLocationConfig parses a location config given like to the --config
+// flag of velero snapshot-location create: comma-separated key=value pairs,
+// quoted as CSV if a value contains a comma.
+func parseLocationConfig(value string) (map[string]string, error) {
+	config := make(map[string]string)
+	if value == "" {
+		return config, nil
+	}
+	pairs, err := csv.NewReader(strings.NewReader(value)).Read()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid --config")
+	}
+	for _, pair := range pairs {
+		key, val, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, errors.Errorf("invalid --config entry %q, must be key=value", pair)
+		}
+		config[key] = val
+	}
+	return config, nil
+}
+
+const snapshotsUsage = `Usage:
+  snapshots list [flags]                   list the snapshots of the volume snapshotter
+  snapshots list --selector TAGS [flags]   list the snapshots with matching tags
+  snapshots prune [flags]                  delete the snapshots the retention rules no longer keep
+
+TAGS are comma-separated key=value, key!=value, key and !key requirements.
+
+Flags:`
+
+// runSnapshots queries the catalog of the volume snapshotter, and applies its
+// retention rules.
+func runSnapshots(args []string) error {
+	if len(args) == 0 || (args[0] != "list" && args[0] != "prune") {
+		fmt.Fprintln(os.Stderr, snapshotsUsage)
+		return errors.New("expected list or prune")
+	}
+
+	var configFlag, stateFile, selector, output string
+	var dryRun bool
+	flags := flag.NewFlagSet("snapshots "+args[0], flag.ContinueOnError)
+	flags.StringVar(&configFlag, "config", "", "config of the volume snapshot location, as given to velero snapshot-location create")
+	flags.StringVar(&stateFile, "state-file", "", "state file of the volume snapshotter, instead of the one in --config")
+	flags.StringVar(&selector, "selector", "", "tags the listed snapshots must match")
+	flags.StringVar(&output, "output", "table", "output format, table or json")
+	flags.BoolVar(&dryRun, "dry-run", false, "only list the snapshots prune would delete")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), snapshotsUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+		return err
+	}
+	if flags.NArg() > 0 {
+		return errors.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+	if output != "table" && output != "json" {
+		return errors.Errorf("unsupported --output %q, must be table or json", output)
+	}
+	if args[0] == "prune" && selector != "" {
+		return errors.New("--selector cannot be used with prune")
+	}
+
+	config, err := parseLocationConfig(configFlag)
+	if err != nil {
+		return err
+	}
+	if stateFile != "" {
+		config["stateFile"] = stateFile
+	}
+	snapshotter := plugin.NewNoOpVolumeSnapshotter(newCommandLogger())
+	if err := snapshotter.Init(config); err != nil {
+		return err
+	}
+
+	if args[0] == "prune" {
+		// Snapshots deleted before an error are still reported.
+		expired, err := snapshotter.PruneSnapshots(dryRun)
+		if output == "json" {
+			if printErr := printJSON(expired); printErr != nil {
+				return printErr
+			}
+			return err
+		}
+		verb := "Deleted"
+		if dryRun {
+			verb = "Would delete"
+		}
+		for _, snapshot := range expired {
+			fmt.Printf("%s %s: %s\n", verb, snapshot.ID, snapshot.Reason)
+		}
+		return err
+	}
+
+	snapshots, err := snapshotter.ListSnapshots(selector)
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		return printJSON(snapshots)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SNAPSHOT\tBACKUP\tPVC\tVOLUME\tCREATED AT")
+	for _, snapshot := range snapshots {
+		created := "<unknown>"
+		if !snapshot.CreatedAt.IsZero() {
+			created = snapshot.CreatedAt.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", snapshot.ID, snapshot.Tags[plugin.BackupTagKey], snapshot.Tags[plugin.PVCTagKey], snapshot.VolID, created)
+	}
+	return w.Flush()
+}
+
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
@@ -0,0 +1,205 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// internalNamePrefix is prepended to the name of every file or directory the
+	// plugin keeps for its own bookkeeping. Such entries are never returned by the
+	// object store listings.
+	internalNamePrefix = ".velero-"
+
+	// tempFilePrefix is prepended to the name of every file that is still being written.
+	tempFilePrefix = internalNamePrefix + "tmp-"
+
+	// staleTempFileAge is how long a temp file must have gone unmodified before
+	// it is considered abandoned. A temp file that is actively being written has
+	// its modification time bumped on every write, so this only matches files
+	// left behind by a crashed process.
+	staleTempFileAge = time.Hour
+)
+
+// cleanedRoots are the store roots this process has removed stale temp files
+// from. Init is called for every backup storage location, over and over, so
+// each root is only walked the first time.
+var (
+	cleanedRoots     = make(map[string]bool)
+	cleanedRootsLock sync.Mutex
+)
+
+// isInternalName returns true if name is the base name of a plugin bookkeeping file or directory.
+func isInternalName(name string) bool {
+	return strings.HasPrefix(name, internalNamePrefix)
+}
+
+// isTempFile returns true if name is the base name of a file created by createAtomic.
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, tempFilePrefix)
+}
+
+// atomicFile is a temp file that replaces path when committed. Until then, path
+// is left untouched, so readers see either the old content or the complete new one.
+type atomicFile struct {
+	*os.File
+	path string
+}
+
+// createAtomic starts an atomic write of path. The temp file lives in the same
+// directory as path so that the final rename never crosses a filesystem.
+func createAtomic(path string) (*atomicFile, error) {
+	dir, name := filepath.Split(path)
+
+	tmp, err := os.CreateTemp(dir, tempFilePrefix+name+"-*")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &atomicFile{File: tmp, path: path}, nil
+}
+
+// Commit fsyncs the temp file, renames it over the target path and fsyncs the
+// directory so that the rename itself survives a crash. The temp file is
+// removed if any step fails.
+func (a *atomicFile) Commit(perm os.FileMode) (err error) {
+	defer func() {
+		if err != nil {
+			a.Abort()
+		}
+	}()
+
+	if err = a.Chmod(perm); err != nil {
+		return errors.WithStack(err)
+	}
+	if err = a.Sync(); err != nil {
+		return errors.Wrapf(err, "error syncing %s", a.Name())
+	}
+	if err = a.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err = os.Rename(a.Name(), a.path); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return syncDir(filepath.Dir(a.path))
+}
+
+// Abort discards the temp file, leaving the target path untouched.
+func (a *atomicFile) Abort() {
+	a.Close()
+	os.Remove(a.Name())
+}
+
+// writeFileAtomic writes everything read from body to path so that path either
+// holds the complete content or is left untouched.
+func writeFileAtomic(path string, body io.Reader, perm os.FileMode) error {
+	file, err := createAtomic(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(file, body); err != nil {
+		file.Abort()
+		return errors.Wrapf(err, "error writing %s", file.Name())
+	}
+
+	return file.Commit(perm)
+}
+
+// syncDir fsyncs a directory so that entries created, renamed or removed in it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return errors.Wrapf(err, "error syncing directory %s", dir)
+	}
+	return nil
+}
+
+// removeStaleTempFiles deletes temp files under dir that were abandoned by an
+// interrupted atomic write. It returns the paths that were removed.
+func removeStaleTempFiles(dir string) ([]string, error) {
+	var removed []string
+	cutoff := time.Now().Add(-staleTempFileAge)
+
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !isTempFile(d.Name()) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.ModTime().After(cutoff) {
+			return nil
+		}
+
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed = append(removed, path)
+		return nil
+	})
+
+	return removed, errors.WithStack(err)
+}
+
+// cleanUpRoot removes the stale temp files below root, unless this process
+// has done so already. Plugin processes are short-lived, so files that are
+// not stale yet are removed by a later process.
+func cleanUpRoot(log logrus.FieldLogger, root string) error {
+	cleanedRootsLock.Lock()
+	defer cleanedRootsLock.Unlock()
+
+	if cleanedRoots[root] {
+		return nil
+	}
+
+	removed, err := removeStaleTempFiles(root)
+	for _, tmp := range removed {
+		log.WithField("path", tmp).Infof("Removed stale temporary file")
+	}
+	if err != nil {
+		return err
+	}
+	cleanedRoots[root] = true
+	return nil
+}
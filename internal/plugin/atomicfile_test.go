@@ -0,0 +1,118 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tempFiles returns the temp files of atomic writes below dir.
+func tempFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && isTempFile(d.Name()) {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// TestFailedPutKeepsOldObject checks that a write that fails part way leaves
+// the object it was replacing intact, and no temp file behind.
+func TestFailedPutKeepsOldObject(t *testing.T) {
+	root := t.TempDir()
+	store := newTestFileObjectStore(t, root)
+	const key = "backups/backup-1/velero-backup.json"
+	if err := store.PutObject("bucket", key, strings.NewReader("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	err := store.PutObject("bucket", key, io.MultiReader(bytes.NewReader(testContent(1000)), failingReader{}))
+	if err == nil {
+		t.Fatal("PutObject() of a failing reader succeeded, want an error")
+	}
+
+	body, err := store.GetObject("bucket", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(body)
+	body.Close()
+	if err != nil || string(content) != "old" {
+		t.Errorf("GetObject() after a failed PutObject() returned %q, %v, want the old content", content, err)
+	}
+	if files := tempFiles(t, root); len(files) != 0 {
+		t.Errorf("the failed write left temp files %q", files)
+	}
+}
+
+// TestCrashedWriteKeepsOldFile checks that a write interrupted before it is
+// committed, as by a crash, leaves the file it was replacing intact, and
+// that its temp file is removed once it is stale, but not before.
+func TestCrashedWriteKeepsOldFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	if err := writeFileAtomic(path, strings.NewReader("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	crashed, err := createAtomic(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := crashed.Write([]byte("new, but not complete")); err != nil {
+		t.Fatal(err)
+	}
+	crashed.Close()
+	inProgress, err := createAtomic(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inProgress.Abort()
+
+	if content, err := os.ReadFile(path); err != nil || string(content) != "old" {
+		t.Errorf("file = %q, %v during an interrupted write, want the old content", content, err)
+	}
+
+	old := time.Now().Add(-2 * staleTempFileAge)
+	if err := os.Chtimes(crashed.Name(), old, old); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := removeStaleTempFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != crashed.Name() {
+		t.Errorf("removeStaleTempFiles() removed %q, want only %q", removed, crashed.Name())
+	}
+	if _, err := os.Stat(inProgress.Name()); err != nil {
+		t.Errorf("the temp file of a write in progress was removed: %v", err)
+	}
+}
@@ -0,0 +1,686 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// A chunked snapshot is a directory holding a manifest of the volume's files,
+// and a chunks directory with every chunk of file data the manifest refers to,
+// named after its SHA-256. The manifest and the chunks are compressed and
+// encrypted if the snapshotter is configured to.
+//
+// In a deduplicated snapshot, the chunks directory holds hard links to chunks
+// in a chunk store shared by all snapshots, where each chunk is stored once.
+// There is a chunk store for every combination of compression and encryption
+// key, so that chunks are only shared between snapshots encoded alike.
+// The hard links are the reference counts of the chunks: a chunk in the store
+// with a link count of one is no longer used by any snapshot and can be
+// removed. Since a snapshot's data is reached through its own links, removing
+// a chunk from the store never affects an existing snapshot, even if it races
+// with a snapshot that is being created.
+const (
+	// deduplicateConfigKey is the VSL config key that, if "true", makes
+	// snapshots store file data as deduplicated chunks instead of full copies.
+	deduplicateConfigKey = "deduplicate"
+
+	chunkStoreDirName     = internalNamePrefix + "chunks"
+	manifestFileName      = "manifest.json"
+	snapshotChunksDirName = "chunks"
+)
+
+// Types of manifest entries.
+const (
+	manifestDir      = "dir"
+	manifestFile     = "file"
+	manifestSymlink  = "symlink"
+	manifestHardlink = "hardlink"
+)
+
+// snapshotManifest lists the files of a deduplicated snapshot in the order
+// they were found in, so that every directory comes before its contents.
+type snapshotManifest struct {
+	Entries []manifestEntry `json:"entries"`
+}
+
+type manifestEntry struct {
+	// Path is slash-separated and relative to the volume root, which is ".".
+	Path string `json:"path"`
+	Type string `json:"type"`
+	// Target is the target of a symlink, or the Path of the file a hard link links to.
+	Target string `json:"target,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	// Chunks are the hashes of the chunks of a file's data, in order.
+	Chunks []string `json:"chunks,omitempty"`
+	// Metadata is not recorded for hard links, which share that of their target.
+	Metadata *fileMetadata `json:"metadata,omitempty"`
+}
+
+// chunkStoreName returns the name of the chunk store for chunks compressed
+// with compression and encrypted with the key with ID keyID.
+func chunkStoreName(compression, keyID string) string {
+	if compression == compressionNone && keyID == "" {
+		return chunkStoreDirName
+	}
+	sum := sha256.Sum256([]byte(compression + "\x00" + keyID))
+	return chunkStoreDirName + "-" + hex.EncodeToString(sum[:8])
+}
+
+// isChunkHash returns true if hash is a hex-encoded SHA-256, as chunks are named.
+func isChunkHash(hash string) bool {
+	if len(hash) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// chunkPath returns the path of the chunk with the given hash in dir.
+func chunkPath(dir, hash string) string {
+	return filepath.Join(dir, hash[:2], hash)
+}
+
+// chunkEncoding is how the manifest and chunks of a snapshot are encoded.
+// Data is encrypted with the active key of keyring, if it is set, and
+// decrypted with the key keyID, which must be in it.
+type chunkEncoding struct {
+	keyring     *keyring
+	keyID       string
+	compression string
+}
+
+// encode returns data compressed and encrypted as configured.
+func (e chunkEncoding) encode(data []byte) ([]byte, error) {
+	if e.keyring == nil && e.compression == compressionNone {
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	w, _, err := newEncodingWriter(&buf, e.keyring, e.compression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// writeFile writes data, encoded, to a new file at path.
+func (e chunkEncoding) writeFile(path string, data []byte) error {
+	encoded, err := e.encode(data)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, bytes.NewReader(encoded), 0600)
+}
+
+// openDecoded opens the file at path, which holds data encoded with e, and
+// returns a reader of the decoded data.
+func (e chunkEncoding) openDecoded(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	r, err := newDecodingReader(file, e.keyring, &objectMetadata{KeyID: e.keyID, Compression: e.compression})
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "error decoding %s", path)
+	}
+	return r, nil
+}
+
+// chunkLinker adds chunks to a snapshot. If store is set, it adds them to the
+// chunk store and links them into the snapshot; otherwise it writes them to
+// the snapshot directly.
+type chunkLinker struct {
+	store    string
+	chunks   string
+	encoding chunkEncoding
+}
+
+// add stores data in the chunk store, unless it is there already, links it
+// into the snapshot and returns its hash.
+func (l *chunkLinker) add(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	dst := chunkPath(l.chunks, hash)
+	if _, err := os.Lstat(dst); err == nil {
+		return hash, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return "", errors.WithStack(err)
+	}
+	if l.store == "" {
+		return hash, l.encoding.writeFile(dst, data)
+	}
+
+	src := chunkPath(l.store, hash)
+	for attempt := 1; ; attempt++ {
+		if _, err := os.Lstat(src); os.IsNotExist(err) {
+			if err := os.MkdirAll(filepath.Dir(src), 0700); err != nil {
+				return "", errors.WithStack(err)
+			}
+			if err := l.encoding.writeFile(src, data); err != nil {
+				return "", err
+			}
+		}
+
+		err := os.Link(src, dst)
+		if err == nil || os.IsExist(err) {
+			return hash, nil
+		}
+		// The chunk can be garbage collected between storing and linking it.
+		if !os.IsNotExist(err) || attempt == 3 {
+			return "", errors.WithStack(err)
+		}
+	}
+}
+
+// reuse links the chunks of an unchanged file from the snapshot whose chunks
+// directory is prev.
+func (l *chunkLinker) reuse(prev string, hashes []string) error {
+	for _, hash := range hashes {
+		dst := chunkPath(l.chunks, hash)
+		if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := os.Link(chunkPath(prev, hash), dst); err != nil && !os.IsExist(err) {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// readManifest reads the manifest of the chunked snapshot in dir, which is encoded with encoding.
+func readManifest(dir string, encoding chunkEncoding) (*snapshotManifest, error) {
+	r, err := encoding.openDecoded(filepath.Join(dir, manifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	manifest := new(snapshotManifest)
+	if err := json.NewDecoder(r).Decode(manifest); err != nil {
+		return nil, errors.Wrapf(err, "error decoding snapshot manifest in %s", dir)
+	}
+	return manifest, nil
+}
+
+// createChunkedSnapshot takes a chunked snapshot of the directory tree at src
+// into dst, which is deduplicated against the chunk store if store is set. If
+// prev is the directory of an earlier snapshot of the same volume, with the
+// same store and encoding, files whose size and modification time have not
+// changed since are not read again, and refer to the chunks they had in prev.
+func createChunkedSnapshot(log logrus.FieldLogger, src, dst, store, prev string, encoding chunkEncoding, skip func(path string) bool) error {
+	prevFiles := make(map[string]manifestEntry)
+	if prev != "" {
+		if manifest, err := readManifest(prev, encoding); err != nil {
+			log.WithError(err).Warnf("Error reading the previous snapshot, all files will be read")
+		} else {
+			for _, entry := range manifest.Entries {
+				if entry.Type == manifestFile {
+					prevFiles[entry.Path] = entry
+				}
+			}
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	tmp, release, err := createTempDir(dst)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	linker := &chunkLinker{store: store, chunks: filepath.Join(tmp, snapshotChunksDirName), encoding: encoding}
+	reused := 0
+	manifest, err := scanVolume(log, src, skip, linker.add, func(item manifestEntry) ([]string, bool) {
+		old, ok := prevFiles[item.Path]
+		if !ok || old.Size != item.Size || old.Metadata == nil || old.Metadata.Mtime != item.Metadata.Mtime {
+			return nil, false
+		}
+		if err := linker.reuse(filepath.Join(prev, snapshotChunksDirName), old.Chunks); err != nil {
+			return nil, false
+		}
+		reused++
+		return old.Chunks, true
+	})
+	if err == nil {
+		var data []byte
+		if data, err = json.Marshal(manifest); err == nil {
+			err = encoding.writeFile(filepath.Join(tmp, manifestFileName), data)
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return errors.Wrapf(err, "error snapshotting %s", src)
+	}
+
+	log.Infof("Snapshotted %d entries, reusing %d unchanged files from the previous snapshot", len(manifest.Entries), reused)
+	return syncDir(filepath.Dir(dst))
+}
+
+// scanVolume returns the manifest of the directory tree at src, passing the
+// chunks of the data of every file to add, which returns their hashes. Files
+// for which reuse returns true are not read, and get the chunks it returns.
+// reuse may be nil.
+func scanVolume(log logrus.FieldLogger, src string, skip func(path string) bool, add func(chunk []byte) (string, error), reuse func(item manifestEntry) ([]string, bool)) (*snapshotManifest, error) {
+	manifest := new(snapshotManifest)
+	var chunk []byte
+
+	err := walkVolume(log, src, skip, func(entry volumeEntry) error {
+		if entry.linkOf != "" {
+			manifest.Entries = append(manifest.Entries, manifestEntry{Path: entry.rel, Type: manifestHardlink, Target: entry.linkOf})
+			return nil
+		}
+
+		md, err := readFileMetadata(entry.path, entry.info)
+		if err != nil {
+			return err
+		}
+		item := manifestEntry{Path: entry.rel, Metadata: md}
+
+		switch mode := entry.info.Mode(); {
+		case mode.IsDir():
+			item.Type = manifestDir
+
+		case mode&fs.ModeSymlink != 0:
+			item.Type = manifestSymlink
+			if item.Target, err = os.Readlink(entry.path); err != nil {
+				return err
+			}
+
+		default:
+			item.Type = manifestFile
+			item.Size = entry.info.Size()
+			if reuse != nil {
+				if chunks, ok := reuse(item); ok {
+					item.Chunks = chunks
+					break
+				}
+			}
+
+			file, err := os.Open(entry.path)
+			if err != nil {
+				return err
+			}
+			chunker := newChunker(file)
+			for {
+				if chunk, err = chunker.next(chunk); err == io.EOF {
+					break
+				} else if err != nil {
+					file.Close()
+					return err
+				}
+				hash, err := add(chunk)
+				if err != nil {
+					file.Close()
+					return err
+				}
+				item.Chunks = append(item.Chunks, hash)
+			}
+			file.Close()
+		}
+
+		manifest.Entries = append(manifest.Entries, item)
+		return nil
+	})
+	return manifest, err
+}
+
+// restoreChunkedSnapshot recreates the directory tree of the chunked snapshot
+// in dir, encoded with encoding, at dst, decoding and verifying every chunk as
+// it is read.
+func restoreChunkedSnapshot(log logrus.FieldLogger, dir, dst string, encoding chunkEncoding) error {
+	manifest, err := readManifest(dir, encoding)
+	if err != nil {
+		return err
+	}
+	chunks := filepath.Join(dir, snapshotChunksDirName)
+	err = materialize(log, manifest, dst, func(hash string) (io.ReadCloser, error) {
+		return encoding.openDecoded(chunkPath(chunks, hash))
+	})
+	return errors.Wrapf(err, "error restoring snapshot %s", dir)
+}
+
+// materialize recreates the directory tree described by manifest at dst,
+// reading the chunks of file data from open and verifying them. The tree is
+// created in a temporary directory next to dst and renamed into place.
+func materialize(log logrus.FieldLogger, manifest *snapshotManifest, dst string, open func(hash string) (io.ReadCloser, error)) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	tmp, release, err := createTempDir(dst)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	err = restoreManifest(log, manifest, tmp, open)
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(dst))
+}
+
+func restoreManifest(log logrus.FieldLogger, manifest *snapshotManifest, dst string, open func(hash string) (io.ReadCloser, error)) error {
+	// Like when copying, directories get their metadata last.
+	var dirs []manifestEntry
+
+	for _, entry := range manifest.Entries {
+		target := filepath.Join(dst, filepath.FromSlash(entry.Path))
+		if !isWithin(dst, target) {
+			return errors.Errorf("invalid path %q in snapshot manifest", entry.Path)
+		}
+
+		switch entry.Type {
+		case manifestDir:
+			if entry.Path != "." {
+				if err := os.Mkdir(target, 0700); err != nil {
+					return errors.WithStack(err)
+				}
+			}
+			dirs = append(dirs, entry)
+			continue
+
+		case manifestSymlink:
+			if err := os.Symlink(entry.Target, target); err != nil {
+				return errors.WithStack(err)
+			}
+
+		case manifestHardlink:
+			source := filepath.Join(dst, filepath.FromSlash(entry.Target))
+			if !isWithin(dst, source) {
+				return errors.Errorf("invalid hard link target %q in snapshot manifest", entry.Target)
+			}
+			if err := os.Link(source, target); err != nil {
+				return errors.WithStack(err)
+			}
+			continue
+
+		case manifestFile:
+			if err := restoreFile(target, entry, open); err != nil {
+				return err
+			}
+
+		default:
+			return errors.Errorf("unknown type %q of %s in snapshot manifest", entry.Type, entry.Path)
+		}
+
+		if entry.Metadata != nil {
+			if err := applyFileMetadata(log, target, entry.Metadata, entry.Type == manifestSymlink); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if dirs[i].Metadata != nil {
+			target := filepath.Join(dst, filepath.FromSlash(dirs[i].Path))
+			if err := applyFileMetadata(log, target, dirs[i].Metadata, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// restoreFile writes the chunks of a file entry to a new file at target.
+func restoreFile(target string, entry manifestEntry, open func(hash string) (io.ReadCloser, error)) error {
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer out.Close()
+
+	var written int64
+	for _, hash := range entry.Chunks {
+		if !isChunkHash(hash) {
+			return errors.Errorf("invalid chunk %q of %s in snapshot manifest", hash, entry.Path)
+		}
+		in, err := open(hash)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(out, h), in)
+		in.Close()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if actual := hex.EncodeToString(h.Sum(nil)); actual != hash {
+			return errors.Errorf("chunk %s of %s is corrupt, its content hashes to %s", hash, entry.Path, actual)
+		}
+		written += n
+	}
+	if written != entry.Size {
+		return errors.Errorf("%s has %d bytes, expected %d", entry.Path, written, entry.Size)
+	}
+	return errors.WithStack(out.Sync())
+}
+
+// deleteDedupSnapshot removes the deduplicated snapshot in dir, and then the
+// chunks in store that no other snapshot refers to. It returns the number of
+// chunks removed.
+func deleteDedupSnapshot(dir, store string) (int, error) {
+	var hashes []string
+	err := filepath.WalkDir(filepath.Join(dir, snapshotChunksDirName), func(path string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			hashes = append(hashes, d.Name())
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	removed := 0
+	for _, hash := range hashes {
+		removedChunk, err := removeUnreferencedChunk(chunkPath(store, hash))
+		if err != nil {
+			return removed, err
+		}
+		if removedChunk {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// removeUnreferencedChunk removes the chunk at path if no snapshot links to it.
+func removeUnreferencedChunk(path string) (bool, error) {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	if linkCount(info) != 1 {
+		return false, nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return false, errors.WithStack(err)
+	}
+	return true, nil
+}
+
+// removeUnlockedTempDir removes the temporary directory at path and its lock
+// file, unless the lock is held. It returns whether they were removed.
+func removeUnlockedTempDir(path string) (bool, error) {
+	lockPath := path + tempDirLockSuffix
+	unlock, ok, err := tryLockFile(lockPath)
+	if err != nil || !ok {
+		return false, err
+	}
+	defer unlock()
+	defer os.Remove(lockPath)
+
+	if err := os.RemoveAll(path); err != nil {
+		return false, errors.WithStack(err)
+	}
+	return true, nil
+}
+
+// cleanedSnapshotDirs are the snapshot directories this process has cleaned
+// up after interrupted snapshots. Init is called over and over, so each
+// directory is only cleaned up the first time, as with cleanedRoots.
+var (
+	cleanedSnapshotDirs     = make(map[string]bool)
+	cleanedSnapshotDirsLock sync.Mutex
+)
+
+// cleanUpSnapshotDirOnce runs cleanUpSnapshotDir for dir, unless this process
+// has done so already.
+func cleanUpSnapshotDirOnce(log logrus.FieldLogger, dir string) {
+	cleanedSnapshotDirsLock.Lock()
+	defer cleanedSnapshotDirsLock.Unlock()
+
+	if cleanedSnapshotDirs[dir] {
+		return
+	}
+	dirs, chunks, err := cleanUpSnapshotDir(dir)
+	if err != nil {
+		log.WithError(err).Warnf("Error cleaning up after interrupted snapshots in %s", dir)
+		return
+	}
+	if dirs > 0 {
+		log.Infof("Removed %d interrupted snapshots and %d chunks only they used", dirs, chunks)
+	}
+	cleanedSnapshotDirs[dir] = true
+}
+
+// cleanUpSnapshotDir removes the temporary directories of snapshots in dir
+// that were interrupted by a crash and, if there were any, the chunks in its
+// chunk stores that only they referred to. It returns the number of
+// directories and chunks removed. Directories whose lock is held are still
+// being written, and are left alone.
+func cleanUpSnapshotDir(dir string) (int, int, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, errors.WithStack(err)
+	}
+
+	names := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		names[entry.Name()] = true
+	}
+
+	dirs := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if !isTempFile(name) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < staleTempFileAge {
+			continue
+		}
+		if strings.HasSuffix(name, tempDirLockSuffix) {
+			// Lock files are removed with their directory, unless the
+			// process was interrupted in between.
+			if names[strings.TrimSuffix(name, tempDirLockSuffix)] {
+				continue
+			}
+			name = strings.TrimSuffix(name, tempDirLockSuffix)
+		}
+		removed, err := removeUnlockedTempDir(filepath.Join(dir, name))
+		if err != nil {
+			return dirs, 0, err
+		}
+		if removed && entry.IsDir() {
+			dirs++
+		}
+	}
+	if dirs == 0 {
+		return 0, 0, nil
+	}
+
+	chunks := 0
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), chunkStoreDirName) {
+			continue
+		}
+		err := filepath.WalkDir(filepath.Join(dir, entry.Name()), func(path string, d fs.DirEntry, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			if isTempFile(d.Name()) {
+				if info, err := d.Info(); err == nil && time.Since(info.ModTime()) >= staleTempFileAge {
+					os.Remove(path)
+				}
+				return nil
+			}
+			removed, err := removeUnreferencedChunk(path)
+			if removed {
+				chunks++
+			}
+			return err
+		})
+		if err != nil {
+			return dirs, chunks, errors.WithStack(err)
+		}
+	}
+	return dirs, chunks, nil
+}
@@ -0,0 +1,267 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCleanUpSnapshotDirKeepsLockedDirs checks that the temporary directory
+// of a snapshot that is still being written is kept, however long ago it
+// last changed, and that abandoned ones are removed.
+func TestCleanUpSnapshotDirKeepsLockedDirs(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-2 * staleTempFileAge)
+
+	live, release, err := createTempDir(filepath.Join(dir, "snap-live"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	abandoned, releaseAbandoned, err := createTempDir(filepath.Join(dir, "snap-abandoned"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An interrupted process leaves its directory unlocked, with or without
+	// its lock file.
+	releaseAbandoned()
+	if err := os.WriteFile(abandoned+tempDirLockSuffix, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	unlockedNoLockFile := filepath.Join(dir, tempFilePrefix+"snap-nolock-1")
+	loneLockFile := filepath.Join(dir, tempFilePrefix+"snap-gone-1"+tempDirLockSuffix)
+	if err := os.Mkdir(unlockedNoLockFile, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(loneLockFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{live, live + tempDirLockSuffix, abandoned, abandoned + tempDirLockSuffix, unlockedNoLockFile, loneLockFile} {
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dirs, _, err := cleanUpSnapshotDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dirs != 2 {
+		t.Errorf("cleanUpSnapshotDir removed %d directories, want 2", dirs)
+	}
+	if _, err := os.Stat(live); err != nil {
+		t.Errorf("the directory of a snapshot in progress was removed: %v", err)
+	}
+	for _, path := range []string{abandoned, abandoned + tempDirLockSuffix, unlockedNoLockFile, loneLockFile} {
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed: %v", path, err)
+		}
+	}
+
+	release()
+	if err := os.RemoveAll(live); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(live + tempDirLockSuffix); !os.IsNotExist(err) {
+		t.Errorf("releasing the directory did not remove its lock file: %v", err)
+	}
+}
+
+// countFiles returns the number of regular files below dir.
+func countFiles(t *testing.T, dir string) int {
+	t.Helper()
+
+	n := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err == nil && d.Type().IsRegular() {
+			n++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// TestDeduplicatedSnapshotRoundTrip checks that deduplicated snapshots
+// restore identical files, share the chunks of unchanged data, and remove
+// their chunks once no snapshot uses them.
+func TestDeduplicatedSnapshotRoundTrip(t *testing.T) {
+	config := newTestSnapshotterConfig(t.TempDir())
+	config[deduplicateConfigKey] = "true"
+	p := newTestSnapshotter(t)
+	if err := p.Init(config); err != nil {
+		t.Fatal(err)
+	}
+	chunkStore := filepath.Join(config[snapshotDirConfigKey], chunkStoreDirName)
+
+	volumeID := newTestVolumeTree(t)
+	wantFirst := readTestTree(t, volumeID)
+	first, err := p.CreateSnapshot(volumeID, "zone-a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := countFiles(t, chunkStore)
+
+	// Only the chunks around the change are new in the second snapshot.
+	large := filepath.Join(volumeID, "a", "b", "large")
+	file, err := os.OpenFile(large, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write([]byte("appended"))
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSecond := readTestTree(t, volumeID)
+	second, err := p.CreateSnapshot(volumeID, "zone-a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added := countFiles(t, chunkStore) - chunks; added <= 0 || added > 2 {
+		t.Errorf("the second snapshot added %d chunks for a change at the end of a file, want 1 or 2", added)
+	}
+
+	for _, test := range []struct {
+		snapshotID string
+		want       map[string]testTreeEntry
+	}{
+		{first, wantFirst},
+		{second, wantSecond},
+	} {
+		restored, err := p.CreateVolumeFromSnapshot(test.snapshotID, "", "zone-a", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSameTree(t, readTestTree(t, restored), test.want)
+	}
+
+	if err := p.DeleteSnapshot(first); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := p.CreateVolumeFromSnapshot(second, "", "zone-a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameTree(t, readTestTree(t, restored), wantSecond)
+
+	if err := p.DeleteSnapshot(second); err != nil {
+		t.Fatal(err)
+	}
+	if n := countFiles(t, chunkStore); n != 0 {
+		t.Errorf("%d chunks are left after every snapshot was deleted", n)
+	}
+}
+
+// TestEncodedSnapshotRoundTrip checks that compressed and encrypted
+// snapshots record their encoding in the catalog, keep no plain content on
+// disk when encrypted, restore identical files, and cannot be restored
+// without their key.
+func TestEncodedSnapshotRoundTrip(t *testing.T) {
+	keyDir := t.TempDir()
+	keyFile := writeTestKeyring(t, keyDir, "key-1")
+	otherKeyFile := writeTestKeyring(t, keyDir, "key-2")
+
+	tests := []struct {
+		name        string
+		compression string
+		encrypted   bool
+	}{
+		{name: "gzip", compression: compressionGzip},
+		{name: "zstd", compression: compressionZstd},
+		{name: "encrypted", encrypted: true},
+		{name: "zstd encrypted", compression: compressionZstd, encrypted: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := newTestSnapshotterConfig(t.TempDir())
+			config[compressionConfigKey] = test.compression
+			if test.encrypted {
+				config[encryptionKeyFileConfigKey] = keyFile
+			}
+			p := newTestSnapshotter(t)
+			if err := p.Init(config); err != nil {
+				t.Fatal(err)
+			}
+
+			volumeID := newTestVolumeTree(t)
+			want := readTestTree(t, volumeID)
+			snapshotID, err := p.CreateSnapshot(volumeID, "zone-a", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			snapshot := catalogSnapshot(t, p, snapshotID)
+			wantCompression := test.compression
+			if wantCompression == "" {
+				wantCompression = compressionNone
+			}
+			if snapshot.Compression != wantCompression {
+				t.Errorf("the catalog records compression %q, want %q", snapshot.Compression, wantCompression)
+			}
+			if test.encrypted != (snapshot.Encryption != "") || test.encrypted != (snapshot.KeyID == "key-1") {
+				t.Errorf("the catalog records encryption %q with key %q, want it encrypted with key-1: %t", snapshot.Encryption, snapshot.KeyID, test.encrypted)
+			}
+
+			var stored int64
+			plain := want["a/b/large"].content[:4096]
+			for _, path := range snapshotDataFiles(t, snapshot) {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				stored += int64(len(data))
+				if test.encrypted && strings.Contains(string(data), plain) {
+					t.Errorf("%s holds plain volume content", path)
+				}
+			}
+			if test.compression != "" && stored > int64(len(want["a/b/large"].content))/2 {
+				t.Errorf("the compressed snapshot stores %d bytes", stored)
+			}
+
+			restored, err := p.CreateVolumeFromSnapshot(snapshotID, "", "zone-a", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkSameTree(t, readTestTree(t, restored), want)
+			if !test.encrypted {
+				return
+			}
+
+			// Without the key the snapshot was encrypted with, restoring fails.
+			for _, keyring := range []string{"", otherKeyFile} {
+				config[encryptionKeyFileConfigKey] = keyring
+				if err := p.Init(config); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := p.CreateVolumeFromSnapshot(snapshotID, "", "zone-a", nil); err == nil {
+					t.Errorf("CreateVolumeFromSnapshot() with keyring %q succeeded, want an error", keyring)
+				}
+			}
+		})
+	}
+}
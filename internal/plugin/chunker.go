@@ -0,0 +1,101 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Files are split into chunks at content-defined boundaries: a boundary is
+// wherever a rolling gear hash of the preceding bytes has its top bits clear.
+// Inserting or removing bytes in a file therefore only changes the chunks
+// around the edit, and the others are deduplicated against earlier snapshots.
+const (
+	minChunkSize = 256 << 10
+	maxChunkSize = 4 << 20
+	// chunkBoundaryMask has 20 bits set, for an average chunk size of about 1MiB.
+	chunkBoundaryMask = uint64(1<<20-1) << 44
+)
+
+// gearTable maps each byte to a pseudo-random value. It must never change, or
+// chunks of unchanged data would no longer match those of earlier snapshots.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	// splitmix64, from a fixed seed.
+	state := uint64(0x76656c65726f2121)
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunker splits a stream into content-defined chunks.
+type chunker struct {
+	r   io.Reader
+	buf []byte
+	// n is the number of bytes in buf, and eof whether r has been read to the end.
+	n   int
+	eof bool
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{r: r, buf: make([]byte, maxChunkSize)}
+}
+
+// next returns the next chunk, reusing the memory of chunk for it, or io.EOF
+// after the last one.
+func (c *chunker) next(chunk []byte) ([]byte, error) {
+	if !c.eof && c.n < len(c.buf) {
+		n, err := io.ReadFull(c.r, c.buf[c.n:])
+		c.n += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+
+	size := c.boundary()
+	chunk = append(chunk[:0], c.buf[:size]...)
+	c.n = copy(c.buf, c.buf[size:c.n])
+	return chunk, nil
+}
+
+// boundary returns the length of the chunk at the start of the buffer.
+func (c *chunker) boundary() int {
+	if c.n <= minChunkSize {
+		return c.n
+	}
+
+	var hash uint64
+	for i := minChunkSize; i < c.n; i++ {
+		hash = (hash << 1) + gearTable[c.buf[i]]
+		if hash&chunkBoundaryMask == 0 {
+			return i + 1
+		}
+	}
+	return c.n
+}
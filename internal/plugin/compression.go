@@ -0,0 +1,101 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// Compressed data is stored as compressionMagic, a byte identifying the
+// algorithm, and the compressed stream. Whether data is compressed is recorded
+// along with it, so changing the setting does not affect reading data that was
+// already written.
+const compressionMagic = "VPECMP01"
+
+const (
+	compressionNone = ""
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+var compressionIDs = map[string]byte{
+	compressionGzip: 1,
+	compressionZstd: 2,
+}
+
+// validateCompression checks that algorithm is one newCompressingWriter supports.
+func validateCompression(algorithm string) error {
+	if _, ok := compressionIDs[algorithm]; !ok && algorithm != compressionNone {
+		return errors.Errorf("unsupported compression %q, must be %s or %s", algorithm, compressionGzip, compressionZstd)
+	}
+	return nil
+}
+
+// newCompressingWriter writes the compression header to w and returns a writer
+// that compresses with algorithm. Closing it flushes the compressed stream but
+// does not close w.
+func newCompressingWriter(w io.Writer, algorithm string) (io.WriteCloser, error) {
+	id, ok := compressionIDs[algorithm]
+	if !ok {
+		return nil, validateCompression(algorithm)
+	}
+	if _, err := w.Write(append([]byte(compressionMagic), id)); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	switch algorithm {
+	case compressionZstd:
+		enc, err := zstd.NewWriter(w)
+		return enc, errors.WithStack(err)
+	default:
+		return gzip.NewWriter(w), nil
+	}
+}
+
+// newDecompressingReader reads the compression header from r and returns a
+// reader of the decompressed data, along with the algorithm used.
+func newDecompressingReader(r *bufio.Reader) (io.ReadCloser, string, error) {
+	header := make([]byte, len(compressionMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, "", errors.Wrap(err, "error reading compression header")
+	}
+	if string(header[:len(compressionMagic)]) != compressionMagic {
+		return nil, "", errors.New("data is not compressed")
+	}
+
+	switch header[len(compressionMagic)] {
+	case compressionIDs[compressionGzip]:
+		dec, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "error reading gzip stream")
+		}
+		return dec, compressionGzip, nil
+	case compressionIDs[compressionZstd]:
+		dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, "", errors.Wrap(err, "error reading zstd stream")
+		}
+		return dec.IOReadCloser(), compressionZstd, nil
+	default:
+		return nil, "", errors.Errorf("unknown compression algorithm %d", header[len(compressionMagic)])
+	}
+}
@@ -0,0 +1,337 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Encrypted data is stored as a header followed by a sequence of AES-256-GCM
+// sealed segments:
+//
+//	magic        8 bytes, encryptionMagic
+//	keyID        1 byte length, then the ID of the master key
+//	wrapped key  1 byte length, then the data key sealed with the master key
+//	nonce prefix 7 bytes
+//	segments     each up to encryptionSegmentSize bytes of plaintext plus a GCM tag
+//
+// Every piece of data gets its own random data key. Segment nonces are the
+// nonce prefix followed by a 4-byte segment counter and a byte that is 1 for
+// the last segment only, so reordered, dropped or truncated segments fail to
+// open. The header is authenticated as additional data of every segment.
+const (
+	encryptionMagic       = "VPEENC01"
+	encryptionSegmentSize = 64 * 1024
+	encryptionKeySize     = 32
+	noncePrefixSize       = 7
+
+	// encryptionAlgorithm names this encryption where it is recorded how data was encoded.
+	encryptionAlgorithm = "AES-256-GCM"
+)
+
+// keyring holds the master keys used to wrap data keys, by ID. The first key
+// in the keyring file is the active one, used for everything written; the
+// others are kept so that data written before a rotation can still be read.
+type keyring struct {
+	activeID string
+	keys     map[string][]byte
+}
+
+// loadKeyring reads a keyring file. Each non-empty line that does not start
+// with "#" has the form "<key ID>:<base64-encoded 32-byte key>".
+func loadKeyring(path string) (*keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading encryption keyring")
+	}
+
+	kr := &keyring{keys: make(map[string][]byte)}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		id, encoded, ok := strings.Cut(line, ":")
+		if !ok || id == "" || len(id) > 255 {
+			return nil, errors.Errorf("%s line %d: expected <key ID>:<base64 key>", path, i+1)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(key) != encryptionKeySize {
+			return nil, errors.Errorf("%s line %d: key %s must be %d base64-encoded bytes", path, i+1, id, encryptionKeySize)
+		}
+		if _, ok := kr.keys[id]; ok {
+			return nil, errors.Errorf("%s line %d: duplicate key ID %s", path, i+1, id)
+		}
+
+		if kr.activeID == "" {
+			kr.activeID = id
+		}
+		kr.keys[id] = key
+	}
+
+	if kr.activeID == "" {
+		return nil, errors.Errorf("%s does not contain any keys", path)
+	}
+	return kr, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	return aead, errors.WithStack(err)
+}
+
+func segmentNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 0, noncePrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, counter)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// encryptingWriter encrypts everything written to it with a fresh data key.
+// Close must be called to write the final segment; it does not close the
+// underlying writer.
+type encryptingWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+// newEncryptingWriter writes the encryption header to w and returns a writer
+// that encrypts with the keyring's active key. It returns the ID of that key.
+func newEncryptingWriter(w io.Writer, kr *keyring) (*encryptingWriter, string, error) {
+	dataKey := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, "", errors.WithStack(err)
+	}
+
+	master, err := newGCM(kr.keys[kr.activeID])
+	if err != nil {
+		return nil, "", err
+	}
+	wrapNonce := make([]byte, master.NonceSize())
+	if _, err := rand.Read(wrapNonce); err != nil {
+		return nil, "", errors.WithStack(err)
+	}
+	wrapped := master.Seal(wrapNonce, wrapNonce, dataKey, []byte(kr.activeID))
+
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, "", errors.WithStack(err)
+	}
+
+	header := []byte(encryptionMagic)
+	header = append(header, byte(len(kr.activeID)))
+	header = append(header, kr.activeID...)
+	header = append(header, byte(len(wrapped)))
+	header = append(header, wrapped...)
+	header = append(header, prefix...)
+	if _, err := w.Write(header); err != nil {
+		return nil, "", errors.WithStack(err)
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &encryptingWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		prefix: prefix,
+		buf:    make([]byte, 0, encryptionSegmentSize),
+	}, kr.activeID, nil
+}
+
+func (e *encryptingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full segment is only sealed once more data arrives, since the
+		// last segment has to be marked as such.
+		if len(e.buf) == encryptionSegmentSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):encryptionSegmentSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals and writes the final segment.
+func (e *encryptingWriter) Close() error {
+	return e.seal(true)
+}
+
+func (e *encryptingWriter) seal(last bool) error {
+	sealed := e.aead.Seal(nil, segmentNonce(e.prefix, e.counter, last), e.buf, e.header)
+	if _, err := e.w.Write(sealed); err != nil {
+		return errors.WithStack(err)
+	}
+	e.counter++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+// decryptingReader decrypts data written by an encryptingWriter.
+type decryptingReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	prefix  []byte
+	counter uint32
+	segment []byte
+	plain   []byte
+	done    bool
+}
+
+// newDecryptingReader reads the encryption header from r and returns a reader
+// of the plaintext, along with the ID of the master key the data was written with.
+func newDecryptingReader(r *bufio.Reader, kr *keyring) (io.Reader, string, error) {
+	var header bytes.Buffer
+	readField := func(n int) ([]byte, error) {
+		field := make([]byte, n)
+		if _, err := io.ReadFull(r, field); err != nil {
+			return nil, errors.Wrap(err, "error reading encryption header")
+		}
+		header.Write(field)
+		return field, nil
+	}
+	readLengthPrefixed := func() ([]byte, error) {
+		length, err := readField(1)
+		if err != nil {
+			return nil, err
+		}
+		return readField(int(length[0]))
+	}
+
+	magic, err := readField(len(encryptionMagic))
+	if err != nil {
+		return nil, "", err
+	}
+	if string(magic) != encryptionMagic {
+		return nil, "", errors.New("data is not encrypted")
+	}
+	keyID, err := readLengthPrefixed()
+	if err != nil {
+		return nil, "", err
+	}
+	wrapped, err := readLengthPrefixed()
+	if err != nil {
+		return nil, "", err
+	}
+	prefix, err := readField(noncePrefixSize)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if kr == nil {
+		return nil, string(keyID), errors.Errorf("data is encrypted with key %s, but no encryption keyring is configured", keyID)
+	}
+	masterKey, ok := kr.keys[string(keyID)]
+	if !ok {
+		return nil, string(keyID), errors.Errorf("data is encrypted with key %s, which is not in the keyring", keyID)
+	}
+	master, err := newGCM(masterKey)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(wrapped) < master.NonceSize() {
+		return nil, "", errors.New("encryption header has a malformed data key")
+	}
+	dataKey, err := master.Open(nil, wrapped[:master.NonceSize()], wrapped[master.NonceSize():], keyID)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "error unwrapping data key with key %s", keyID)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &decryptingReader{
+		r:       r,
+		aead:    aead,
+		header:  header.Bytes(),
+		prefix:  prefix,
+		segment: make([]byte, encryptionSegmentSize+aead.Overhead()),
+	}, string(keyID), nil
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptingReader) open() error {
+	n, err := io.ReadFull(d.r, d.segment)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return errors.WithStack(err)
+	}
+
+	// A short segment is always the last one; a full one is the last one if nothing follows it.
+	last := n < len(d.segment)
+	if !last {
+		if _, err := d.r.Peek(1); err == io.EOF {
+			last = true
+		}
+	}
+
+	plain, err := d.aead.Open(d.segment[:0], segmentNonce(d.prefix, d.counter, last), d.segment[:n], d.header)
+	if err != nil {
+		return errors.New("encrypted data is corrupt, truncated or was tampered with")
+	}
+
+	d.counter++
+	d.plain = plain
+	d.done = last
+	return nil
+}
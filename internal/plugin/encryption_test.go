@@ -0,0 +1,262 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// writeTestKeyring writes a keyring file with a random key for each of ids,
+// the first of which is active, and returns its path.
+func writeTestKeyring(t *testing.T, dir string, ids ...string) string {
+	t.Helper()
+
+	var lines []string
+	for _, id := range ids {
+		key := make([]byte, encryptionKeySize)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, id+":"+base64.StdEncoding.EncodeToString(key))
+	}
+	path := filepath.Join(dir, "keyring-"+strings.Join(ids, "-"))
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// encryptTestData returns data encrypted with the active key of kr.
+func encryptTestData(t *testing.T, kr *keyring, data []byte) []byte {
+	t.Helper()
+
+	var sealed bytes.Buffer
+	w, _, err := newEncryptingWriter(&sealed, kr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return sealed.Bytes()
+}
+
+// decryptTestData returns sealed decrypted with kr.
+func decryptTestData(sealed []byte, kr *keyring) ([]byte, error) {
+	r, _, err := newDecryptingReader(bufio.NewReader(bytes.NewReader(sealed)), kr)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	kr, err := loadKeyring(writeTestKeyring(t, t.TempDir(), "key-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{0, 1, encryptionSegmentSize - 1, encryptionSegmentSize, 2*encryptionSegmentSize + 3} {
+		data := testContent(size)
+		sealed := encryptTestData(t, kr, data)
+		if size > 0 && bytes.Contains(sealed, data) {
+			t.Errorf("%d bytes were written unencrypted", size)
+		}
+		got, err := decryptTestData(sealed, kr)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("decrypting %d bytes returned %d bytes, %v, want them unchanged", size, len(got), err)
+		}
+	}
+}
+
+// TestEncryptionRejectsTampering checks that changed, truncated and
+// reordered data, and data sealed with a key that is not in the keyring, fail
+// to decrypt rather than returning other content.
+func TestEncryptionRejectsTampering(t *testing.T) {
+	dir := t.TempDir()
+	kr, err := loadKeyring(writeTestKeyring(t, dir, "key-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := loadKeyring(writeTestKeyring(t, dir, "key-2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameID, err := loadKeyring(writeTestKeyring(t, t.TempDir(), "key-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := testContent(2*encryptionSegmentSize + 3)
+	sealed := encryptTestData(t, kr, data)
+	// The data is sealed in two full segments and one of 3 bytes.
+	segment := encryptionSegmentSize + gcmOverhead(t, kr)
+	header := len(sealed) - 2*segment - (3 + gcmOverhead(t, kr))
+
+	tests := []struct {
+		name   string
+		sealed func() []byte
+		kr     *keyring
+	}{
+		{
+			name: "changed segment",
+			sealed: func() []byte {
+				changed := bytes.Clone(sealed)
+				changed[header+10] ^= 1
+				return changed
+			},
+			kr: kr,
+		},
+		{
+			name: "truncated after a segment",
+			sealed: func() []byte {
+				return bytes.Clone(sealed[:header+segment])
+			},
+			kr: kr,
+		},
+		{
+			name: "reordered segments",
+			sealed: func() []byte {
+				reordered := bytes.Clone(sealed[:header])
+				reordered = append(reordered, sealed[header+segment:header+2*segment]...)
+				reordered = append(reordered, sealed[header:header+segment]...)
+				return append(reordered, sealed[header+2*segment:]...)
+			},
+			kr: kr,
+		},
+		{
+			name:   "key not in keyring",
+			sealed: func() []byte { return sealed },
+			kr:     other,
+		},
+		{
+			name:   "other key with the same ID",
+			sealed: func() []byte { return sealed },
+			kr:     sameID,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := decryptTestData(test.sealed(), test.kr)
+			if err == nil {
+				t.Errorf("decrypting returned %d bytes, want an error", len(got))
+			}
+		})
+	}
+}
+
+// gcmOverhead returns the size of the tag added to each segment sealed with
+// the active key of kr.
+func gcmOverhead(t *testing.T, kr *keyring) int {
+	t.Helper()
+
+	aead, err := newGCM(kr.keys[kr.activeID])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead.Overhead()
+}
+
+// TestEncryptedObjectsAfterKeyRotation checks that objects are stored
+// encrypted, and read back after the active key is rotated as long as their
+// key stays in the keyring.
+func TestEncryptedObjectsAfterKeyRotation(t *testing.T) {
+	root, keys := t.TempDir(), t.TempDir()
+	log := logrus.New()
+	log.SetOutput(testLogWriter{t})
+	store := NewFileObjectStore(log)
+	config := map[string]string{
+		rootConfigKey:              root,
+		"bucket":                   "bucket",
+		encryptionKeyFileConfigKey: writeTestKeyring(t, keys, "key-1"),
+	}
+	if err := store.Init(config); err != nil {
+		t.Fatal(err)
+	}
+	const key = "backups/backup-1/velero-backup.json"
+	content := strings.Repeat("secret content ", 100)
+	if err := store.PutObject("bucket", key, strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := os.ReadFile(filepath.Join(root, "bucket", filepath.FromSlash(key)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, []byte("secret")) {
+		t.Errorf("the object was stored unencrypted")
+	}
+
+	// The keyring file is replaced by one with a new active key.
+	rotated, err := os.ReadFile(writeTestKeyring(t, keys, "key-2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, err := os.ReadFile(config[encryptionKeyFileConfigKey])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name    string
+		keyring string
+		wantErr bool
+	}{
+		{name: "old key kept", keyring: string(rotated) + "\n" + string(previous)},
+		{name: "old key dropped", keyring: string(rotated), wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := os.WriteFile(config[encryptionKeyFileConfigKey], []byte(test.keyring), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Init(config); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readTestObject(store, "bucket", key)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("reading the object without its key returned %d bytes, want an error", len(got))
+				}
+			} else if err != nil || got != content {
+				t.Errorf("reading the object returned %d bytes, %v, want its content", len(got), err)
+			}
+		})
+	}
+}
+
+// readTestObject returns the content of the object at key, or why it cannot
+// be read.
+func readTestObject(store *FileObjectStore, bucket, key string) (string, error) {
+	body, err := store.GetObject(bucket, key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	return string(data), err
+}
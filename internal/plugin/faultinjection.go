@@ -0,0 +1,193 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The fault injection config keys make the volume snapshotter fail or slow
+// down on purpose, so that it can stand in for broken storage when testing
+// how Velero handles errors.
+const (
+	// faultOperationsConfigKey is the VSL config key for the comma-separated
+	// operations faults are injected into. By default, all of them are.
+	faultOperationsConfigKey = "faultOperations"
+	// faultProbabilityConfigKey is the VSL config key for the probability,
+	// between 0 and 1, of an operation failing.
+	faultProbabilityConfigKey = "faultProbability"
+	// faultVolumesConfigKey is the VSL config key for a regular expression
+	// that makes operations on volume IDs it matches fail.
+	faultVolumesConfigKey = "faultVolumes"
+	// faultTagsConfigKey is the VSL config key for comma-separated
+	// <key>=<value> pairs that make operations on snapshots with all of these
+	// tags fail.
+	faultTagsConfigKey = "faultTags"
+	// faultLatencyConfigKey is the VSL config key for the duration operations
+	// are delayed by.
+	faultLatencyConfigKey = "faultLatency"
+	// faultNotReadyPollsConfigKey is the VSL config key for the number of
+	// times IsVolumeReady reports a new volume as not ready.
+	faultNotReadyPollsConfigKey = "faultNotReadyPolls"
+)
+
+// Operations that faults can be injected into.
+const (
+	operationCreateSnapshot           = "CreateSnapshot"
+	operationCreateVolumeFromSnapshot = "CreateVolumeFromSnapshot"
+	operationIsVolumeReady            = "IsVolumeReady"
+	operationDeleteSnapshot           = "DeleteSnapshot"
+)
+
+var faultOperations = []string{
+	operationCreateSnapshot,
+	operationCreateVolumeFromSnapshot,
+	operationIsVolumeReady,
+	operationDeleteSnapshot,
+}
+
+// errInjectedFault is the cause of all injected failures.
+var errInjectedFault = errors.New("injected fault")
+
+// faultInjector injects the faults configured for a VSL. Its zero value injects none.
+type faultInjector struct {
+	operations    map[string]bool
+	probability   float64
+	volumes       *regexp.Regexp
+	tags          map[string]string
+	latency       time.Duration
+	notReadyPolls int
+}
+
+// parseFaultInjector returns the fault injector configured by config.
+func parseFaultInjector(config map[string]string) (*faultInjector, error) {
+	f := &faultInjector{operations: make(map[string]bool)}
+
+	if value := config[faultOperationsConfigKey]; value != "" {
+		for _, op := range strings.Split(value, ",") {
+			op = strings.TrimSpace(op)
+			if !isFaultOperation(op) {
+				return nil, errors.Errorf("unsupported %s %q, must be one of %s", faultOperationsConfigKey, op, strings.Join(faultOperations, ", "))
+			}
+			f.operations[op] = true
+		}
+	} else {
+		for _, op := range faultOperations {
+			f.operations[op] = true
+		}
+	}
+
+	if value := config[faultProbabilityConfigKey]; value != "" {
+		probability, err := strconv.ParseFloat(value, 64)
+		if err != nil || probability < 0 || probability > 1 {
+			return nil, errors.Errorf("%s must be a number between 0 and 1, got %q", faultProbabilityConfigKey, value)
+		}
+		f.probability = probability
+	}
+
+	if value := config[faultVolumesConfigKey]; value != "" {
+		volumes, err := regexp.Compile(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s", faultVolumesConfigKey)
+		}
+		f.volumes = volumes
+	}
+
+	tags, err := parseMapping(config, faultTagsConfigKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(tags) > 0 {
+		f.tags = tags
+	}
+
+	if value := config[faultLatencyConfigKey]; value != "" {
+		latency, err := time.ParseDuration(value)
+		if err != nil || latency < 0 {
+			return nil, errors.Errorf("%s must be a non-negative duration, got %q", faultLatencyConfigKey, value)
+		}
+		f.latency = latency
+	}
+
+	if value := config[faultNotReadyPollsConfigKey]; value != "" {
+		polls, err := strconv.Atoi(value)
+		if err != nil || polls < 0 {
+			return nil, errors.Errorf("%s must be a non-negative integer, got %q", faultNotReadyPollsConfigKey, value)
+		}
+		f.notReadyPolls = polls
+	}
+
+	return f, nil
+}
+
+func isFaultOperation(op string) bool {
+	for _, known := range faultOperations {
+		if op == known {
+			return true
+		}
+	}
+	return false
+}
+
+// delay sleeps for the configured latency if op is one faults are injected into.
+func (f *faultInjector) delay(log logrus.FieldLogger, op string) {
+	if f.latency <= 0 || !f.operations[op] {
+		return
+	}
+	log.Infof("Delaying %s by %s", op, f.latency)
+	time.Sleep(f.latency)
+}
+
+// fail returns an error wrapping errInjectedFault if op on the volume with ID
+// volumeID, or on a snapshot with tags, is to fail.
+func (f *faultInjector) fail(log logrus.FieldLogger, op, volumeID string, tags map[string]string) error {
+	if !f.operations[op] {
+		return nil
+	}
+
+	var reason string
+	switch {
+	case f.volumes != nil && f.volumes.MatchString(volumeID):
+		reason = "volume matches " + faultVolumesConfigKey
+	case f.tags != nil && hasTags(tags, f.tags):
+		reason = "snapshot matches " + faultTagsConfigKey
+	case f.probability > 0 && rand.Float64() < f.probability:
+		reason = faultProbabilityConfigKey + " is " + strconv.FormatFloat(f.probability, 'g', -1, 64)
+	default:
+		return nil
+	}
+
+	log.Warnf("Injecting a failure into %s of volume %s: %s", op, volumeID, reason)
+	return errors.Wrapf(errInjectedFault, "%s of volume %s (%s)", op, volumeID, reason)
+}
+
+// hasTags returns true if tags has all of want.
+func hasTags(tags, want map[string]string) bool {
+	for key, value := range want {
+		if tag, ok := tags[key]; !ok || tag != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,108 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestParseFaultInjectorRejectsInvalidSettings(t *testing.T) {
+	for key, value := range map[string]string{
+		faultOperationsConfigKey:    "CreateSnapshot,Backup",
+		faultProbabilityConfigKey:   "1.5",
+		faultVolumesConfigKey:       "(",
+		faultTagsConfigKey:          "velero.io/backup",
+		faultLatencyConfigKey:       "-1s",
+		faultNotReadyPollsConfigKey: "-1",
+	} {
+		if _, err := parseFaultInjector(map[string]string{key: value}); err == nil {
+			t.Errorf("parseFaultInjector() with %s %q succeeded, want an error", key, value)
+		}
+	}
+}
+
+// TestInjectedFaults checks that operations fail for the volumes, tags and
+// operations faults are configured for only, without leaving anything behind.
+func TestInjectedFaults(t *testing.T) {
+	volumeID := newTestVolume(t)
+	tags := map[string]string{"velero.io/backup": "backup-1"}
+
+	tests := []struct {
+		name     string
+		config   map[string]string
+		wantFail bool
+	}{
+		{name: "none", config: map[string]string{}},
+		{name: "matching volume", config: map[string]string{faultVolumesConfigKey: "^" + volumeID + "$"}, wantFail: true},
+		{name: "other volume", config: map[string]string{faultVolumesConfigKey: "^/other$"}},
+		{name: "matching tags", config: map[string]string{faultTagsConfigKey: "velero.io/backup=backup-1"}, wantFail: true},
+		{name: "other tags", config: map[string]string{faultTagsConfigKey: "velero.io/backup=backup-1,velero.io/pv=pv-1"}},
+		{name: "always", config: map[string]string{faultProbabilityConfigKey: "1"}, wantFail: true},
+		{name: "other operation", config: map[string]string{faultProbabilityConfigKey: "1", faultOperationsConfigKey: operationDeleteSnapshot}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := newTestSnapshotterConfig(t.TempDir())
+			for key, value := range test.config {
+				config[key] = value
+			}
+			p := newTestSnapshotter(t)
+			if err := p.Init(config); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := p.CreateSnapshot(volumeID, "zone-a", tags)
+			if test.wantFail != (errors.Cause(err) == errInjectedFault) {
+				t.Errorf("CreateSnapshot() returned %v, want an injected fault: %t", err, test.wantFail)
+			}
+			if !test.wantFail && err != nil {
+				t.Fatal(err)
+			}
+			if ids := snapshotIDs(t, p); (len(ids) == 0) != test.wantFail {
+				t.Errorf("the catalog holds snapshots %q, want one unless the operation failed", ids)
+			}
+		})
+	}
+}
+
+// TestNotReadyPolls checks that new volumes are reported as not ready as
+// many times as configured, and ready from then on.
+func TestNotReadyPolls(t *testing.T) {
+	config := newTestSnapshotterConfig(t.TempDir())
+	config[faultNotReadyPollsConfigKey] = "2"
+	p := newTestSnapshotter(t)
+	if err := p.Init(config); err != nil {
+		t.Fatal(err)
+	}
+	snapshotID, err := p.CreateSnapshot(newTestVolume(t), "zone-a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeID, err := p.CreateVolumeFromSnapshot(snapshotID, "", "zone-a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []bool{false, false, true, true} {
+		if ready, err := p.IsVolumeReady(volumeID, "zone-a"); err != nil || ready != want {
+			t.Errorf("IsVolumeReady() poll %d = %t, %v, want %t", i+1, ready, err, want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+//go:build !unix
+
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// File locks are not available on this platform, so locks only exclude the
+// goroutines of this process. Sharing a store between processes is not safe.
+var (
+	fileLocks     = make(map[string]*sync.Mutex)
+	fileLocksLock sync.Mutex
+)
+
+// lockFile takes an exclusive lock on the file at path, creating it if
+// needed, and returns the function that releases it.
+func lockFile(path string) (func(), error) {
+	mu, err := fileMutex(path)
+	if err != nil {
+		return nil, err
+	}
+	mu.Lock()
+	return mu.Unlock, nil
+}
+
+// tryLockFile is like lockFile, but returns false rather than wait if the
+// lock is held.
+func tryLockFile(path string) (func(), bool, error) {
+	mu, err := fileMutex(path)
+	if err != nil {
+		return nil, false, err
+	}
+	if !mu.TryLock() {
+		return nil, false, nil
+	}
+	return mu.Unlock, true, nil
+}
+
+// fileMutex creates the file at path if needed, and returns the mutex that
+// stands in for its lock.
+func fileMutex(path string) (*sync.Mutex, error) {
+	lock, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	lock.Close()
+
+	fileLocksLock.Lock()
+	defer fileLocksLock.Unlock()
+	mu, ok := fileLocks[filepath.Clean(path)]
+	if !ok {
+		mu = new(sync.Mutex)
+		fileLocks[filepath.Clean(path)] = mu
+	}
+	return mu, nil
+}
+
+// withFileLock runs fn while holding an exclusive lock on the file at path,
+// creating it if needed.
+func withFileLock(path string, fn func() error) error {
+	unlock, err := lockFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return fn()
+}
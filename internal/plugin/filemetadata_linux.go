@@ -0,0 +1,138 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// fileID identifies a file by its device and inode numbers.
+type fileID struct {
+	dev, ino uint64
+}
+
+// getFileID returns the ID of the file described by info, and whether the
+// file has more than one hard link.
+func getFileID(info fs.FileInfo) (fileID, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(stat.Dev), ino: stat.Ino}, stat.Nlink > 1
+}
+
+// linkCount returns the number of hard links to the file described by info.
+func linkCount(info fs.FileInfo) uint64 {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return uint64(stat.Nlink)
+}
+
+// readFileMetadata returns the metadata of the file at path, which info describes.
+func readFileMetadata(path string, info fs.FileInfo) (*fileMetadata, error) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, errors.Errorf("no file status for %s", path)
+	}
+
+	md := &fileMetadata{
+		Mode:  info.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky),
+		UID:   int(stat.Uid),
+		GID:   int(stat.Gid),
+		Atime: syscall.TimespecToNsec(stat.Atim),
+		Mtime: syscall.TimespecToNsec(stat.Mtim),
+	}
+
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil {
+		if isUnprivileged(err) {
+			return md, nil
+		}
+		return nil, errors.Wrapf(err, "error listing extended attributes of %s", path)
+	}
+	if size == 0 {
+		return md, nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(path, buf); err != nil {
+		return nil, errors.Wrapf(err, "error listing extended attributes of %s", path)
+	}
+
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		attr := string(name)
+
+		size, err := unix.Lgetxattr(path, attr, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading extended attribute %s of %s", attr, path)
+		}
+		value := make([]byte, size)
+		if size, err = unix.Lgetxattr(path, attr, value); err != nil {
+			return nil, errors.Wrapf(err, "error reading extended attribute %s of %s", attr, path)
+		}
+		if md.Xattrs == nil {
+			md.Xattrs = make(map[string][]byte)
+		}
+		md.Xattrs[attr] = value[:size]
+	}
+	return md, nil
+}
+
+// applyFileMetadata gives the file at path the ownership, extended attributes,
+// permissions and timestamps in md. Ownership and attributes that the plugin
+// lacks the privileges to set, or the filesystem does not support, are skipped.
+func applyFileMetadata(log logrus.FieldLogger, path string, md *fileMetadata, symlink bool) error {
+	// Ownership goes first, as changing it clears the setuid and setgid bits.
+	if err := os.Lchown(path, md.UID, md.GID); err != nil && !isUnprivileged(err) {
+		return err
+	}
+
+	for attr, value := range md.Xattrs {
+		if err := unix.Lsetxattr(path, attr, value, 0); err != nil {
+			if !isUnprivileged(err) {
+				return errors.Wrapf(err, "error setting extended attribute %s of %s", attr, path)
+			}
+			log.WithField("path", path).Debugf("Skipping extended attribute %s: %v", attr, err)
+		}
+	}
+
+	if !symlink {
+		if err := os.Chmod(path, md.Mode); err != nil {
+			return err
+		}
+	}
+
+	times := []unix.Timespec{unix.NsecToTimespec(md.Atime), unix.NsecToTimespec(md.Mtime)}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, times, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// isUnprivileged returns true if err means the plugin lacks the privileges for
+// an operation, or the filesystem does not support it.
+func isUnprivileged(err error) bool {
+	return errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) || errors.Is(err, unix.ENOTSUP)
+}
@@ -0,0 +1,62 @@
+//go:build !linux
+
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fileID is not available on this platform, so hard links are copied as separate files.
+type fileID struct{}
+
+func getFileID(info fs.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
+// linkCount is not available on this platform, which keeps unreferenced
+// chunks from being garbage collected.
+func linkCount(info fs.FileInfo) uint64 {
+	return 0
+}
+
+// readFileMetadata returns the permissions and modification time of the file
+// at path. Ownership and extended attributes are only recorded on Linux.
+func readFileMetadata(path string, info fs.FileInfo) (*fileMetadata, error) {
+	mtime := info.ModTime().UnixNano()
+	return &fileMetadata{
+		Mode:  info.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky),
+		Atime: mtime,
+		Mtime: mtime,
+	}, nil
+}
+
+// applyFileMetadata gives the file at path the permissions and modification time in md.
+func applyFileMetadata(log logrus.FieldLogger, path string, md *fileMetadata, symlink bool) error {
+	if symlink {
+		return nil
+	}
+	if err := os.Chmod(path, md.Mode); err != nil {
+		return err
+	}
+	return os.Chtimes(path, time.Unix(0, md.Atime), time.Unix(0, md.Mtime))
+}
@@ -0,0 +1,288 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// snapshotDirConfigKey is the VSL config key for the directory snapshots
+	// are copied into.
+	snapshotDirConfigKey = "snapshotDir"
+	// volumeDirConfigKey is the VSL config key for the directory that volumes
+	// are created in from snapshots. Restored PVs point at directories in it.
+	volumeDirConfigKey = "volumeDir"
+
+	defaultSnapshotDir = "/tmp/velero-volume-snapshotter/snapshots"
+	defaultVolumeDir   = "/tmp/velero-volume-snapshotter/volumes"
+)
+
+// parseDirConfig returns the absolute directory set for key in config, or def.
+// An empty def makes the directory optional.
+func parseDirConfig(config map[string]string, key, def string) (string, error) {
+	dir := config[key]
+	if dir == "" {
+		dir = def
+	}
+	if dir == "" {
+		return "", nil
+	}
+	if !filepath.IsAbs(dir) {
+		return "", errors.Errorf("%s must be an absolute path, got %q", key, dir)
+	}
+	return filepath.Clean(dir), nil
+}
+
+// newDataDir returns a new, not yet existing, path in parent whose name starts with prefix.
+func newDataDir(parent, prefix string) (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return filepath.Join(parent, prefix+hex.EncodeToString(id)), nil
+}
+
+// tempDirLockSuffix is appended to the path of a temporary directory to give
+// the path of its lock file. The lock is held for as long as the directory is
+// being written, so that cleanUpSnapshotDir never removes one still in use,
+// however long ago its entries last changed.
+const tempDirLockSuffix = ".lock"
+
+// createTempDir creates and locks a temporary directory next to dst, for
+// building dst in. The returned function releases the lock, and must only be
+// called once the directory has been renamed into place or removed.
+func createTempDir(dst string) (string, func(), error) {
+	// The lock file is locked before the directory exists, so that the
+	// directory is never seen unlocked while it is in use.
+	lock, err := os.CreateTemp(filepath.Dir(dst), tempFilePrefix+filepath.Base(dst)+"-*"+tempDirLockSuffix)
+	if err != nil {
+		return "", nil, errors.WithStack(err)
+	}
+	lockPath := lock.Name()
+	lock.Close()
+	unlock, err := lockFile(lockPath)
+	if err != nil {
+		os.Remove(lockPath)
+		return "", nil, err
+	}
+	release := func() {
+		os.Remove(lockPath)
+		unlock()
+	}
+
+	tmp := strings.TrimSuffix(lockPath, tempDirLockSuffix)
+	if err := os.Mkdir(tmp, 0700); err != nil {
+		release()
+		return "", nil, errors.WithStack(err)
+	}
+	return tmp, release, nil
+}
+
+// copyTree copies the directory tree at src to dst, preserving permissions,
+// ownership, timestamps, symlinks, hard links and extended attributes as far
+// as the plugin is allowed to. The tree is copied to a temporary directory
+// next to dst and renamed into place, so dst only ever holds a complete copy.
+// Directories for which skip returns true are left out.
+func copyTree(log logrus.FieldLogger, src, dst string, skip func(path string) bool) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if !info.IsDir() {
+		return errors.Errorf("%s is not a directory", src)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	tmp, release, err := createTempDir(dst)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := copyTreeInto(log, src, tmp, skip); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.RemoveAll(tmp)
+		return errors.WithStack(err)
+	}
+	return syncDir(filepath.Dir(dst))
+}
+
+// fileMetadata is the metadata of a file that is preserved in snapshots.
+type fileMetadata struct {
+	Mode fs.FileMode `json:"mode"`
+	UID  int         `json:"uid"`
+	GID  int         `json:"gid"`
+	// Atime and Mtime are the access and modification times in nanoseconds since the epoch.
+	Atime  int64             `json:"atime"`
+	Mtime  int64             `json:"mtime"`
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// copyFileMetadata gives dst the metadata of src, which info describes.
+func copyFileMetadata(log logrus.FieldLogger, src, dst string, info fs.FileInfo) error {
+	md, err := readFileMetadata(src, info)
+	if err != nil {
+		return err
+	}
+	return applyFileMetadata(log, dst, md, info.Mode()&fs.ModeSymlink != 0)
+}
+
+// volumeEntry is a file, directory or symlink found by walkVolume.
+type volumeEntry struct {
+	// rel is the slash-separated path of the entry relative to the volume
+	// root, which itself is ".".
+	rel  string
+	path string
+	info fs.FileInfo
+	// linkOf is the rel of an earlier regular file this one is a hard link to, if any.
+	linkOf string
+}
+
+// walkVolume calls fn for every directory, regular file and symlink below
+// src, including src itself, in lexical order. Directories for which skip
+// returns true are left out, and so are special files such as sockets.
+func walkVolume(log logrus.FieldLogger, src string, skip func(path string) bool, fn func(entry volumeEntry) error) error {
+	links := make(map[fileID]string)
+
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entry := volumeEntry{rel: filepath.ToSlash(rel), path: path, info: info}
+
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			if path != src && skip(path) {
+				return filepath.SkipDir
+			}
+		case mode&fs.ModeSymlink != 0:
+		case mode.IsRegular():
+			// Files with more than one link are reported as links to the
+			// first path they were found at.
+			if id, linked := getFileID(info); linked {
+				if first, ok := links[id]; ok {
+					entry.linkOf = first
+				} else {
+					links[id] = entry.rel
+				}
+			}
+		default:
+			log.WithField("path", path).Warnf("Skipping special file of type %s", mode.Type())
+			return nil
+		}
+
+		return fn(entry)
+	})
+}
+
+func copyTreeInto(log logrus.FieldLogger, src, dst string, skip func(path string) bool) error {
+	// Directories get their metadata after their contents are copied, so that
+	// their timestamps and permissions are not changed by the copying.
+	var dirs []volumeEntry
+
+	err := walkVolume(log, src, skip, func(entry volumeEntry) error {
+		target := filepath.Join(dst, filepath.FromSlash(entry.rel))
+
+		switch mode := entry.info.Mode(); {
+		case mode.IsDir():
+			if entry.rel != "." {
+				if err := os.Mkdir(target, 0700); err != nil {
+					return err
+				}
+			}
+			dirs = append(dirs, entry)
+			return nil
+
+		case mode&fs.ModeSymlink != 0:
+			link, err := os.Readlink(entry.path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+
+		case entry.linkOf != "":
+			// Hard links share the metadata of the file they link to.
+			return os.Link(filepath.Join(dst, filepath.FromSlash(entry.linkOf)), target)
+
+		default:
+			if err := copyFile(entry.path, target); err != nil {
+				return err
+			}
+		}
+
+		return copyFileMetadata(log, entry.path, target, entry.info)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "error copying %s", src)
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		target := filepath.Join(dst, filepath.FromSlash(dirs[i].rel))
+		if err := copyFileMetadata(log, dirs[i].path, target, dirs[i].info); err != nil {
+			return errors.Wrapf(err, "error copying %s", src)
+		}
+	}
+	return nil
+}
+
+// copyFile copies the content of the regular file at src to a new file at dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,158 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestVolumeTree returns the ID of a hostPath volume holding nested
+// directories, an empty one, files of several sizes and modes, and a
+// symlink.
+func newTestVolumeTree(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for _, sub := range []string{"a/b", "empty"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.FromSlash(sub)), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string][]byte{
+		"data":      []byte("data"),
+		"a/b/large": testContent(3 << 20),
+		"a/empty":   nil,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(dir, "data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("b/large", filepath.Join(dir, "a", "link")); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// testTreeEntry is what checkSameTree compares of a file in a tree.
+type testTreeEntry struct {
+	mode    fs.FileMode
+	content string
+}
+
+// readTestTree returns the entries below dir by their slash-separated path.
+func readTestTree(t *testing.T, dir string) map[string]testTreeEntry {
+	t.Helper()
+
+	entries := make(map[string]testTreeEntry)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entry := testTreeEntry{mode: info.Mode() & (fs.ModeType | fs.ModePerm)}
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			entry.content, err = os.Readlink(path)
+		case info.Mode().IsRegular():
+			var data []byte
+			data, err = os.ReadFile(path)
+			entry.content = string(data)
+		}
+		entries[filepath.ToSlash(rel)] = entry
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+// checkSameTree fails the test unless got holds the same files as want.
+func checkSameTree(t *testing.T, got map[string]testTreeEntry, want map[string]testTreeEntry) {
+	t.Helper()
+
+	for path, wantEntry := range want {
+		gotEntry, ok := got[path]
+		switch {
+		case !ok:
+			t.Errorf("%s is missing", path)
+		case gotEntry.mode != wantEntry.mode:
+			t.Errorf("%s has mode %v, want %v", path, gotEntry.mode, wantEntry.mode)
+		case gotEntry.content != wantEntry.content:
+			t.Errorf("%s has different content", path)
+		}
+	}
+	for path := range got {
+		if _, ok := want[path]; !ok {
+			t.Errorf("%s was not in the volume", path)
+		}
+	}
+}
+
+// TestCopySnapshotRoundTrip checks that a volume created from a copy
+// snapshot holds the volume as it was when the snapshot was taken, and that
+// deleting the snapshot removes its data.
+func TestCopySnapshotRoundTrip(t *testing.T) {
+	config := newTestSnapshotterConfig(t.TempDir())
+	p := newTestSnapshotter(t)
+	if err := p.Init(config); err != nil {
+		t.Fatal(err)
+	}
+
+	volumeID := newTestVolumeTree(t)
+	want := readTestTree(t, volumeID)
+	snapshotID, err := p.CreateSnapshot(volumeID, "zone-a", map[string]string{BackupTagKey: "backup-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(volumeID, "data"), []byte("changed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := p.CreateVolumeFromSnapshot(snapshotID, "", "zone-a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameTree(t, readTestTree(t, restored), want)
+
+	if err := p.DeleteSnapshot(snapshotID); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(config[snapshotDirConfigKey])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if !isInternalName(entry.Name()) {
+			t.Errorf("%s was left in the snapshot directory after the snapshot was deleted", entry.Name())
+		}
+	}
+}
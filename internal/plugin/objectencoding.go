@@ -0,0 +1,148 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// newObjectWriter returns a writer that encodes object content into its stored
+// form, as configured for the store, and writes it to w. Closing the returned
+// writer flushes the encoding but does not close w. Details of the encoding
+// are recorded in md.
+func (f *FileObjectStore) newObjectWriter(w io.Writer, md *objectMetadata) (io.WriteCloser, error) {
+	enc, keyID, err := newEncodingWriter(w, f.keyring, f.compression)
+	if err != nil {
+		return nil, err
+	}
+	md.KeyID = keyID
+	md.Compression = f.compression
+	return enc, nil
+}
+
+// newObjectReader returns a reader that decodes the stored form of an object
+// read from r, as recorded in its metadata md, regardless of how the store is
+// configured now. md is nil for objects without metadata. Closing the
+// returned reader closes r.
+func (f *FileObjectStore) newObjectReader(r io.ReadCloser, md *objectMetadata) (io.ReadCloser, error) {
+	return newDecodingReader(r, f.keyring, md)
+}
+
+// newEncodingWriter returns a writer that compresses with compression, unless
+// it is compressionNone, and then encrypts with the active key of kr, unless
+// it is nil, writing the result to w. It returns the ID of the key used, if
+// any. Closing the returned writer flushes the encoding but does not close w.
+func newEncodingWriter(w io.Writer, kr *keyring, compression string) (io.WriteCloser, string, error) {
+	var layers closers
+	var keyID string
+
+	if kr != nil {
+		enc, id, err := newEncryptingWriter(w, kr)
+		if err != nil {
+			return nil, "", err
+		}
+		keyID = id
+		layers = append(layers, enc)
+		w = enc
+	}
+
+	if compression != compressionNone {
+		comp, err := newCompressingWriter(w, compression)
+		if err != nil {
+			return nil, "", err
+		}
+		layers = append(layers, comp)
+		w = comp
+	}
+
+	return layeredWriter{Writer: w, layers: layers}, keyID, nil
+}
+
+// newDecodingReader returns a reader that decodes what a writer returned by
+// newEncodingWriter wrote to r, with the settings recorded in md. Data without
+// metadata, for which md is nil, was never encoded and is read as it is.
+// Closing the returned reader closes r.
+func newDecodingReader(r io.ReadCloser, kr *keyring, md *objectMetadata) (io.ReadCloser, error) {
+	if md == nil {
+		return r, nil
+	}
+	layers := closers{r}
+	var content io.Reader = r
+
+	if md.KeyID != "" {
+		plain, keyID, err := newDecryptingReader(bufio.NewReader(content), kr)
+		if err != nil {
+			return nil, err
+		}
+		if keyID != md.KeyID {
+			return nil, errors.Errorf("data is encrypted with key %s, but key %s was recorded for it", keyID, md.KeyID)
+		}
+		content = plain
+	}
+
+	if md.Compression != compressionNone {
+		dec, algorithm, err := newDecompressingReader(bufio.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		if algorithm != md.Compression {
+			dec.Close()
+			return nil, errors.Errorf("data is compressed with %s, but %s was recorded for it", algorithm, md.Compression)
+		}
+		layers = append(closers{dec}, layers...)
+		content = dec
+	}
+
+	return readCloser{Reader: content, Closer: layers}, nil
+}
+
+// layeredWriter is the outermost of a stack of encoding writers. Closing it
+// closes each layer, from the outermost to the innermost.
+type layeredWriter struct {
+	io.Writer
+	layers closers
+}
+
+func (l layeredWriter) Close() error {
+	for i := len(l.layers) - 1; i >= 0; i-- {
+		if err := l.layers[i].Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closers closes each of its elements in order and returns the first error.
+type closers []io.Closer
+
+func (c closers) Close() error {
+	var first error
+	for _, closer := range c {
+		if err := closer.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,110 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TestObjectsWithoutMetadataAreReadAsTheyAre checks that objects without
+// metadata are never decoded, even if their content starts like encoded data.
+func TestObjectsWithoutMetadataAreReadAsTheyAre(t *testing.T) {
+	root := t.TempDir()
+	store := newTestFileObjectStore(t, root)
+
+	for name, content := range map[string]string{
+		"plain":              "plain content",
+		"compression header": compressionMagic + "\x01not gzip",
+		"encryption header":  encryptionMagic + "not encrypted",
+	} {
+		t.Run(name, func(t *testing.T) {
+			key := "backups/" + name
+			path := filepath.Join(root, "bucket", filepath.FromSlash(key))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			body, err := store.GetObject("bucket", key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(body)
+			body.Close()
+			if err != nil || string(data) != content {
+				t.Errorf("GetObject() returned %q, %v, want %q", data, err, content)
+			}
+		})
+	}
+}
+
+// TestEncodedObjectsRoundTrip checks that objects are stored compressed
+// and encrypted as configured, and read back as they were put, also after
+// the settings of the location change.
+func TestEncodedObjectsRoundTrip(t *testing.T) {
+	root := t.TempDir()
+	log := logrus.New()
+	log.SetOutput(testLogWriter{t})
+	store := NewFileObjectStore(log)
+	keyFile := writeTestKeyring(t, t.TempDir(), "key-1")
+	content := strings.Repeat("compressible content ", 1000)
+
+	settings := []map[string]string{
+		{},
+		{compressionConfigKey: compressionGzip},
+		{compressionConfigKey: compressionZstd},
+		{encryptionKeyFileConfigKey: keyFile},
+		{compressionConfigKey: compressionZstd, encryptionKeyFileConfigKey: keyFile},
+	}
+	var keys []string
+	for i, config := range settings {
+		config[rootConfigKey] = root
+		config["bucket"] = "bucket"
+		if err := store.Init(config); err != nil {
+			t.Fatal(err)
+		}
+		key := fmt.Sprintf("backups/backup-%d/velero-backup.json", i)
+		if err := store.PutObject("bucket", key, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+
+		stored, err := os.ReadFile(filepath.Join(root, "bucket", filepath.FromSlash(key)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compressed := len(stored) < len(content)/2; compressed != (config[compressionConfigKey] != "") {
+			t.Errorf("%v stored %d bytes for %d bytes of content", config, len(stored), len(content))
+		}
+	}
+
+	// Every object is read as it was written, whatever the current settings.
+	for _, key := range keys {
+		if got, err := readTestObject(store, "bucket", key); err != nil || got != content {
+			t.Errorf("reading %s returned %d bytes, %v, want its content", key, len(got), err)
+		}
+	}
+}
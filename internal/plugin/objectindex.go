@@ -0,0 +1,446 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Every bucket has an index of its keys, so that listings do not have to read
+// the whole directory tree. The index is a file of all keys in sorted order,
+// plus a journal of the keys that have been written or deleted since the
+// file was last rewritten. PutObject and DeleteObject add a "begin" entry to
+// the journal before they change an object and an "end" entry afterwards.
+// Keys in the journal are looked up on disk whenever the index is read, so the
+// index is correct even if the plugin crashed half way through a change, or a
+// change is still in progress.
+const (
+	indexDirName      = internalNamePrefix + "index"
+	indexKeysFileName = "keys"
+	indexJournalName  = "journal"
+	indexLockFileName = "lock"
+
+	// keyLocksDirName is the directory in the index directory that holds the
+	// files changes to keys are serialized with. Keys are spread over
+	// keyLockStripes files by their hash.
+	keyLocksDirName = "locks"
+	keyLockStripes  = 64
+
+	journalBegin = '?'
+	journalEnd   = '.'
+
+	// indexCompactionThreshold is the number of journal entries above which
+	// the journal is merged into the keys file.
+	indexCompactionThreshold = 1024
+
+	// indexReadDirBatch is the number of directory entries read at a time when
+	// the index is built.
+	indexReadDirBatch = 256
+)
+
+// errStopListing is returned by a listing callback to end the listing early.
+var errStopListing = errors.New("stop listing")
+
+// objectIndex is the index of the keys in a bucket.
+type objectIndex struct {
+	bucketDir string
+	dir       string
+	dirMode   os.FileMode
+	fileMode  os.FileMode
+}
+
+// journalKey is the state of a key in the journal.
+type journalKey struct {
+	key string
+	// inFlight is the number of changes to the key that have begun but not ended.
+	inFlight int
+	// lastBegin is the time of the most recent change that began.
+	lastBegin time.Time
+}
+
+// dirtyKey is a key from the journal, looked up on disk.
+type dirtyKey struct {
+	key    string
+	exists bool
+}
+
+func (f *FileObjectStore) index(bucket string) *objectIndex {
+	bucketDir := f.bucketDir(bucket)
+	return &objectIndex{
+		bucketDir: bucketDir,
+		dir:       filepath.Join(bucketDir, indexDirName),
+		dirMode:   f.dirMode,
+		fileMode:  f.fileMode,
+	}
+}
+
+// beginChange locks key against changes by other goroutines and processes,
+// and records in the journal that it is about to change. The returned
+// function records that the change ended, whether or not it succeeded, and
+// unlocks key. If the journal cannot be written, the index is discarded so
+// that it is rebuilt.
+func (f *FileObjectStore) beginChange(bucket, key string) (func(), error) {
+	ix := f.index(bucket)
+	unlock, err := ix.lockKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ix.appendJournal(journalBegin, key); err != nil {
+		f.log.WithError(err).WithField("key", key).Warnf("Error updating the object index, it will be rebuilt")
+		ix.discard()
+	}
+
+	return func() {
+		if err := ix.appendJournal(journalEnd, key); err != nil {
+			f.log.WithError(err).WithField("key", key).Warnf("Error updating the object index, it will be rebuilt")
+			ix.discard()
+		}
+		unlock()
+	}, nil
+}
+
+// lockKey takes the lock that changes to key are serialized with, and
+// returns the function that releases it.
+func (ix *objectIndex) lockKey(key string) (func(), error) {
+	dir := filepath.Join(ix.dir, keyLocksDirName)
+	if err := os.MkdirAll(dir, ix.dirMode); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return lockFile(filepath.Join(dir, strconv.Itoa(int(h.Sum32()%keyLockStripes))))
+}
+
+func (ix *objectIndex) withLock(fn func() error) error {
+	if err := os.MkdirAll(ix.dir, ix.dirMode); err != nil {
+		return errors.WithStack(err)
+	}
+	return withFileLock(filepath.Join(ix.dir, indexLockFileName), fn)
+}
+
+func (ix *objectIndex) appendJournal(op byte, key string) error {
+	return ix.withLock(func() error {
+		journal, err := os.OpenFile(filepath.Join(ix.dir, indexJournalName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, ix.fileMode)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer journal.Close()
+
+		if _, err := fmt.Fprintf(journal, "%c %d %s\n", op, time.Now().UnixNano(), strconv.Quote(key)); err != nil {
+			return errors.WithStack(err)
+		}
+		return errors.WithStack(journal.Sync())
+	})
+}
+
+// discard removes the keys file, so that the index is rebuilt the next time it is read.
+func (ix *objectIndex) discard() {
+	os.Remove(filepath.Join(ix.dir, indexKeysFileName))
+}
+
+// readJournal returns the keys in the journal, and the number of entries it has.
+func (ix *objectIndex) readJournal() (map[string]*journalKey, int, error) {
+	keys := make(map[string]*journalKey)
+
+	journal, err := os.Open(filepath.Join(ix.dir, indexJournalName))
+	if os.IsNotExist(err) {
+		return keys, 0, nil
+	}
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	defer journal.Close()
+
+	entries := 0
+	scanner := bufio.NewScanner(journal)
+	for scanner.Scan() {
+		// The last entry can be incomplete if the plugin crashed while
+		// writing it, in which case the change it began never happened.
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 || len(fields[0]) != 1 {
+			continue
+		}
+		nanos, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		key, err := strconv.Unquote(fields[2])
+		if err != nil {
+			continue
+		}
+
+		entries++
+		state, ok := keys[key]
+		if !ok {
+			state = &journalKey{key: key}
+			keys[key] = state
+		}
+		switch fields[0][0] {
+		case journalBegin:
+			state.inFlight++
+			state.lastBegin = time.Unix(0, nanos)
+		case journalEnd:
+			if state.inFlight > 0 {
+				state.inFlight--
+			}
+		}
+	}
+	return keys, entries, errors.WithStack(scanner.Err())
+}
+
+// lookUp returns the keys from the journal whose key starts with prefix, in
+// sorted order, with whether the object exists now.
+func (ix *objectIndex) lookUp(keys map[string]*journalKey, prefix string) []dirtyKey {
+	var dirty []dirtyKey
+	for key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		info, err := os.Lstat(filepath.Join(ix.bucketDir, filepath.FromSlash(key)))
+		dirty = append(dirty, dirtyKey{key: key, exists: err == nil && !info.IsDir()})
+	}
+	sort.Slice(dirty, func(i, j int) bool { return dirty[i].key < dirty[j].key })
+	return dirty
+}
+
+// list calls fn for every key in the bucket that starts with prefix, in sorted
+// order. The keys are streamed from disk, and the index is built first if it
+// does not exist yet.
+func (ix *objectIndex) list(prefix string, fn func(key string) error) error {
+	if _, err := os.Stat(ix.bucketDir); os.IsNotExist(err) {
+		return nil
+	}
+
+	return ix.withLock(func() error {
+		journal, entries, err := ix.readJournal()
+		if err != nil {
+			return err
+		}
+
+		keysPath := filepath.Join(ix.dir, indexKeysFileName)
+		if _, err := os.Stat(keysPath); os.IsNotExist(err) || entries > indexCompactionThreshold {
+			if journal, err = ix.compact(journal); err != nil {
+				return err
+			}
+		}
+
+		keys, err := os.Open(keysPath)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer keys.Close()
+
+		merger := &keyMerger{dirty: ix.lookUp(journal, prefix), emit: func(key string) error {
+			if strings.HasPrefix(key, prefix) {
+				return fn(key)
+			}
+			if key > prefix {
+				return errStopListing
+			}
+			return nil
+		}}
+		err = readKeys(keys, merger.add)
+		if err == nil {
+			err = merger.flush()
+		}
+		if err == errStopListing {
+			err = nil
+		}
+		return err
+	})
+}
+
+// compact rewrites the keys file with the changes in the journal, and the
+// journal with the changes that are still in flight, which it returns. If
+// there is no keys file yet, it is built from the directory tree. It must be
+// called with the index locked.
+func (ix *objectIndex) compact(journal map[string]*journalKey) (map[string]*journalKey, error) {
+	inFlight := make(map[string]*journalKey)
+	for key, state := range journal {
+		// A change that began so long ago was interrupted by a crash.
+		if state.inFlight > 0 && time.Since(state.lastBegin) < staleTempFileAge {
+			inFlight[key] = state
+		}
+	}
+
+	keysPath := filepath.Join(ix.dir, indexKeysFileName)
+	file, err := createAtomic(keysPath)
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(file)
+	merger := &keyMerger{dirty: ix.lookUp(journal, ""), emit: func(key string) error {
+		_, err := w.WriteString(strconv.Quote(key) + "\n")
+		return err
+	}}
+
+	keys, err := os.Open(keysPath)
+	switch {
+	case os.IsNotExist(err):
+		err = walkSorted(ix.bucketDir, "", merger.add)
+	case err == nil:
+		err = readKeys(keys, merger.add)
+		keys.Close()
+	}
+	if err == nil {
+		err = merger.flush()
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		file.Abort()
+		return nil, errors.Wrap(err, "error writing object index")
+	}
+	if err := file.Commit(ix.fileMode); err != nil {
+		return nil, err
+	}
+
+	var lines strings.Builder
+	for key, state := range inFlight {
+		for i := 0; i < state.inFlight; i++ {
+			fmt.Fprintf(&lines, "%c %d %s\n", journalBegin, state.lastBegin.UnixNano(), strconv.Quote(key))
+		}
+	}
+	if err := writeFileAtomic(filepath.Join(ix.dir, indexJournalName), strings.NewReader(lines.String()), ix.fileMode); err != nil {
+		return nil, err
+	}
+	return inFlight, nil
+}
+
+// keyMerger merges the sorted keys of the keys file with the sorted keys from
+// the journal, which replace them.
+type keyMerger struct {
+	dirty []dirtyKey
+	next  int
+	emit  func(key string) error
+}
+
+func (m *keyMerger) add(key string) error {
+	for ; m.next < len(m.dirty) && m.dirty[m.next].key <= key; m.next++ {
+		dirty := m.dirty[m.next]
+		if dirty.exists {
+			if err := m.emit(dirty.key); err != nil {
+				return err
+			}
+		}
+		if dirty.key == key {
+			m.next++
+			return nil
+		}
+	}
+	return m.emit(key)
+}
+
+// flush emits the journal keys that sort after the last key of the keys file.
+func (m *keyMerger) flush() error {
+	for ; m.next < len(m.dirty); m.next++ {
+		if m.dirty[m.next].exists {
+			if err := m.emit(m.dirty[m.next].key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readKeys calls fn for every key in a keys file.
+func readKeys(r io.Reader, fn func(key string) error) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, err := strconv.Unquote(scanner.Text())
+		if err != nil {
+			return errors.Wrap(err, "object index is corrupt")
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return errors.WithStack(scanner.Err())
+}
+
+// walkSorted calls fn for the key of every object below dir in sorted order,
+// reading only one directory at a time. keyPrefix is the key of dir.
+func walkSorted(dir, keyPrefix string, fn func(key string) error) error {
+	names, err := readDirNames(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if strings.HasSuffix(name, "/") {
+			if err := walkSorted(filepath.Join(dir, name), keyPrefix+name, fn); err != nil {
+				return err
+			}
+		} else if err := fn(keyPrefix + name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readDirNames reads the entries of dir in batches and returns their names in
+// the order their keys sort in, with a "/" appended to the names of
+// directories. Internal entries are left out.
+func readDirNames(dir string) ([]string, error) {
+	d, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer d.Close()
+
+	var names []string
+	for {
+		entries, err := d.ReadDir(indexReadDirBatch)
+		for _, entry := range entries {
+			if isInternalName(entry.Name()) {
+				continue
+			}
+			name := entry.Name()
+			if entry.IsDir() {
+				name += "/"
+			}
+			names = append(names, name)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,121 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestIndexAfterInterruptedChanges checks that listings are correct when
+// changes began but never ended, as when the plugin crashes half way through
+// them, whether or not the change reached the disk.
+func TestIndexAfterInterruptedChanges(t *testing.T) {
+	root := t.TempDir()
+	store := newTestFileObjectStore(t, root)
+	model := putTestObjects(t, store, s3Model{}, []string{"backups/a", "backups/b"})
+	if _, err := store.ListObjects("bucket", ""); err != nil {
+		t.Fatal(err)
+	}
+	ix := store.location("bucket", "").index("bucket")
+	bucketDir := filepath.Join(root, "bucket")
+
+	// A put that created its object, and a delete that removed it, before
+	// crashing, and a put that crashed before it created anything.
+	interrupted := map[string]func() error{
+		"backups/c": func() error { return os.WriteFile(filepath.Join(bucketDir, "backups", "c"), []byte("c"), 0644) },
+		"backups/a": func() error { return os.Remove(filepath.Join(bucketDir, "backups", "a")) },
+		"backups/d": func() error { return nil },
+	}
+	for key, change := range interrupted {
+		if err := ix.appendJournal(journalBegin, key); err != nil {
+			t.Fatal(err)
+		}
+		if err := change(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	model["backups/c"] = true
+	delete(model, "backups/a")
+
+	got, err := store.ListObjects("bucket", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := model.listObjects(""); !equalKeys(got, want) {
+		t.Errorf("ListObjects() = %q, want %q", got, want)
+	}
+}
+
+// TestIndexWithConcurrentChanges checks that the index matches the objects
+// after puts and deletes of overlapping keys from many goroutines, with
+// enough changes for the journal to be compacted along the way.
+func TestIndexWithConcurrentChanges(t *testing.T) {
+	store := newTestFileObjectStore(t, t.TempDir())
+	if _, err := store.ListObjects("bucket", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	const workers, keys = 8, 50
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			// Every change adds two journal entries.
+			for n := 0; n < indexCompactionThreshold/workers; n++ {
+				i := (n + w) % keys
+				key := fmt.Sprintf("backups/backup-%d/object-%d", i%5, i)
+				var err error
+				if (n+w)%3 == 0 {
+					err = store.DeleteObject("bucket", key)
+				} else {
+					err = store.PutObject("bucket", key, strings.NewReader(key))
+				}
+				if err != nil && !os.IsNotExist(err) {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	want := s3Model{}
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("backups/backup-%d/object-%d", i%5, i)
+		if _, err := os.Stat(filepath.Join(store.location("bucket", "").bucketDir("bucket"), filepath.FromSlash(key))); err == nil {
+			want[key] = true
+		}
+	}
+	got, err := store.ListObjects("bucket", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalKeys(got, want.listObjects("")) {
+		t.Errorf("ListObjects() = %q, want the objects on disk, %q", got, want.listObjects(""))
+	}
+}
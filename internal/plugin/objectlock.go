@@ -0,0 +1,86 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Object lock modes, named after their S3 counterparts. Both prevent an
+// object from being overwritten or deleted until its retain-until time.
+const (
+	objectLockNone = ""
+	// objectLockGovernance locks can be bypassed by a location that sets
+	// objectLockBypassGovernanceConfigKey.
+	objectLockGovernance = "governance"
+	// objectLockCompliance locks cannot be bypassed.
+	objectLockCompliance = "compliance"
+)
+
+// ObjectLockedError is returned when an object cannot be overwritten or
+// deleted because it is locked.
+type ObjectLockedError struct {
+	Bucket, Key string
+	Mode        string
+	RetainUntil time.Time
+}
+
+func (e *ObjectLockedError) Error() string {
+	return fmt.Sprintf("object %s in bucket %s is locked in %s mode until %s", e.Key, e.Bucket, e.Mode, e.RetainUntil.UTC().Format(time.RFC3339))
+}
+
+// validateObjectLockMode checks that mode is a supported object lock mode.
+func validateObjectLockMode(mode string) error {
+	switch mode {
+	case objectLockNone, objectLockGovernance, objectLockCompliance:
+		return nil
+	}
+	return errors.Errorf("unsupported object lock mode %q, must be %s or %s", mode, objectLockGovernance, objectLockCompliance)
+}
+
+// lockObject records in md that the object is locked from now until the
+// retention configured for the store has passed.
+func (f *FileObjectStore) lockObject(md *objectMetadata) {
+	if f.objectLockMode == objectLockNone {
+		return
+	}
+
+	retainUntil := time.Now().Add(f.objectLockRetention).UTC()
+	md.LockMode = f.objectLockMode
+	md.RetainUntil = &retainUntil
+}
+
+// checkObjectLock returns an *ObjectLockedError if the object stored at path
+// is locked and the store is not allowed to bypass the lock.
+func (f *FileObjectStore) checkObjectLock(bucket, key, path string) error {
+	md, err := readObjectMetadata(path)
+	if err != nil || md == nil || md.LockMode == objectLockNone || md.RetainUntil == nil {
+		return err
+	}
+	if !time.Now().Before(*md.RetainUntil) {
+		return nil
+	}
+	if md.LockMode == objectLockGovernance && f.objectLockBypassGovernance {
+		f.log.WithField("key", key).Warnf("Bypassing governance lock on object")
+		return nil
+	}
+
+	return &ObjectLockedError{Bucket: bucket, Key: key, Mode: md.LockMode, RetainUntil: *md.RetainUntil}
+}
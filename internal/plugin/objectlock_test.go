@@ -0,0 +1,79 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// TestObjectLock checks that locked objects refuse to be overwritten or
+// deleted, also once the lock mode is turned off, and that only governance
+// locks can be bypassed.
+func TestObjectLock(t *testing.T) {
+	const key = "backups/backup-1/velero-backup.json"
+
+	for _, mode := range []string{objectLockGovernance, objectLockCompliance} {
+		t.Run(mode, func(t *testing.T) {
+			root := t.TempDir()
+			log := logrus.New()
+			log.SetOutput(testLogWriter{t})
+			store := NewFileObjectStore(log)
+			initStore := func(config map[string]string) {
+				t.Helper()
+				config[rootConfigKey] = root
+				config["bucket"] = "bucket"
+				if err := store.Init(config); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			initStore(map[string]string{objectLockModeConfigKey: mode, objectLockRetentionConfigKey: "1h"})
+			if err := store.PutObject("bucket", key, strings.NewReader("locked")); err != nil {
+				t.Fatal(err)
+			}
+
+			// Locks recorded with objects outlast the setting.
+			initStore(map[string]string{})
+			var lockedErr *ObjectLockedError
+			if err := store.PutObject("bucket", key, strings.NewReader("changed")); !errors.As(err, &lockedErr) {
+				t.Errorf("PutObject() over a locked object returned %v, want an ObjectLockedError", err)
+			}
+			if err := store.DeleteObject("bucket", key); !errors.As(err, &lockedErr) {
+				t.Errorf("DeleteObject() of a locked object returned %v, want an ObjectLockedError", err)
+			}
+			if lockedErr != nil && lockedErr.Mode != mode {
+				t.Errorf("the object is locked in %s mode, want %s", lockedErr.Mode, mode)
+			}
+			if got, err := readTestObject(store, "bucket", key); err != nil || got != "locked" {
+				t.Errorf("locked object = %q, %v, want it unchanged", got, err)
+			}
+
+			initStore(map[string]string{objectLockBypassGovernanceConfigKey: "true"})
+			err := store.DeleteObject("bucket", key)
+			if mode == objectLockGovernance && err != nil {
+				t.Errorf("DeleteObject() bypassing governance returned %v, want the lock bypassed", err)
+			}
+			if mode == objectLockCompliance && !errors.As(err, &lockedErr) {
+				t.Errorf("DeleteObject() bypassing governance returned %v for a compliance lock, want an ObjectLockedError", err)
+			}
+		})
+	}
+}
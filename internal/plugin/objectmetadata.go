@@ -0,0 +1,226 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Objects are stored with their metadata in a footer that follows their
+// content, so that an object and its metadata are written, renamed and copied
+// as one file, and read through one file descriptor. The footer is the
+// JSON-encoded objectMetadata, its length as a big-endian uint32, and
+// objectFooterMagic.
+const (
+	objectFooterMagic = "VPEOBJ01"
+	// maxObjectFooterSize bounds the metadata read from a footer.
+	maxObjectFooterSize = 64 << 10
+)
+
+// objectMetadata is the record the FileObjectStore keeps for every object.
+type objectMetadata struct {
+	// Size is the length of the object content in bytes.
+	Size int64 `json:"size"`
+	// SHA256 is the hex-encoded SHA-256 digest of the object content.
+	SHA256 string `json:"sha256"`
+	// KeyID is the ID of the master key the object was encrypted with, if any.
+	KeyID string `json:"keyID,omitempty"`
+	// Compression is the algorithm the object was compressed with, if any.
+	Compression string `json:"compression,omitempty"`
+	// LockMode is the object lock mode the object was written under, if any.
+	LockMode string `json:"lockMode,omitempty"`
+	// RetainUntil is the time until which a locked object cannot be
+	// overwritten or deleted.
+	RetainUntil *time.Time `json:"retainUntil,omitempty"`
+}
+
+// writeObjectFooter writes md as the footer of an object whose content has
+// just been written to w.
+func writeObjectFooter(w io.Writer, md *objectMetadata) error {
+	data, err := json.Marshal(md)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	data = binary.BigEndian.AppendUint32(data, uint32(len(data)))
+	data = append(data, objectFooterMagic...)
+	_, err = w.Write(data)
+	return errors.WithStack(err)
+}
+
+// storedObject is an object file opened for reading.
+type storedObject struct {
+	*os.File
+	// content is the stored form of the object content, without the footer.
+	content *io.SectionReader
+	// md is the metadata recorded for the object, or nil if it has none.
+	md *objectMetadata
+}
+
+// openStoredObject opens the object stored at path along with its metadata.
+func openStoredObject(path string) (*storedObject, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, errors.WithStack(err)
+	}
+	object := &storedObject{File: file, content: io.NewSectionReader(file, 0, info.Size())}
+
+	md, footerSize, err := readObjectFooter(file, info.Size())
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "error reading metadata of %s", path)
+	}
+	if md != nil {
+		object.md = md
+		object.content = io.NewSectionReader(file, 0, info.Size()-footerSize)
+	}
+	return object, nil
+}
+
+// readObjectFooter reads the footer of an object file of the given size. It
+// returns nil and no error if the file has no footer, which is the case for
+// files that were not written by the FileObjectStore.
+func readObjectFooter(r io.ReaderAt, size int64) (*objectMetadata, int64, error) {
+	trailerSize := int64(4 + len(objectFooterMagic))
+	if size < trailerSize {
+		return nil, 0, nil
+	}
+	trailer := make([]byte, trailerSize)
+	if _, err := r.ReadAt(trailer, size-trailerSize); err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	if string(trailer[4:]) != objectFooterMagic {
+		return nil, 0, nil
+	}
+
+	length := int64(binary.BigEndian.Uint32(trailer))
+	if length > maxObjectFooterSize || length > size-trailerSize {
+		return nil, 0, errors.New("object footer is corrupt")
+	}
+	data := make([]byte, length)
+	if _, err := r.ReadAt(data, size-trailerSize-length); err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	md := new(objectMetadata)
+	if err := json.Unmarshal(data, md); err != nil {
+		return nil, 0, errors.Wrap(err, "object footer is corrupt")
+	}
+	return md, trailerSize + length, nil
+}
+
+// readObjectMetadata loads the metadata of the object stored at path. It
+// returns nil and no error if there is no object at path, or it has no
+// metadata.
+func readObjectMetadata(path string) (*objectMetadata, error) {
+	object, err := openStoredObject(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	object.Close()
+	return object.md, nil
+}
+
+// IntegrityError is returned when an object's content does not match the
+// checksum recorded when it was written.
+type IntegrityError struct {
+	Bucket, Key      string
+	Expected, Actual string
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("integrity check failed for object %s in bucket %s: expected sha256 %s, got %s", e.Key, e.Bucket, e.Expected, e.Actual)
+}
+
+// hashingReader computes the SHA-256 and length of everything read through it.
+type hashingReader struct {
+	r    io.Reader
+	hash hash.Hash
+	size int64
+}
+
+func newHashingReader(r io.Reader) *hashingReader {
+	return &hashingReader{r: r, hash: sha256.New()}
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	h.size += int64(n)
+	return n, err
+}
+
+// Sum returns the hex-encoded digest of the content read so far.
+func (h *hashingReader) Sum() string {
+	return hex.EncodeToString(h.hash.Sum(nil))
+}
+
+// verifyingReader passes an object's content through unchanged and, once the
+// underlying reader reaches EOF, replaces io.EOF with an *IntegrityError if
+// the content does not match the expected metadata.
+type verifyingReader struct {
+	*hashingReader
+	closer      io.Closer
+	bucket, key string
+	expected    *objectMetadata
+	err         error
+}
+
+func newVerifyingReader(rc io.ReadCloser, bucket, key string, expected *objectMetadata) *verifyingReader {
+	return &verifyingReader{
+		hashingReader: newHashingReader(rc),
+		closer:        rc,
+		bucket:        bucket,
+		key:           key,
+		expected:      expected,
+	}
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+
+	n, err := v.hashingReader.Read(p)
+	if err == io.EOF {
+		if actual := v.Sum(); v.size != v.expected.Size || actual != v.expected.SHA256 {
+			err = &IntegrityError{Bucket: v.bucket, Key: v.key, Expected: v.expected.SHA256, Actual: actual}
+		}
+		v.err = err
+	}
+	return n, err
+}
+
+func (v *verifyingReader) Close() error {
+	return v.closer.Close()
+}
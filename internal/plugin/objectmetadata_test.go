@@ -0,0 +1,136 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// TestObjectFooter checks that objects are read back without their footer,
+// and that changes to their content or footer are reported instead of
+// returning the changed content.
+func TestObjectFooter(t *testing.T) {
+	const key = "backups/backup-1/velero-backup.json"
+	content := `{"kind":"Backup"}`
+
+	tests := []struct {
+		name string
+		// tamper changes the stored object, or leaves it alone if nil.
+		tamper func(data []byte) []byte
+		// wantOpenErr is whether GetObject fails, rather than reading.
+		wantOpenErr bool
+		// wantIntegrityErr is whether reading fails with an IntegrityError.
+		wantIntegrityErr bool
+	}{
+		{
+			name: "unchanged",
+		},
+		{
+			name: "changed content",
+			tamper: func(data []byte) []byte {
+				data[2] ^= 1
+				return data
+			},
+			wantIntegrityErr: true,
+		},
+		{
+			name: "changed checksum",
+			tamper: func(data []byte) []byte {
+				i := bytes.Index(data, []byte(`"sha256":"`)) + len(`"sha256":"`)
+				data[i] ^= 1
+				return data
+			},
+			wantIntegrityErr: true,
+		},
+		{
+			name: "truncated footer",
+			tamper: func(data []byte) []byte {
+				trailer := data[len(data)-4-len(objectFooterMagic):]
+				length := binary.BigEndian.Uint32(trailer)
+				binary.BigEndian.PutUint32(trailer, length-1)
+				return data
+			},
+			wantOpenErr: true,
+		},
+		{
+			name: "oversized footer",
+			tamper: func(data []byte) []byte {
+				trailer := data[len(data)-4-len(objectFooterMagic):]
+				binary.BigEndian.PutUint32(trailer, maxObjectFooterSize+1)
+				return data
+			},
+			wantOpenErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			store := newTestFileObjectStore(t, root)
+			if err := store.PutObject("bucket", key, strings.NewReader(content)); err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join(root, "bucket", filepath.FromSlash(key))
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(data, []byte(content)) || !bytes.HasSuffix(data, []byte(objectFooterMagic)) {
+				t.Fatalf("stored object %q is not its content followed by a footer", data)
+			}
+			if test.tamper != nil {
+				if err := os.WriteFile(path, test.tamper(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			body, err := store.GetObject("bucket", key)
+			if test.wantOpenErr {
+				if err == nil {
+					body.Close()
+					t.Fatal("GetObject() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(body)
+			body.Close()
+
+			var integrityErr *IntegrityError
+			if test.wantIntegrityErr {
+				if !errors.As(err, &integrityErr) {
+					t.Errorf("reading the object returned %v, want an IntegrityError", err)
+				}
+				return
+			}
+			if err != nil || string(got) != content {
+				t.Errorf("reading the object returned %q, %v, want %q", got, err, content)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// InvalidPathError is returned when a bucket, prefix or key cannot be safely
+// mapped to a path under the object store root.
+type InvalidPathError struct {
+	// Field is the name of the offending input: "bucket", "prefix" or "key".
+	Field  string
+	Value  string
+	Reason string
+}
+
+func (e *InvalidPathError) Error() string {
+	return fmt.Sprintf("invalid %s %q: %s", e.Field, e.Value, e.Reason)
+}
+
+// validateBucket checks that bucket is a single, ordinary path component.
+func validateBucket(bucket string) error {
+	invalid := func(reason string) error {
+		return &InvalidPathError{Field: "bucket", Value: bucket, Reason: reason}
+	}
+
+	switch {
+	case bucket == "":
+		return invalid("must not be empty")
+	case bucket == "." || bucket == "..":
+		return invalid("must not be a relative path reference")
+	case strings.ContainsAny(bucket, "/\\\x00"):
+		return invalid("must not contain path separators or NUL bytes")
+	case isInternalName(bucket):
+		return invalid(fmt.Sprintf("names starting with %q are reserved", internalNamePrefix))
+	}
+	return nil
+}
+
+// cleanKey validates a slash-separated key or prefix and returns it in a
+// normalized form: repeated and trailing slashes are collapsed. Absolute paths,
+// "." and ".." components, NUL bytes and reserved names are rejected, as are
+// empty keys. An empty prefix is allowed and refers to the whole bucket.
+func cleanKey(field, key string) (string, error) {
+	invalid := func(reason string) error {
+		return &InvalidPathError{Field: field, Value: key, Reason: reason}
+	}
+
+	if strings.HasPrefix(key, "/") {
+		return "", invalid("must not be an absolute path")
+	}
+	if strings.ContainsRune(key, '\x00') {
+		return "", invalid("must not contain NUL bytes")
+	}
+
+	var parts []string
+	for _, part := range strings.Split(key, "/") {
+		switch {
+		case part == "":
+			continue
+		case part == "." || part == "..":
+			return "", invalid("must not contain relative path references")
+		case isInternalName(part):
+			return "", invalid(fmt.Sprintf("names starting with %q are reserved", internalNamePrefix))
+		}
+		parts = append(parts, part)
+	}
+	if field == "key" && len(parts) == 0 {
+		return "", invalid("must not be empty")
+	}
+
+	return strings.Join(parts, "/"), nil
+}
+
+// resolvePath maps a bucket and key (or prefix) to a filesystem path under the
+// store root. Besides validating the inputs, it makes sure the path does not
+// leave the root through a symlink, whether the symlink is the path itself or
+// one of its existing ancestors.
+func (f *FileObjectStore) resolvePath(bucket, field, key string) (string, error) {
+	if err := validateBucket(bucket); err != nil {
+		return "", err
+	}
+	clean, err := cleanKey(field, key)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(f.root, bucket, filepath.FromSlash(clean))
+
+	realRoot, err := evalExistingSymlinks(f.root)
+	if err != nil {
+		return "", err
+	}
+	realPath, err := evalExistingSymlinks(path)
+	if errors.Cause(err) == errDanglingSymlink {
+		return "", &InvalidPathError{Field: field, Value: key, Reason: "traverses a dangling symlink"}
+	}
+	if err != nil {
+		return "", err
+	}
+	if !isWithin(realRoot, realPath) {
+		return "", &InvalidPathError{Field: field, Value: key, Reason: "resolves outside of the object store root"}
+	}
+
+	return path, nil
+}
+
+// errDanglingSymlink is returned by evalExistingSymlinks when a component of
+// the path is a symlink whose target does not exist. Creating files through
+// such a symlink could place them anywhere, so it is never followed.
+var errDanglingSymlink = errors.New("dangling symlink")
+
+// evalExistingSymlinks resolves symlinks in the longest existing ancestor of
+// path and appends the remaining, not yet existing, components unchanged.
+func evalExistingSymlinks(path string) (string, error) {
+	var missing []string
+	existing := filepath.Clean(path)
+
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, missing...)...), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", errors.WithStack(err)
+		}
+		if _, err := os.Lstat(existing); err == nil {
+			return "", errors.Wrap(errDanglingSymlink, existing)
+		}
+
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return "", errors.WithStack(err)
+		}
+		missing = append([]string{filepath.Base(existing)}, missing...)
+		existing = parent
+	}
+}
+
+// isWithin returns true if path is root or a descendant of root. Both must be clean.
+func isWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,418 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func TestValidateBucket(t *testing.T) {
+	tests := []struct {
+		bucket     string
+		wantReason string
+	}{
+		{bucket: "bucket"},
+		{bucket: "my.bucket-1"},
+		{bucket: "..."},
+		{bucket: "", wantReason: "must not be empty"},
+		{bucket: ".", wantReason: "relative path reference"},
+		{bucket: "..", wantReason: "relative path reference"},
+		{bucket: "a/b", wantReason: "path separators"},
+		{bucket: "/bucket", wantReason: "path separators"},
+		{bucket: "../bucket", wantReason: "path separators"},
+		{bucket: `a\b`, wantReason: "path separators"},
+		{bucket: "bucket\x00", wantReason: "NUL bytes"},
+		{bucket: ".velero-index", wantReason: "reserved"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.bucket, func(t *testing.T) {
+			checkPathError(t, validateBucket(test.bucket), "bucket", test.wantReason)
+		})
+	}
+}
+
+func TestCleanKey(t *testing.T) {
+	tests := []struct {
+		field      string
+		key        string
+		want       string
+		wantReason string
+	}{
+		{field: "key", key: "backups/backup-1/velero-backup.json", want: "backups/backup-1/velero-backup.json"},
+		{field: "key", key: "backups//backup-1///velero-backup.json", want: "backups/backup-1/velero-backup.json"},
+		{field: "key", key: "backups/backup-1/", want: "backups/backup-1"},
+		{field: "key", key: "..backup", want: "..backup"},
+		{field: "key", key: "backups/.hidden", want: "backups/.hidden"},
+		{field: "prefix", key: "", want: ""},
+		{field: "prefix", key: "velero/", want: "velero"},
+		{field: "key", key: "", wantReason: "must not be empty"},
+		{field: "prefix", key: "velero//", want: "velero"},
+		{field: "key", key: "/etc/passwd", wantReason: "absolute path"},
+		{field: "prefix", key: "/velero", wantReason: "absolute path"},
+		{field: "key", key: "..", wantReason: "relative path references"},
+		{field: "key", key: "../outside", wantReason: "relative path references"},
+		{field: "key", key: "backups/../../outside", wantReason: "relative path references"},
+		{field: "key", key: "backups/./backup-1", wantReason: "relative path references"},
+		{field: "prefix", key: "velero/..", wantReason: "relative path references"},
+		{field: "key", key: "backups/\x00", wantReason: "NUL bytes"},
+		{field: "key", key: "backups/.velero-meta-backup.json", wantReason: "reserved"},
+		{field: "prefix", key: ".velero-trash/velero", wantReason: "reserved"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.field+"/"+test.key, func(t *testing.T) {
+			got, err := cleanKey(test.field, test.key)
+			checkPathError(t, err, test.field, test.wantReason)
+			if err == nil && got != test.want {
+				t.Errorf("cleanKey(%q, %q) = %q, want %q", test.field, test.key, got, test.want)
+			}
+		})
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	root, _ := newSymlinkTree(t)
+	f := &FileObjectStore{root: root}
+
+	tests := []struct {
+		name       string
+		bucket     string
+		field      string
+		key        string
+		want       string
+		wantField  string
+		wantReason string
+	}{
+		{name: "new key", bucket: "bucket", field: "key", key: "backups/backup-1", want: "bucket/backups/backup-1"},
+		{name: "existing key", bucket: "bucket", field: "key", key: "real/object", want: "bucket/real/object"},
+		{name: "empty prefix", bucket: "bucket", field: "prefix", key: "", want: "bucket"},
+		{name: "new bucket", bucket: "other", field: "prefix", key: "velero", want: "other/velero"},
+		{name: "symlink within root", bucket: "bucket", field: "key", key: "inside/object", want: "bucket/inside/object"},
+		{name: "symlink to root", bucket: "bucket", field: "key", key: "to-root/bucket/real/object", want: "bucket/to-root/bucket/real/object"},
+		{name: "parent reference", bucket: "bucket", field: "key", key: "../bucket/object", wantField: "key", wantReason: "relative path references"},
+		{name: "absolute key", bucket: "bucket", field: "key", key: "/bucket/object", wantField: "key", wantReason: "absolute path"},
+		{name: "NUL byte", bucket: "bucket", field: "key", key: "object\x00", wantField: "key", wantReason: "NUL bytes"},
+		{name: "invalid bucket", bucket: "..", field: "key", key: "object", wantField: "bucket", wantReason: "relative path reference"},
+		{name: "escaping symlink", bucket: "bucket", field: "key", key: "escape/victim", wantField: "key", wantReason: "outside of the object store root"},
+		{name: "escaping symlink itself", bucket: "bucket", field: "key", key: "escape", wantField: "key", wantReason: "outside of the object store root"},
+		{name: "new key under escaping symlink", bucket: "bucket", field: "key", key: "escape/a/b", wantField: "key", wantReason: "outside of the object store root"},
+		{name: "escaping prefix", bucket: "bucket", field: "prefix", key: "escape", wantField: "prefix", wantReason: "outside of the object store root"},
+		{name: "escaping bucket", bucket: "escaped", field: "prefix", key: "", wantField: "prefix", wantReason: "outside of the object store root"},
+		{name: "chained escaping symlink", bucket: "bucket", field: "key", key: "via-inside/victim", wantField: "key", wantReason: "outside of the object store root"},
+		{name: "dangling symlink", bucket: "bucket", field: "key", key: "dangling", wantField: "key", wantReason: "dangling symlink"},
+		{name: "new key under dangling symlink", bucket: "bucket", field: "key", key: "dangling/object", wantField: "key", wantReason: "dangling symlink"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := f.resolvePath(test.bucket, test.field, test.key)
+			checkPathError(t, err, test.wantField, test.wantReason)
+			if err == nil && got != filepath.Join(root, filepath.FromSlash(test.want)) {
+				t.Errorf("resolvePath(%q, %q, %q) = %q, want %q under %s", test.bucket, test.field, test.key, got, test.want, root)
+			}
+		})
+	}
+}
+
+// TestPublicMethodsRejectInvalidPaths checks that every public method of
+// FileObjectStore rejects buckets and keys that do not map to a path under
+// the root, and that none of them touches anything outside of it.
+func TestPublicMethodsRejectInvalidPaths(t *testing.T) {
+	root, outside := newSymlinkTree(t)
+	store := newTestFileObjectStore(t, root)
+
+	// The trash of bucket is not empty, so that RestoreTrash has something
+	// to restore if it ever gets past the validation.
+	if err := store.PutObject("bucket", "trashed", strings.NewReader("trashed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteObject("bucket", "trashed"); err != nil {
+		t.Fatal(err)
+	}
+
+	keyMethods := []struct {
+		name string
+		call func(bucket, key string) error
+	}{
+		{name: "PutObject", call: func(bucket, key string) error {
+			return store.PutObject(bucket, key, strings.NewReader("content"))
+		}},
+		{name: "ObjectExists", call: func(bucket, key string) error {
+			_, err := store.ObjectExists(bucket, key)
+			return err
+		}},
+		{name: "GetObject", call: func(bucket, key string) error {
+			body, err := store.GetObject(bucket, key)
+			if err == nil {
+				body.Close()
+			}
+			return err
+		}},
+		{name: "DeleteObject", call: func(bucket, key string) error {
+			return store.DeleteObject(bucket, key)
+		}},
+		{name: "CreateSignedURL", call: func(bucket, key string) error {
+			_, err := store.CreateSignedURL(bucket, key, time.Minute)
+			return err
+		}},
+	}
+
+	// The prefix of a listing is matched against keys, not resolved, so only
+	// the bucket is validated.
+	bucketMethods := []struct {
+		name string
+		call func(bucket string) error
+	}{
+		{name: "ListCommonPrefixes", call: func(bucket string) error {
+			_, err := store.ListCommonPrefixes(bucket, "", "/")
+			return err
+		}},
+		{name: "ListObjects", call: func(bucket string) error {
+			_, err := store.ListObjects(bucket, "")
+			return err
+		}},
+		{name: "ListTrash", call: func(bucket string) error {
+			_, err := store.ListTrash(bucket, "")
+			return err
+		}},
+		{name: "RestoreTrash", call: func(bucket string) error {
+			_, err := store.RestoreTrash(bucket, "")
+			return err
+		}},
+	}
+
+	invalidBuckets := []struct {
+		name       string
+		bucket     string
+		wantField  string
+		wantReason string
+	}{
+		{name: "empty", bucket: "", wantField: "bucket", wantReason: "must not be empty"},
+		{name: "parent reference", bucket: "..", wantField: "bucket", wantReason: "relative path reference"},
+		{name: "absolute", bucket: "/bucket", wantField: "bucket", wantReason: "path separators"},
+		{name: "NUL byte", bucket: "bucket\x00", wantField: "bucket", wantReason: "NUL bytes"},
+		{name: "escaping symlink", bucket: "escaped", wantReason: "outside of the object store root"},
+	}
+
+	invalidKeys := []struct {
+		name       string
+		key        string
+		wantReason string
+	}{
+		{name: "empty", key: "", wantReason: "must not be empty"},
+		{name: "parent reference", key: "../outside/victim", wantReason: "relative path references"},
+		{name: "nested parent reference", key: "backups/../../outside/victim", wantReason: "relative path references"},
+		{name: "absolute", key: filepath.ToSlash(filepath.Join(outside, "victim")), wantReason: "absolute path"},
+		{name: "NUL byte", key: "victim\x00", wantReason: "NUL bytes"},
+		{name: "reserved", key: ".velero-index/keys", wantReason: "reserved"},
+		{name: "escaping symlink", key: "escape/victim", wantReason: "outside of the object store root"},
+		{name: "new key under escaping symlink", key: "escape/new/object", wantReason: "outside of the object store root"},
+		{name: "dangling symlink", key: "dangling", wantReason: "dangling symlink"},
+		{name: "new key under dangling symlink", key: "dangling/object", wantReason: "dangling symlink"},
+	}
+
+	for _, method := range keyMethods {
+		for _, test := range invalidBuckets {
+			t.Run(method.name+"/bucket/"+test.name, func(t *testing.T) {
+				checkPathError(t, method.call(test.bucket, "object"), test.wantField, test.wantReason)
+			})
+		}
+		for _, test := range invalidKeys {
+			t.Run(method.name+"/key/"+test.name, func(t *testing.T) {
+				checkPathError(t, method.call("bucket", test.key), "key", test.wantReason)
+			})
+		}
+	}
+	for _, method := range bucketMethods {
+		for _, test := range invalidBuckets {
+			t.Run(method.name+"/bucket/"+test.name, func(t *testing.T) {
+				checkPathError(t, method.call(test.bucket), test.wantField, test.wantReason)
+			})
+		}
+	}
+
+	t.Run("Init", func(t *testing.T) {
+		log := logrus.New()
+		log.SetOutput(testLogWriter{t})
+		for _, prefix := range []string{"../outside", "/velero", "velero\x00", "escape", "dangling"} {
+			err := NewFileObjectStore(log).Init(map[string]string{
+				rootConfigKey: root,
+				"bucket":      "bucket",
+				"prefix":      prefix,
+			})
+			var pathErr *InvalidPathError
+			if !errors.As(err, &pathErr) {
+				t.Errorf("Init with prefix %q: got error %v, want an InvalidPathError", prefix, err)
+			}
+		}
+		err := NewFileObjectStore(log).Init(map[string]string{rootConfigKey: root, "bucket": "escaped"})
+		var pathErr *InvalidPathError
+		if !errors.As(err, &pathErr) {
+			t.Errorf("Init with bucket escaped: got error %v, want an InvalidPathError", err)
+		}
+	})
+
+	entries, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "victim" {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Errorf("directory outside of the root was changed, it now contains %v", names)
+	}
+}
+
+// TestListingPrefixesAreNotResolved checks that listing with a prefix that
+// would be an invalid key only matches keys, and never reads outside of the
+// bucket.
+func TestListingPrefixesAreNotResolved(t *testing.T) {
+	root, _ := newSymlinkTree(t)
+	store := newTestFileObjectStore(t, root)
+	if err := store.PutObject("bucket", "backups/backup-1", strings.NewReader("backup")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, prefix := range []string{"../", "/", "escape/", "dangling/", "backups/../"} {
+		objects, err := store.ListObjects("bucket", prefix)
+		if err != nil || len(objects) != 0 {
+			t.Errorf("ListObjects(bucket, %q) = %v, %v, want no objects", prefix, objects, err)
+		}
+		prefixes, err := store.ListCommonPrefixes("bucket", prefix, "/")
+		if err != nil || len(prefixes) != 0 {
+			t.Errorf("ListCommonPrefixes(bucket, %q, /) = %v, %v, want no prefixes", prefix, prefixes, err)
+		}
+		trashed, err := store.ListTrash("bucket", prefix)
+		if err != nil || len(trashed) != 0 {
+			t.Errorf("ListTrash(bucket, %q) = %v, %v, want no objects", prefix, trashed, err)
+		}
+	}
+}
+
+// newSymlinkTree creates a store root and a directory outside of it holding
+// the file "victim", and returns both. In the root, bucket "escaped" is a
+// symlink to the outside directory, and bucket "bucket" contains:
+//
+//	real/object          a regular file
+//	inside -> real       a symlink that stays within the root
+//	to-root -> root      a symlink to the root itself
+//	escape -> outside    a symlink out of the root
+//	via-inside -> escape a symlink to a symlink out of the root
+//	dangling -> missing  a symlink whose target does not exist
+func newSymlinkTree(t *testing.T) (string, string) {
+	t.Helper()
+
+	root := filepath.Join(t.TempDir(), "root")
+	outside := t.TempDir()
+	bucketDir := filepath.Join(root, "bucket")
+
+	if err := os.MkdirAll(filepath.Join(bucketDir, "real"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{filepath.Join(bucketDir, "real", "object"), filepath.Join(outside, "victim")} {
+		if err := os.WriteFile(path, []byte("content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := []struct{ target, link string }{
+		{target: outside, link: filepath.Join(root, "escaped")},
+		{target: "real", link: filepath.Join(bucketDir, "inside")},
+		{target: root, link: filepath.Join(bucketDir, "to-root")},
+		{target: outside, link: filepath.Join(bucketDir, "escape")},
+		{target: "escape", link: filepath.Join(bucketDir, "via-inside")},
+		{target: filepath.Join(root, "missing"), link: filepath.Join(bucketDir, "dangling")},
+	}
+	for _, l := range links {
+		if err := os.Symlink(l.target, l.link); err != nil {
+			t.Skipf("symlinks are not supported: %v", err)
+		}
+	}
+
+	return root, outside
+}
+
+// newTestFileObjectStore returns a FileObjectStore for bucket "bucket" under
+// root, with versioning and signed URLs enabled so that every method is
+// supported.
+func newTestFileObjectStore(t *testing.T, root string) *FileObjectStore {
+	t.Helper()
+
+	keyFile := filepath.Join(t.TempDir(), "signing-key")
+	if err := os.WriteFile(keyFile, []byte(strings.Repeat("k", 32)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	log := logrus.New()
+	log.SetOutput(testLogWriter{t})
+	store := NewFileObjectStore(log)
+	err := store.Init(map[string]string{
+		rootConfigKey:             root,
+		"bucket":                  "bucket",
+		versioningConfigKey:       "true",
+		signedURLBaseURLConfigKey: "http://localhost:8085",
+		signedURLKeyFileConfigKey: keyFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// checkPathError fails the test unless err is an InvalidPathError for field
+// with a reason containing wantReason, or nil if wantReason is empty. An
+// empty field matches any field.
+func checkPathError(t *testing.T, err error, field, wantReason string) {
+	t.Helper()
+
+	if wantReason == "" {
+		if err != nil {
+			t.Errorf("got error %v, want none", err)
+		}
+		return
+	}
+
+	var pathErr *InvalidPathError
+	switch {
+	case !errors.As(err, &pathErr):
+		t.Errorf("got error %v, want an InvalidPathError", err)
+	case field != "" && pathErr.Field != field:
+		t.Errorf("got error for field %q, want %q: %v", pathErr.Field, field, err)
+	case !strings.Contains(pathErr.Reason, wantReason):
+		t.Errorf("got reason %q, want it to contain %q", pathErr.Reason, wantReason)
+	}
+}
+
+// testLogWriter sends log output to the test log.
+type testLogWriter struct {
+	t *testing.T
+}
+
+func (w testLogWriter) Write(p []byte) (int, error) {
+	w.t.Log(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
@@ -17,36 +17,411 @@ limitations under the License.
 package plugin
 
 import (
-	"errors"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// rootConfigKey is the BSL config key for the directory the store keeps its buckets in.
+	// If it is not set, the ARK_FILE_OBJECT_STORE_ROOT env var or defaultRoot is used.
+	rootConfigKey = "root"
+	// dirModeConfigKey is the BSL config key for the octal permissions of created directories.
+	dirModeConfigKey = "dirMode"
+	// fileModeConfigKey is the BSL config key for the octal permissions of created files.
+	fileModeConfigKey = "fileMode"
+
+	// signedURLBaseURLConfigKey is the BSL config key for the URL that clients
+	// reach the signed URL server at, e.g. "http://velero-files.velero.svc:8085".
+	// CreateSignedURL is only supported if it is set.
+	signedURLBaseURLConfigKey = "signedURLBaseURL"
+	// signedURLKeyFileConfigKey is the BSL config key for the path of a file,
+	// typically a mounted Secret, holding the HMAC key URLs are signed with.
+	// It is required if signedURLBaseURL is set.
+	signedURLKeyFileConfigKey = "signedURLKeyFile"
+
+	// encryptionKeyFileConfigKey is the BSL config key for the path of a keyring
+	// file, typically a mounted Secret. If it is set, objects are encrypted with
+	// the first key in the keyring. See loadKeyring for the file format.
+	encryptionKeyFileConfigKey = "encryptionKeyFile"
+
+	// compressionConfigKey is the BSL config key for the algorithm, "gzip" or
+	// "zstd", that objects are compressed with. Objects are stored as they are
+	// if it is not set.
+	compressionConfigKey = "compression"
+
+	// versioningConfigKey is the BSL config key to enable versioning. If it is
+	// "true", overwritten objects are kept as prior versions and deleted
+	// objects are moved to a trash, from where they can be restored until the
+	// trash retention has passed.
+	versioningConfigKey = "versioning"
+	// trashRetentionConfigKey is the BSL config key for how long prior
+	// versions and trashed objects are kept, e.g. "168h".
+	trashRetentionConfigKey = "trashRetention"
+
+	// objectLockModeConfigKey is the BSL config key for the object lock mode,
+	// "governance" or "compliance". If it is set, every object written is
+	// locked against being overwritten or deleted for the object lock retention.
+	objectLockModeConfigKey = "objectLockMode"
+	// objectLockRetentionConfigKey is the BSL config key for how long objects
+	// are locked for, e.g. "720h". It is required if objectLockMode is set.
+	objectLockRetentionConfigKey = "objectLockRetention"
+	// objectLockBypassGovernanceConfigKey is the BSL config key that, if
+	// "true", lets objects locked in governance mode be overwritten and deleted.
+	objectLockBypassGovernanceConfigKey = "objectLockBypassGovernance"
+
+	// bucketHardQuotaConfigKey and bucketSoftQuotaConfigKey are the BSL config
+	// keys for the quotas, such as "500Gi", on the size of the objects in the
+	// bucket. PutObject fails rather than exceed the hard quota, while
+	// exceeding the soft quota is only logged.
+	bucketHardQuotaConfigKey = "bucketHardQuota"
+	bucketSoftQuotaConfigKey = "bucketSoftQuota"
+	// prefixHardQuotaConfigKey and prefixSoftQuotaConfigKey are the BSL config
+	// keys for the quotas on the size of the objects under the prefix.
+	prefixHardQuotaConfigKey = "prefixHardQuota"
+	prefixSoftQuotaConfigKey = "prefixSoftQuota"
+
+	// replicasConfigKey is the BSL config key for a comma-separated list of
+	// directories that every object is mirrored to, laid out like the root.
+	replicasConfigKey = "replicas"
+	// replicationModeConfigKey is the BSL config key for whether replicas are
+	// updated before PutObject and DeleteObject return, "sync", or by a
+	// background goroutine from a durable queue, "async". It defaults to "sync".
+	replicationModeConfigKey = "replicationMode"
+
+	defaultDirMode  os.FileMode = 0755
+	defaultFileMode os.FileMode = 0644
+)
+
+// FileObjectStore is an object store plugin for Velero that keeps each bucket
+// in a directory on the local filesystem.
 type FileObjectStore struct {
 	log logrus.FieldLogger
+
+	// locations are the stores configured by Init, one per backup storage
+	// location. The settings below are those of the location a store is for,
+	// and never change once Init has configured them.
+	locations *storeLocations
+
+	// root, dirMode and fileMode are set from the config passed to Init, so
+	// that each BackupStorageLocation can use its own directory and permissions.
+	root     string
+	dirMode  os.FileMode
+	fileMode os.FileMode
+
+	// bucket and prefix are those of the BackupStorageLocation. Directories
+	// left empty by DeleteObject are removed up to, but not including, prefix.
+	bucket string
+	prefix string
+
+	// purgesExpired is true if the store purges the expired prior versions
+	// and trashed objects of its location. Only the store Velero configures
+	// does, since it is the one certain to have the location's own settings.
+	purgesExpired bool
+
+	// readOnly is true if the store is only used to look objects up. Init
+	// then never creates or cleans up anything in the location.
+	readOnly bool
+
+	// keyring holds the master keys for encrypting objects, or is nil if
+	// encryption is not configured.
+	keyring *keyring
+
+	// compression is the algorithm objects are compressed with, or compressionNone.
+	compression string
+
+	// versioning is true if overwritten and deleted objects are kept for trashRetention.
+	versioning     bool
+	trashRetention time.Duration
+
+	// objectLockMode is the lock mode objects are written under, or
+	// objectLockNone. Locks on existing objects are enforced regardless.
+	objectLockMode             string
+	objectLockRetention        time.Duration
+	objectLockBypassGovernance bool
+
+	// quotas are the limits on the size of the bucket and prefix.
+	quotas []quota
+
+	// replicas are the roots objects are mirrored to. If replicationQueues is
+	// set, they are mirrored asynchronously through those queues.
+	replicas          []string
+	replicationQueues []*replicationQueue
+
+	// signedURLKey is the key CreateSignedURL signs URLs with, or nil if
+	// signed URLs are not configured. signedURLStoreID identifies the
+	// location in its URLs.
+	signedURLKey     []byte
+	signedURLStoreID string
+	signedURLBaseURL string
 }
 
 // NewFileObjectStore instantiates a FileObjectStore.
 func NewFileObjectStore(log logrus.FieldLogger) *FileObjectStore {
-	return &FileObjectStore{log: log}
+	return &FileObjectStore{
+		log:           log,
+		locations:     &storeLocations{byBucket: make(map[string]map[string]*FileObjectStore)},
+		root:          getRoot(),
+		dirMode:       defaultDirMode,
+		fileMode:      defaultFileMode,
+		purgesExpired: true,
+	}
+}
+
+// OpenFileObjectStore returns a FileObjectStore initialized with config, for
+// use outside of the plugin Velero runs, such as by the snapshotter or the
+// commands of the plugin binary. Unlike the store Velero uses, it never purges
+// expired prior versions and trashed objects, as config need not have all
+// the settings of the backup storage location it is for.
+func OpenFileObjectStore(log logrus.FieldLogger, config map[string]string) (*FileObjectStore, error) {
+	store := NewFileObjectStore(log)
+	store.purgesExpired = false
+	if err := store.Init(config); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// OpenFileObjectStoreReadOnly returns a FileObjectStore initialized with
+// config for looking objects up, like OpenFileObjectStore, but without
+// creating the directory of the location or touching anything in it, so that
+// a mistyped root, bucket or prefix finds nothing rather than an empty
+// location. It must not be used to change objects.
+func OpenFileObjectStoreReadOnly(log logrus.FieldLogger, config map[string]string) (*FileObjectStore, error) {
+	store := NewFileObjectStore(log)
+	store.purgesExpired = false
+	store.readOnly = true
+	if err := store.Init(config); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// locationConfig returns the config of a FileObjectStore location that is
+// embedded in config with keyPrefix prepended to every key, such as
+// "exportBucket" and "exportObjectLockMode" for keyPrefix "export".
+func locationConfig(config map[string]string, keyPrefix string) map[string]string {
+	location := make(map[string]string)
+	for key, value := range config {
+		name := strings.TrimPrefix(key, keyPrefix)
+		if name == key || name == "" || name[0] < 'A' || name[0] > 'Z' {
+			continue
+		}
+		location[strings.ToLower(name[:1])+name[1:]] = value
+	}
+	return location
 }
 
 // Init initializes the plugin. After v0.10.0, this can be called multiple times.
+// Velero calls Init with the config of each BackupStorageLocation that uses the
+// plugin, and the settings of a location apply to the keys under its bucket and
+// prefix. Calling Init again for a location replaces its settings.
 func (f *FileObjectStore) Init(config map[string]string) error {
 	f.log.Infof("FileObjectStore.Init called")
 
-	path := filepath.Join(getRoot(), config["bucket"], config["prefix"])
-	return os.MkdirAll(path, 0755)
+	root := config[rootConfigKey]
+	if root == "" {
+		root = getRoot()
+	}
+	if !filepath.IsAbs(root) {
+		return errors.Errorf("%s must be an absolute path, got %q", rootConfigKey, root)
+	}
+
+	dirMode, err := parseFileMode(config, dirModeConfigKey, defaultDirMode)
+	if err != nil {
+		return err
+	}
+	fileMode, err := parseFileMode(config, fileModeConfigKey, defaultFileMode)
+	if err != nil {
+		return err
+	}
+
+	var kr *keyring
+	if keyFile := config[encryptionKeyFileConfigKey]; keyFile != "" {
+		if kr, err = loadKeyring(keyFile); err != nil {
+			return err
+		}
+	}
+
+	compression := config[compressionConfigKey]
+	if err := validateCompression(compression); err != nil {
+		return err
+	}
+
+	trashRetention := defaultTrashRetention
+	if value := config[trashRetentionConfigKey]; value != "" {
+		if trashRetention, err = time.ParseDuration(value); err != nil || trashRetention < 0 {
+			return errors.Errorf("%s must be a non-negative duration such as 168h, got %q", trashRetentionConfigKey, value)
+		}
+	}
+
+	lockMode := config[objectLockModeConfigKey]
+	if err := validateObjectLockMode(lockMode); err != nil {
+		return err
+	}
+	var lockRetention time.Duration
+	if lockMode != objectLockNone {
+		value := config[objectLockRetentionConfigKey]
+		if lockRetention, err = time.ParseDuration(value); err != nil || lockRetention <= 0 {
+			return errors.Errorf("%s must be a positive duration such as 720h when %s is set, got %q", objectLockRetentionConfigKey, objectLockModeConfigKey, value)
+		}
+	}
+
+	// The settings are configured on a new store, which replaces the one of
+	// the location only once it is complete, so that concurrent calls for
+	// this or other locations never see them half way through.
+	bucket := config["bucket"]
+	prefix, err := cleanKey("prefix", config["prefix"])
+	if err != nil {
+		return err
+	}
+
+	loc := &FileObjectStore{
+		log:                        f.log,
+		locations:                  f.locations,
+		root:                       filepath.Clean(root),
+		dirMode:                    dirMode,
+		fileMode:                   fileMode,
+		keyring:                    kr,
+		compression:                compression,
+		versioning:                 config[versioningConfigKey] == "true",
+		trashRetention:             trashRetention,
+		bucket:                     bucket,
+		prefix:                     prefix,
+		purgesExpired:              f.purgesExpired,
+		readOnly:                   f.readOnly,
+		objectLockMode:             lockMode,
+		objectLockRetention:        lockRetention,
+		objectLockBypassGovernance: config[objectLockBypassGovernanceConfigKey] == "true",
+	}
+
+	path, err := loc.resolvePath(bucket, "prefix", prefix)
+	if err != nil {
+		return err
+	}
+	if loc.readOnly {
+		f.locations.add(bucket, prefix, loc)
+		return nil
+	}
+	if err := os.MkdirAll(path, loc.dirMode); err != nil {
+		return err
+	}
+
+	// Clean up after any PutObject that was interrupted by a crash.
+	if err := cleanUpRoot(f.log, loc.root); err != nil {
+		return err
+	}
+
+	if err := loc.initQuotas(config); err != nil {
+		return err
+	}
+	if err := loc.initReplication(config); err != nil {
+		return err
+	}
+
+	if err := loc.initSignedURLs(config); err != nil {
+		return err
+	}
+
+	f.locations.add(bucket, prefix, loc)
+	return nil
+}
+
+// storeLocations are the settings of the backup storage locations a
+// FileObjectStore was initialized for. Velero shares one plugin instance
+// between all locations that use the plugin, and calls Init for each of them,
+// so the settings of a location are looked up by the bucket and key of each
+// call.
+type storeLocations struct {
+	lock sync.RWMutex
+	// byBucket holds the store configured for each location, by bucket and then prefix.
+	byBucket map[string]map[string]*FileObjectStore
+	// latest is the store of the location initialized most recently.
+	latest *FileObjectStore
+}
+
+func (l *storeLocations) add(bucket, prefix string, loc *FileObjectStore) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.byBucket[bucket] == nil {
+		l.byBucket[bucket] = make(map[string]*FileObjectStore)
+	}
+	l.byBucket[bucket][prefix] = loc
+	l.latest = loc
+}
+
+// location returns the store configured for the location that key, or
+// prefix, belongs to: the location in bucket with the longest prefix that
+// key is under. If no location in bucket has such a prefix, it is the
+// location initialized most recently, and if Init was never called, f itself.
+func (f *FileObjectStore) location(bucket, key string) *FileObjectStore {
+	f.locations.lock.RLock()
+	defer f.locations.lock.RUnlock()
+
+	var best *FileObjectStore
+	bestPrefix := ""
+	for prefix, loc := range f.locations.byBucket[bucket] {
+		if prefix != "" && key != prefix && !strings.HasPrefix(key, prefix+"/") {
+			continue
+		}
+		if best == nil || len(prefix) > len(bestPrefix) {
+			best, bestPrefix = loc, prefix
+		}
+	}
+	switch {
+	case best != nil:
+		return best
+	case f.locations.latest != nil:
+		return f.locations.latest
+	default:
+		return f
+	}
+}
+
+// initSignedURLs loads the key URLs are signed with and registers the
+// BackupStorageLocation with the signed URL server, if it is configured.
+func (f *FileObjectStore) initSignedURLs(config map[string]string) error {
+	baseURL := config[signedURLBaseURLConfigKey]
+	if baseURL == "" {
+		return nil
+	}
+	keyFile := config[signedURLKeyFileConfigKey]
+	if keyFile == "" {
+		return errors.Errorf("%s is required when %s is set", signedURLKeyFileConfigKey, signedURLBaseURLConfigKey)
+	}
+	key, err := readSigningKey(keyFile)
+	if err != nil {
+		return err
+	}
+
+	id := signedURLStoreID(f.root, f.bucket, f.prefix)
+	if err := f.registerSignedURLs(id, keyFile, config); err != nil {
+		return errors.Wrap(err, "error registering with the signed URL server")
+	}
+
+	f.signedURLKey = key
+	f.signedURLStoreID = id
+	f.signedURLBaseURL = baseURL
+	return nil
 }
 
 func (f *FileObjectStore) PutObject(bucket string, key string, body io.Reader) error {
-	path := filepath.Join(getRoot(), bucket, key)
+	return f.location(bucket, key).putObject(bucket, key, body)
+}
+
+func (f *FileObjectStore) putObject(bucket string, key string, body io.Reader) error {
+	path, err := f.resolvePath(bucket, "key", key)
+	if err != nil {
+		return err
+	}
 
 	log := f.log.WithFields(logrus.Fields{
 		"bucket": bucket,
@@ -55,28 +430,157 @@ func (f *FileObjectStore) PutObject(bucket string, key string, body io.Reader) e
 	})
 	log.Infof("PutObject")
 
-	dir := filepath.Dir(path)
-	log.Infof("Creating dir %s", dir)
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	// The trash is purged even if versioning has since been turned off.
+	f.purgeExpiredIfDue(bucket)
+
+	// Refuse to overwrite a locked object before anything is written. This
+	// is checked again once the change has begun.
+	if err := f.checkObjectLock(bucket, key, path); err != nil {
 		return err
 	}
+	oldSize := storedSize(path)
 
-	log.Infof("Creating file")
-	file, err := os.Create(path)
+	// Write to a temporary file and rename it into place, so that a crash or a
+	// full disk never leaves a truncated object behind for GetObject to serve.
+	file, err := f.createObjectFile(log, path)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+
+	// Hard quotas are checked before anything is written, and enforced on
+	// what is written to disk, after compression and encryption.
+	limited, release, err := f.reserveQuotas(key, path, oldSize, file)
+	if err != nil {
+		file.Abort()
+		return err
+	}
+	defer release()
+
+	md := new(objectMetadata)
+	f.lockObject(md)
+	w, err := f.newObjectWriter(limited, md)
+	if err != nil {
+		file.Abort()
+		return err
+	}
 
 	log.Infof("Writing to file")
-	_, err = io.Copy(file, body)
+	content := newHashingReader(body)
+	if _, err := io.Copy(w, content); err != nil {
+		file.Abort()
+		return errors.Wrapf(err, "error writing %s", path)
+	}
+	if err := w.Close(); err != nil {
+		file.Abort()
+		return errors.Wrapf(err, "error writing %s", path)
+	}
+
+	// The metadata goes in a footer of the same file, so that the object is
+	// renamed into place along with the metadata needed to verify it.
+	log.Infof("Writing metadata")
+	md.Size = content.size
+	md.SHA256 = content.Sum()
+	if err := writeObjectFooter(limited, md); err != nil {
+		file.Abort()
+		return errors.Wrapf(err, "error writing %s", path)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Abort()
+		return errors.WithStack(err)
+	}
+	if md.Compression != compressionNone && md.Size > 0 {
+		log.Infof("Compressed %d bytes to %d bytes with %s (%.1f%%)", md.Size, info.Size(), md.Compression, 100*float64(info.Size())/float64(md.Size))
+	}
+
+	done, err := f.beginChange(bucket, key)
+	if err != nil {
+		file.Abort()
+		return err
+	}
+	defer done()
+
+	// The object may have been replaced by a locked one while this one was
+	// written, but cannot be anymore until the change has ended.
+	if err := f.checkObjectLock(bucket, key, path); err != nil {
+		file.Abort()
+		return err
+	}
+	oldSize = storedSize(path)
+
+	// The prior version is replicated before the object that replaced it.
+	var replicated []string
+	if f.versioning {
+		log.Infof("Keeping prior version")
+		version, err := f.archiveVersion(bucket, path)
+		if err != nil {
+			file.Abort()
+			return err
+		}
+		if version != "" {
+			replicated = append(replicated, version)
+		}
+	}
+	replicated = append(replicated, path)
+
+	// The usage is updated before the object is put in place, and the room
+	// reserved for it released only then, so that the usage never falls
+	// short of what is stored. Failing to account for the object is not
+	// reported as a failure to store it. The object it replaced is still
+	// counted if it was kept as a prior version.
+	delta := info.Size()
+	if !f.versioning {
+		delta -= oldSize
+	}
+	if err := f.addUsage(bucket, path, delta); err != nil {
+		log.WithError(err).Warnf("Error updating usage")
+	}
+	release()
+
+	if err := file.Commit(f.fileMode); err != nil {
+		if err := f.addUsage(bucket, path, -delta); err != nil {
+			log.WithError(err).Warnf("Error updating usage")
+		}
+		return err
+	}
+
+	if err := f.replicate(bucket, key, replicated...); err != nil {
+		return err
+	}
 
 	log.Infof("Done")
-	return err
+	return nil
+}
+
+// createObjectFile creates the temporary file for writing the object at path,
+// along with its directory. A DeleteObject in a sibling key can remove the
+// directory again as soon as it is empty, in which case creating the file is
+// retried.
+func (f *FileObjectStore) createObjectFile(log logrus.FieldLogger, path string) (*atomicFile, error) {
+	dir := filepath.Dir(path)
+	for attempt := 1; ; attempt++ {
+		log.Infof("Creating dir %s", dir)
+		if err := os.MkdirAll(dir, f.dirMode); err != nil {
+			return nil, err
+		}
+
+		log.Infof("Creating file")
+		file, err := createAtomic(path)
+		if err == nil || !os.IsNotExist(errors.Cause(err)) || attempt == 3 {
+			return file, err
+		}
+	}
 }
 
 func (f *FileObjectStore) ObjectExists(bucket, key string) (bool, error) {
-	path := filepath.Join(getRoot(), bucket, key)
+	return f.location(bucket, key).objectExists(bucket, key)
+}
+
+func (f *FileObjectStore) objectExists(bucket, key string) (bool, error) {
+	path, err := f.resolvePath(bucket, "key", key)
+	if err != nil {
+		return false, err
+	}
 
 	log := f.log.WithFields(logrus.Fields{
 		"bucket": bucket,
@@ -85,7 +589,7 @@ func (f *FileObjectStore) ObjectExists(bucket, key string) (bool, error) {
 	})
 	log.Infof("ObjectExists")
 
-	_, err := os.Stat(path)
+	_, err = os.Stat(path)
 	if err == nil {
 		return true, nil
 	}
@@ -97,7 +601,14 @@ func (f *FileObjectStore) ObjectExists(bucket, key string) (bool, error) {
 }
 
 func (f *FileObjectStore) GetObject(bucket, key string) (io.ReadCloser, error) {
-	path := filepath.Join(getRoot(), bucket, key)
+	return f.location(bucket, key).getObject(bucket, key)
+}
+
+func (f *FileObjectStore) getObject(bucket, key string) (io.ReadCloser, error) {
+	path, err := f.resolvePath(bucket, "key", key)
+	if err != nil {
+		return nil, err
+	}
 
 	log := f.log.WithFields(logrus.Fields{
 		"bucket": bucket,
@@ -106,60 +617,122 @@ func (f *FileObjectStore) GetObject(bucket, key string) (io.ReadCloser, error) {
 	})
 	log.Infof("GetObject")
 
-	return os.Open(path)
+	if len(f.replicas) > 0 {
+		return f.openVerified(bucket, key, path)
+	}
+	return f.openObject(bucket, key, path)
 }
 
+// openObject returns the content of the object stored at path, which is
+// verified against its checksum as it is read.
+func (f *FileObjectStore) openObject(bucket, key, path string) (io.ReadCloser, error) {
+	object, err := openStoredObject(path)
+	if err != nil {
+		return nil, err
+	}
+	md := object.md
+
+	body, err := f.newObjectReader(readCloser{Reader: object.content, Closer: object}, md)
+	if err != nil {
+		object.Close()
+		return nil, errors.Wrapf(err, "error reading object %s", key)
+	}
+
+	if md == nil {
+		f.log.WithField("path", path).Warnf("No checksum recorded for object, its content will not be verified")
+		return body, nil
+	}
+
+	return newVerifyingReader(body, bucket, key, md), nil
+}
+
+// ListCommonPrefixes follows S3 semantics: for every object whose key starts
+// with prefix, the key is cut after the first delimiter that follows the
+// prefix, and the distinct results are returned in lexicographic order. The
+// returned values are full prefixes including the delimiter, e.g.
+// "backups/backup-1/" for prefix "backups/" and delimiter "/". Keys without a
+// delimiter after the prefix are objects, not common prefixes.
 func (f *FileObjectStore) ListCommonPrefixes(bucket, prefix, delimiter string) ([]string, error) {
-	path := filepath.Join(getRoot(), bucket, prefix, delimiter)
+	return f.location(bucket, prefix).listCommonPrefixes(bucket, prefix, delimiter)
+}
 
+func (f *FileObjectStore) listCommonPrefixes(bucket, prefix, delimiter string) ([]string, error) {
 	log := f.log.WithFields(logrus.Fields{
 		"bucket":    bucket,
 		"delimiter": delimiter,
-		"path":      path,
 		"prefix":    prefix,
 	})
 	log.Infof("ListCommonPrefixes")
 
-	infos, err := ioutil.ReadDir(path)
-	if err != nil {
+	if delimiter == "" {
+		return nil, nil
+	}
+
+	if _, err := f.resolvePath(bucket, "prefix", ""); err != nil {
 		return nil, err
 	}
 
-	var dirs []string
-	for _, info := range infos {
-		if info.IsDir() {
-			dirs = append(dirs, info.Name())
+	// Keys come in sorted order, so the keys sharing a common prefix are
+	// listed one after the other.
+	var prefixes []string
+	err := f.index(bucket).list(prefix, func(key string) error {
+		i := strings.Index(key[len(prefix):], delimiter)
+		if i < 0 {
+			return nil
 		}
+		commonPrefix := key[:len(prefix)+i+len(delimiter)]
+		if n := len(prefixes); n == 0 || prefixes[n-1] != commonPrefix {
+			prefixes = append(prefixes, commonPrefix)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return dirs, nil
+	return prefixes, nil
 }
 
+// ListObjects follows S3 semantics: it returns the full key of every object in
+// the bucket whose key starts with prefix, at any depth, in lexicographic order.
+// The prefix does not need to end at a "/"; "backups/ba" matches both
+// "backups/backup-1/velero-backup.json" and "backups/bar".
 func (f *FileObjectStore) ListObjects(bucket, prefix string) ([]string, error) {
-	path := filepath.Join(getRoot(), bucket, prefix)
+	return f.location(bucket, prefix).listObjects(bucket, prefix)
+}
 
+func (f *FileObjectStore) listObjects(bucket, prefix string) ([]string, error) {
 	log := f.log.WithFields(logrus.Fields{
 		"bucket": bucket,
 		"prefix": prefix,
-		"path":   path,
 	})
 	log.Infof("ListObjects")
 
-	infos, err := ioutil.ReadDir(path)
-	if err != nil {
+	if _, err := f.resolvePath(bucket, "prefix", ""); err != nil {
 		return nil, err
 	}
 
 	var objects []string
-	for _, info := range infos {
-		objects = append(objects, filepath.Join(prefix, info.Name()))
+	err := f.index(bucket).list(prefix, func(key string) error {
+		objects = append(objects, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return objects, nil
 }
 
 func (f *FileObjectStore) DeleteObject(bucket, key string) error {
-	path := filepath.Join(getRoot(), bucket, key)
+	return f.location(bucket, key).deleteObject(bucket, key)
+}
+
+func (f *FileObjectStore) deleteObject(bucket, key string) error {
+	path, err := f.resolvePath(bucket, "key", key)
+	if err != nil {
+		return err
+	}
 
 	log := f.log.WithFields(logrus.Fields{
 		"bucket": bucket,
@@ -168,43 +741,102 @@ func (f *FileObjectStore) DeleteObject(bucket, key string) error {
 	})
 	log.Infof("DeleteObject")
 
-	err := os.Remove(path)
+	f.purgeExpiredIfDue(bucket)
 
-	// This logic is specific to a file system; we need to clean up the backup directory
-	// if there's nothing left. "Normal" object stores only mimic directory structures and don't need this.
-	keyParts := strings.Split(key, "/")
-	var backupPath string
-	if len(keyParts) > 1 {
-		backupPath = filepath.Join(getRoot(), bucket, keyParts[0], keyParts[1])
+	done, err := f.beginChange(bucket, key)
+	if err != nil {
+		return err
 	}
-	if backupPath != "" {
-		infos, err := ioutil.ReadDir(backupPath)
-		if err != nil {
-			return err
-		}
-		if len(infos) == 0 {
-			l := f.log.WithFields(logrus.Fields{
-				"backupPath": backupPath,
-			})
-			l.Infof("Deleted backup directory")
-			os.Remove(backupPath)
-		}
+	defer done()
+
+	if err := f.checkObjectLock(bucket, key, path); err != nil {
+		return err
 	}
 
-	return err
+	// An object moved to the trash is still counted, until it is purged.
+	// The trashed copy is replicated before the object is removed.
+	freed := storedSize(path)
+	var replicated []string
+	if f.versioning {
+		var trashed string
+		trashed, err = f.moveToTrash(bucket, path)
+		replicated = append(replicated, trashed)
+		freed = 0
+	} else {
+		err = os.Remove(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := f.addUsage(bucket, path, -freed); err != nil {
+		log.WithError(err).Warnf("Error updating usage")
+	}
+
+	// This logic is specific to a file system: "normal" object stores only mimic
+	// directory structures, so directories left empty are removed as well.
+	if err := pruneEmptyParents(filepath.Dir(path), f.pruneRoot(bucket, path)); err != nil {
+		return errors.Wrapf(err, "deleted object %s, but failed to remove the directories left empty", key)
+	}
+
+	return f.replicate(bucket, key, append(replicated, path)...)
+}
+
+// pruneRoot returns the directory above which empty directories are never
+// removed when the object at path is deleted: the prefix of the backup
+// storage location if the object is in it, otherwise the bucket.
+func (f *FileObjectStore) pruneRoot(bucket, path string) string {
+	if prefixDir, err := f.resolvePath(bucket, "prefix", f.prefix); err == nil && isWithin(prefixDir, path) {
+		return prefixDir
+	}
+	return f.bucketDir(bucket)
+}
+
+// pruneEmptyParents removes dir and its parents as long as they are empty,
+// stopping below root. A directory that is not empty, because an object was
+// put in it concurrently, ends the pruning without an error. A directory that
+// no longer exists, because of a concurrent delete, is skipped.
+func pruneEmptyParents(dir, root string) error {
+	for ; dir != root && isWithin(root, dir); dir = filepath.Dir(dir) {
+		err := os.Remove(dir)
+		switch {
+		case err == nil, os.IsNotExist(err):
+		case isNotEmpty(dir, err):
+			return nil
+		default:
+			return errors.WithStack(err)
+		}
+	}
+	return nil
 }
 
 func (f *FileObjectStore) CreateSignedURL(bucket, key string, ttl time.Duration) (string, error) {
+	return f.location(bucket, key).createSignedURL(bucket, key, ttl)
+}
+
+func (f *FileObjectStore) createSignedURL(bucket, key string, ttl time.Duration) (string, error) {
 	log := f.log.WithFields(logrus.Fields{
 		"bucket": bucket,
 		"key":    key,
 	})
 	log.Infof("CreateSignedURL")
-	return "", errors.New("CreateSignedURL is not supported for this plugin")
+
+	if f.signedURLKey == nil {
+		return "", errors.Errorf("CreateSignedURL is not supported unless %s is set in the backup storage location config", signedURLBaseURLConfigKey)
+	}
+	if _, err := f.resolvePath(bucket, "key", key); err != nil {
+		return "", err
+	}
+	if bucket != f.bucket || (f.prefix != "" && !strings.HasPrefix(key, f.prefix+"/")) {
+		return "", errors.Errorf("CreateSignedURL is not supported for key %s in bucket %s, which is not in a backup storage location with %s set", key, bucket, signedURLBaseURLConfigKey)
+	}
+
+	return signURL(f.signedURLKey, f.signedURLBaseURL, f.signedURLStoreID, bucket, key, time.Now().Add(ttl)), nil
 }
 
 const defaultRoot = "/tmp/backups"
 
+// getRoot returns the store root used when a BackupStorageLocation does not set one in its config.
 func getRoot() string {
 	root := os.Getenv("ARK_FILE_OBJECT_STORE_ROOT")
 	if root != "" {
@@ -213,3 +845,18 @@ func getRoot() string {
 
 	return defaultRoot
 }
+
+// parseFileMode reads an octal permission value such as "0750" from config,
+// returning def if key is not set.
+func parseFileMode(config map[string]string, key string, def os.FileMode) (os.FileMode, error) {
+	value, ok := config[key]
+	if !ok || value == "" {
+		return def, nil
+	}
+
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode&^uint64(os.ModePerm) != 0 {
+		return 0, errors.Errorf("%s must be an octal permission such as 0755, got %q", key, value)
+	}
+	return os.FileMode(mode), nil
+}
@@ -0,0 +1,387 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// s3Model is a reference model of the listing semantics of S3, holding the
+// keys of a bucket in memory.
+type s3Model map[string]bool
+
+// listObjects returns the keys that start with prefix, in lexicographic order.
+func (m s3Model) listObjects(prefix string) []string {
+	var keys []string
+	for key := range m {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// listCommonPrefixes returns the distinct keys that start with prefix, cut
+// after the first delimiter that follows prefix, in lexicographic order.
+// Keys without a delimiter after prefix are not common prefixes, and with an
+// empty delimiter nothing is.
+func (m s3Model) listCommonPrefixes(prefix, delimiter string) []string {
+	if delimiter == "" {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var prefixes []string
+	for _, key := range m.listObjects(prefix) {
+		i := strings.Index(key[len(prefix):], delimiter)
+		if i < 0 {
+			continue
+		}
+		commonPrefix := key[:len(prefix)+i+len(delimiter)]
+		if !seen[commonPrefix] {
+			seen[commonPrefix] = true
+			prefixes = append(prefixes, commonPrefix)
+		}
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// TestListingMatchesS3 compares ListObjects and ListCommonPrefixes with the
+// S3 reference model, for a listing served from an index that is built by
+// walking the directory tree, from an index with changes in its journal, and
+// from an index whose journal was compacted into its keys file.
+func TestListingMatchesS3(t *testing.T) {
+	// Keys whose names continue past the end of a prefix, with characters
+	// that sort before and after "/", so that the order of keys differs from
+	// the order a naive walk of the directory tree returns them in.
+	initial := []string{
+		"backups/a",
+		"backups/a-1/velero-backup.json",
+		"backups/a-1/a-1-logs.gz",
+		"backups/a.json",
+		"backups/a0",
+		"backups/ab/velero-backup.json",
+		"backups/b/c/d/e",
+		"backups/b/c-d",
+		"backups/with space/velero-backup.json",
+		"backups/ünïcode/velero-backup.json",
+		"restores/r-1/restore-r-1-logs.gz",
+		"restores/r-1/restore-r-1-results.gz",
+		"top-level",
+	}
+	// Changes made after the index was built, which are only in its journal
+	// until it is compacted.
+	added := []string{
+		"backups/a-0/velero-backup.json",
+		"backups/a-1/a-1-volumesnapshots.json.gz",
+		"backups/aa",
+		"backups/b/c/d/f",
+		"backups/new/velero-backup.json",
+		"zz/last",
+	}
+	deleted := []string{
+		"backups/a0",
+		"backups/b/c/d/e",
+		"restores/r-1/restore-r-1-logs.gz",
+		"top-level",
+	}
+
+	modes := []struct {
+		name  string
+		setUp func(t *testing.T, store *FileObjectStore) s3Model
+	}{
+		{
+			name: "walked",
+			setUp: func(t *testing.T, store *FileObjectStore) s3Model {
+				model := putTestObjects(t, store, s3Model{}, initial)
+				if err := os.RemoveAll(store.location("bucket", "").index("bucket").dir); err != nil {
+					t.Fatal(err)
+				}
+				return model
+			},
+		},
+		{
+			name: "journal",
+			setUp: func(t *testing.T, store *FileObjectStore) s3Model {
+				return changeIndexedTestObjects(t, store, initial, added, deleted)
+			},
+		},
+		{
+			name: "compacted",
+			setUp: func(t *testing.T, store *FileObjectStore) s3Model {
+				model := changeIndexedTestObjects(t, store, initial, added, deleted)
+				ix := store.location("bucket", "").index("bucket")
+				err := ix.withLock(func() error {
+					journal, _, err := ix.readJournal()
+					if err == nil {
+						_, err = ix.compact(journal)
+					}
+					return err
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return model
+			},
+		},
+	}
+
+	prefixes := []string{
+		"",
+		"b",
+		"backups",
+		"backups/",
+		"backups/a",
+		"backups/a-",
+		"backups/a-1",
+		"backups/a-1/",
+		"backups/a/",
+		"backups/b/c",
+		"backups/b/c/d/f",
+		"backups/b/c/d/f/",
+		"backups/ü",
+		"restores/r-1/restore-r-1-",
+		"top",
+		"zz",
+		"zzz",
+	}
+	delimiters := []string{"", "/", "-", ".", ".json", "/velero-", "a"}
+
+	for _, mode := range modes {
+		t.Run(mode.name, func(t *testing.T) {
+			store := newTestFileObjectStore(t, t.TempDir())
+			model := mode.setUp(t, store)
+
+			for _, prefix := range prefixes {
+				got, err := store.ListObjects("bucket", prefix)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := model.listObjects(prefix); !equalKeys(got, want) {
+					t.Errorf("ListObjects(bucket, %q) = %q, want %q", prefix, got, want)
+				}
+
+				for _, delimiter := range delimiters {
+					got, err := store.ListCommonPrefixes("bucket", prefix, delimiter)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if want := model.listCommonPrefixes(prefix, delimiter); !equalKeys(got, want) {
+						t.Errorf("ListCommonPrefixes(bucket, %q, %q) = %q, want %q", prefix, delimiter, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestListingEmptyBucket(t *testing.T) {
+	store := newTestFileObjectStore(t, t.TempDir())
+
+	for _, bucket := range []string{"bucket", "missing"} {
+		objects, err := store.ListObjects(bucket, "")
+		if err != nil || len(objects) != 0 {
+			t.Errorf("ListObjects(%s, \"\") = %q, %v, want no objects", bucket, objects, err)
+		}
+		prefixes, err := store.ListCommonPrefixes(bucket, "", "/")
+		if err != nil || len(prefixes) != 0 {
+			t.Errorf("ListCommonPrefixes(%s, \"\", /) = %q, %v, want no prefixes", bucket, prefixes, err)
+		}
+	}
+}
+
+// changeIndexedTestObjects puts the initial objects, lists them so that the
+// index is built, and then puts and deletes objects so that the changes are
+// recorded in the journal.
+func changeIndexedTestObjects(t *testing.T, store *FileObjectStore, initial, added, deleted []string) s3Model {
+	t.Helper()
+
+	model := putTestObjects(t, store, s3Model{}, initial)
+	if _, err := store.ListObjects("bucket", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(store.location("bucket", "").index("bucket").dir, indexKeysFileName)); err != nil {
+		t.Fatalf("index was not built: %v", err)
+	}
+
+	model = putTestObjects(t, store, model, added)
+	for _, key := range deleted {
+		if err := store.DeleteObject("bucket", key); err != nil {
+			t.Fatal(err)
+		}
+		delete(model, key)
+	}
+	return model
+}
+
+// putTestObjects puts an object under each of keys in bucket "bucket" and
+// adds the keys to model.
+func putTestObjects(t *testing.T, store *FileObjectStore, model s3Model, keys []string) s3Model {
+	t.Helper()
+
+	for _, key := range keys {
+		if err := store.PutObject("bucket", key, strings.NewReader(key)); err != nil {
+			t.Fatal(err)
+		}
+		model[key] = true
+	}
+	return model
+}
+
+// equalKeys returns true if got and want hold the same keys in the same
+// order. A nil and an empty list are equal.
+func equalKeys(got, want []string) bool {
+	if len(got) == 0 && len(want) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(got, want)
+}
+
+// TestDeleteObjectPrunesEmptyDirs checks that DeleteObject removes the
+// directories it leaves empty, up to the prefix of the location for objects
+// in it and up to the bucket for others, and keeps those that are not empty.
+func TestDeleteObjectPrunesEmptyDirs(t *testing.T) {
+	root := t.TempDir()
+	log := logrus.New()
+	log.SetOutput(testLogWriter{t})
+	store := NewFileObjectStore(log)
+	if err := store.Init(map[string]string{rootConfigKey: root, "bucket": "bucket", "prefix": "velero"}); err != nil {
+		t.Fatal(err)
+	}
+	putTestObjects(t, store, s3Model{}, []string{
+		"velero/backups/backup-1/dir/a",
+		"velero/backups/backup-1/b",
+		"other/dir/c",
+	})
+	exists := func(dir string) bool {
+		_, err := os.Stat(filepath.Join(root, "bucket", filepath.FromSlash(dir)))
+		return err == nil
+	}
+
+	tests := []struct {
+		key     string
+		removed []string
+		kept    []string
+	}{
+		{
+			key:     "velero/backups/backup-1/dir/a",
+			removed: []string{"velero/backups/backup-1/dir"},
+			kept:    []string{"velero/backups/backup-1"},
+		},
+		{
+			key:     "velero/backups/backup-1/b",
+			removed: []string{"velero/backups"},
+			kept:    []string{"velero"},
+		},
+		{
+			key:     "other/dir/c",
+			removed: []string{"other"},
+			kept:    []string{""},
+		},
+	}
+	for _, test := range tests {
+		if err := store.DeleteObject("bucket", test.key); err != nil {
+			t.Fatal(err)
+		}
+		for _, dir := range test.removed {
+			if exists(dir) {
+				t.Errorf("deleting %s left %s", test.key, dir)
+			}
+		}
+		for _, dir := range test.kept {
+			if !exists(dir) {
+				t.Errorf("deleting %s removed %q", test.key, dir)
+			}
+		}
+	}
+}
+
+func TestIsNotEmpty(t *testing.T) {
+	dir := t.TempDir()
+	full := filepath.Join(dir, "full")
+	if err := os.MkdirAll(filepath.Join(full, "child"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	err := os.Remove(full)
+	if err == nil {
+		t.Fatal("removing a directory that is not empty succeeded")
+	}
+	if !isNotEmpty(full, err) {
+		t.Errorf("isNotEmpty(%v) = false for a directory that is not empty", err)
+	}
+	if err := os.Remove(filepath.Join(dir, "missing")); isNotEmpty(filepath.Join(dir, "missing"), err) {
+		t.Errorf("isNotEmpty(%v) = true for a directory that does not exist", err)
+	}
+}
+
+// TestLocationsKeepTheirSettings checks that objects are stored with the
+// root and permissions of the location whose bucket and prefix they are in,
+// whichever location was initialized last, and that the most specific
+// prefix wins.
+func TestLocationsKeepTheirSettings(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(testLogWriter{t})
+	store := NewFileObjectStore(log)
+
+	locations := []struct {
+		bucket, prefix, fileMode string
+		root                     string
+	}{
+		{bucket: "bucket", prefix: "a", fileMode: "0600"},
+		{bucket: "bucket", prefix: "a/nested", fileMode: "0640"},
+		{bucket: "bucket", prefix: "b", fileMode: "0644"},
+		{bucket: "other", fileMode: "0604"},
+	}
+	for i := range locations {
+		loc := &locations[i]
+		loc.root = t.TempDir()
+		err := store.Init(map[string]string{
+			rootConfigKey:     loc.root,
+			"bucket":          loc.bucket,
+			"prefix":          loc.prefix,
+			fileModeConfigKey: loc.fileMode,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, loc := range locations {
+		key := strings.TrimPrefix(loc.prefix+"/backups/backup-1/velero-backup.json", "/")
+		if err := store.PutObject(loc.bucket, key, strings.NewReader("content")); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(filepath.Join(loc.root, loc.bucket, filepath.FromSlash(key)))
+		if err != nil {
+			t.Errorf("%s/%s was not stored in the root of its location: %v", loc.bucket, key, err)
+			continue
+		}
+		if got := fmt.Sprintf("%04o", info.Mode().Perm()); got != loc.fileMode {
+			t.Errorf("%s/%s has mode %s, want %s", loc.bucket, key, got, loc.fileMode)
+		}
+	}
+}
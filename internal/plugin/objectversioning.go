@@ -0,0 +1,429 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// versionsDirName is the directory in each bucket that holds the prior
+	// versions of overwritten objects, as "<key>/<time overwritten>".
+	versionsDirName = internalNamePrefix + "versions"
+	// trashDirName is the directory in each bucket that holds deleted
+	// objects, as "<time deleted>/<key>".
+	trashDirName = internalNamePrefix + "trash"
+
+	// versionTimeFormat is used for the names of entries in the versions and
+	// trash directories. It sorts lexically in time order.
+	versionTimeFormat = "20060102T150405.000000000Z"
+
+	defaultTrashRetention = 30 * 24 * time.Hour
+
+	// purgeMarkerPrefix is prepended to the name of the file in each bucket
+	// whose modification time is when the expired prior versions and trashed
+	// objects of a location were last purged.
+	purgeMarkerPrefix = internalNamePrefix + "purged-"
+	// purgeInterval is how often the expired prior versions and trashed
+	// objects of a location are purged.
+	purgeInterval = time.Hour
+)
+
+// TrashedObject is an object that was deleted from a FileObjectStore with
+// versioning enabled and can still be restored.
+type TrashedObject struct {
+	Key       string
+	DeletedAt time.Time
+	// Size is the length of the object content in bytes.
+	Size int64
+}
+
+func (f *FileObjectStore) bucketDir(bucket string) string {
+	return filepath.Join(f.root, bucket)
+}
+
+// bucketKey returns the normalized key of the object stored at path.
+func (f *FileObjectStore) bucketKey(bucket, path string) (string, error) {
+	rel, err := filepath.Rel(f.bucketDir(bucket), path)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// moveObject moves the object stored at src to dst. Its metadata is in its
+// footer, so a single rename moves both.
+func (f *FileObjectStore) moveObject(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), f.dirMode); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return errors.WithStack(err)
+	}
+	return syncDir(filepath.Dir(dst))
+}
+
+// archiveVersion moves the current version of the object stored at path, if
+// there is one, into the versions directory, and returns its path there.
+func (f *FileObjectStore) archiveVersion(bucket, path string) (string, error) {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return "", nil
+	}
+
+	key, err := f.bucketKey(bucket, path)
+	if err != nil {
+		return "", err
+	}
+	version := filepath.Join(f.bucketDir(bucket), versionsDirName, filepath.FromSlash(key), time.Now().UTC().Format(versionTimeFormat))
+	return version, f.moveObject(path, version)
+}
+
+// moveToTrash moves the object stored at path into the trash, and returns
+// its path there.
+func (f *FileObjectStore) moveToTrash(bucket, path string) (string, error) {
+	if _, err := os.Lstat(path); err != nil {
+		return "", err
+	}
+
+	key, err := f.bucketKey(bucket, path)
+	if err != nil {
+		return "", err
+	}
+	trashed := filepath.Join(f.bucketDir(bucket), trashDirName, time.Now().UTC().Format(versionTimeFormat), filepath.FromSlash(key))
+	return trashed, f.moveObject(path, trashed)
+}
+
+// ListTrash returns the objects in the trash of bucket whose key starts with
+// prefix, ordered by key and then by deletion time.
+func (f *FileObjectStore) ListTrash(bucket, prefix string) ([]TrashedObject, error) {
+	return f.location(bucket, prefix).listTrash(bucket, prefix)
+}
+
+func (f *FileObjectStore) listTrash(bucket, prefix string) ([]TrashedObject, error) {
+	if _, err := f.resolvePath(bucket, "prefix", ""); err != nil {
+		return nil, err
+	}
+	trashDir := filepath.Join(f.bucketDir(bucket), trashDirName)
+
+	entries, err := os.ReadDir(trashDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var trashed []TrashedObject
+	for _, entry := range entries {
+		deletedAt, err := time.Parse(versionTimeFormat, entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+
+		dir := filepath.Join(trashDir, entry.Name())
+		err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || isInternalName(d.Name()) {
+				return nil
+			}
+
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			key := filepath.ToSlash(rel)
+			if !strings.HasPrefix(key, prefix) {
+				return nil
+			}
+
+			object := TrashedObject{Key: key, DeletedAt: deletedAt}
+			if md, err := readObjectMetadata(path); err == nil && md != nil {
+				object.Size = md.Size
+			} else if info, err := d.Info(); err == nil {
+				object.Size = info.Size()
+			}
+			trashed = append(trashed, object)
+			return nil
+		})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	sort.Slice(trashed, func(i, j int) bool {
+		if trashed[i].Key != trashed[j].Key {
+			return trashed[i].Key < trashed[j].Key
+		}
+		return trashed[i].DeletedAt.Before(trashed[j].DeletedAt)
+	})
+	return trashed, nil
+}
+
+// RestoreTrash moves the most recently deleted copy of every trashed object
+// whose key starts with prefix back into place, and returns the restored keys.
+// Objects that exist again under their key are left in the trash and reported
+// in the returned error.
+func (f *FileObjectStore) RestoreTrash(bucket, prefix string) ([]string, error) {
+	return f.location(bucket, prefix).restoreTrash(bucket, prefix)
+}
+
+func (f *FileObjectStore) restoreTrash(bucket, prefix string) ([]string, error) {
+	trashed, err := f.listTrash(bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	latest := make(map[string]TrashedObject)
+	for _, object := range trashed {
+		latest[object.Key] = object
+	}
+
+	var restored, conflicts []string
+	for _, object := range trashed {
+		if !latest[object.Key].DeletedAt.Equal(object.DeletedAt) {
+			continue
+		}
+
+		path, err := f.resolvePath(bucket, "key", object.Key)
+		if err != nil {
+			return restored, err
+		}
+		trashPath := filepath.Join(f.bucketDir(bucket), trashDirName, object.DeletedAt.Format(versionTimeFormat), filepath.FromSlash(object.Key))
+		done, err := f.beginChange(bucket, object.Key)
+		if err != nil {
+			return restored, err
+		}
+		if _, err := os.Lstat(path); err == nil {
+			done()
+			conflicts = append(conflicts, object.Key)
+			continue
+		}
+		err = f.moveObject(trashPath, path)
+		done()
+		if err != nil {
+			return restored, errors.Wrapf(err, "error restoring %s", object.Key)
+		}
+		if err := f.replicate(bucket, object.Key, path, trashPath); err != nil {
+			return restored, err
+		}
+		restored = append(restored, object.Key)
+	}
+
+	if err := pruneEmptyDirs(filepath.Join(f.bucketDir(bucket), trashDirName)); err != nil {
+		return restored, err
+	}
+	if len(conflicts) > 0 {
+		return restored, errors.Errorf("not restoring objects that exist again: %s", strings.Join(conflicts, ", "))
+	}
+	return restored, nil
+}
+
+// purgeExpired permanently removes the prior versions and trashed objects
+// under the prefix of the location that were superseded or deleted longer
+// than the trash retention ago, unless they are still locked. It returns the
+// number of objects removed.
+func (f *FileObjectStore) purgeExpired(bucket string) (int, error) {
+	now := time.Now()
+	cutoff := now.Add(-f.trashRetention)
+	purged := 0
+	remove := func(path, key string) error {
+		// Locks outlast the trash retention, and no location may bypass them
+		// to purge an object, since nobody asked for it to be deleted.
+		md, err := readObjectMetadata(path)
+		if err != nil {
+			f.log.WithError(err).WithField("path", path).Warnf("Not purging object whose lock cannot be read")
+			return nil
+		}
+		if md != nil && md.LockMode != objectLockNone && md.RetainUntil != nil && now.Before(*md.RetainUntil) {
+			return nil
+		}
+
+		size := storedSize(path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		purged++
+
+		if err := f.addUsage(bucket, filepath.Join(f.bucketDir(bucket), key), -size); err != nil {
+			f.log.WithError(err).WithField("path", path).Warnf("Error updating usage")
+		}
+		if err := f.replicate(bucket, filepath.ToSlash(key), path); err != nil {
+			f.log.WithError(err).WithField("path", path).Warnf("Error removing purged object from replicas")
+		}
+		return nil
+	}
+
+	// Trashed objects are grouped in one directory per deletion time.
+	trashDir := filepath.Join(f.bucketDir(bucket), trashDirName)
+	entries, err := os.ReadDir(trashDir)
+	if err != nil && !os.IsNotExist(err) {
+		return purged, errors.WithStack(err)
+	}
+	for _, entry := range entries {
+		deletedAt, err := time.Parse(versionTimeFormat, entry.Name())
+		if err != nil || deletedAt.After(cutoff) {
+			continue
+		}
+		dir := filepath.Join(trashDir, entry.Name())
+		err = walkObjectFiles(filepath.Join(dir, filepath.FromSlash(f.prefix)), func(path string, d fs.DirEntry) error {
+			key, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			return remove(path, key)
+		})
+		if err != nil {
+			return purged, err
+		}
+	}
+	if err := pruneEmptyDirs(trashDir); err != nil {
+		return purged, err
+	}
+
+	// Prior versions are files named after the time they were superseded.
+	versionsDir := filepath.Join(f.bucketDir(bucket), versionsDirName)
+	err = walkObjectFiles(filepath.Join(versionsDir, filepath.FromSlash(f.prefix)), func(path string, d fs.DirEntry) error {
+		supersededAt, err := time.Parse(versionTimeFormat, d.Name())
+		if err != nil || supersededAt.After(cutoff) {
+			return nil
+		}
+		key, err := filepath.Rel(versionsDir, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		return remove(path, key)
+	})
+	if err != nil {
+		return purged, err
+	}
+
+	return purged, pruneEmptyDirs(versionsDir)
+}
+
+// purgeExpiredIfDue runs purgeExpired for the location, if this store is the
+// one Velero configured for it and no process has done so in the last
+// purgeInterval. Failing to purge is only logged.
+func (f *FileObjectStore) purgeExpiredIfDue(bucket string) {
+	if !f.purgesExpired || bucket != f.bucket {
+		return
+	}
+
+	// The time of the last purge is kept as the modification time of a
+	// marker file, which is touched before purging so that concurrent plugin
+	// processes do not purge the same location at once.
+	sum := sha256.Sum256([]byte(f.prefix))
+	marker := filepath.Join(f.bucketDir(bucket), purgeMarkerPrefix+hex.EncodeToString(sum[:8]))
+	if info, err := os.Stat(marker); err == nil && time.Since(info.ModTime()) < purgeInterval {
+		return
+	}
+
+	log := f.log.WithField("bucket", bucket)
+	now := time.Now()
+	file, err := os.OpenFile(marker, os.O_WRONLY|os.O_CREATE, f.fileMode)
+	if err == nil {
+		file.Close()
+		err = os.Chtimes(marker, now, now)
+	}
+	if err != nil {
+		log.WithError(err).Warnf("Error recording the purge of expired prior versions and trashed objects")
+		return
+	}
+
+	purged, err := f.purgeExpired(bucket)
+	if purged > 0 {
+		log.Infof("Purged %d expired prior versions and trashed objects", purged)
+	}
+	if err != nil {
+		log.WithError(err).Warnf("Error purging expired prior versions and trashed objects")
+	}
+}
+
+// walkObjectFiles calls fn for every object file below dir, skipping
+// bookkeeping files. A dir that does not exist has no objects.
+func walkObjectFiles(dir string, fn func(path string, d fs.DirEntry) error) error {
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || isInternalName(d.Name()) {
+			return nil
+		}
+		return fn(path, d)
+	})
+	return errors.WithStack(err)
+}
+
+// pruneEmptyDirs removes every empty directory below dir, but not dir itself.
+func pruneEmptyDirs(dir string) error {
+	var dirs []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path != dir {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// Children come after their parents in walk order, so remove in reverse.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Remove(dirs[i]); err != nil && !os.IsNotExist(err) && !isNotEmpty(dirs[i], err) {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// isNotEmpty returns true if err, returned for removing the directory dir,
+// is because dir is not empty. The error for that differs between platforms,
+// and is EEXIST on some, so dir is checked for an entry instead.
+func isNotEmpty(dir string, err error) bool {
+	if err == nil {
+		return false
+	}
+	if os.IsExist(err) {
+		return true
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return false
+	}
+	defer d.Close()
+	names, _ := d.Readdirnames(1)
+	return len(names) > 0
+}
@@ -0,0 +1,159 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// storedVersions returns the content of the prior versions of key, oldest first.
+func storedVersions(t *testing.T, root, key string) []string {
+	t.Helper()
+
+	dir := filepath.Join(root, "bucket", versionsDirName, filepath.FromSlash(key))
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var versions []string
+	for _, entry := range entries {
+		object, err := openStoredObject(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(object.content)
+		object.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, string(data))
+	}
+	return versions
+}
+
+// TestVersioningAndTrash checks that overwritten objects are kept as prior
+// versions, and that deleted objects are hidden from listings until they are
+// restored from the trash.
+func TestVersioningAndTrash(t *testing.T) {
+	root := t.TempDir()
+	store := newTestFileObjectStore(t, root)
+	const key = "backups/backup-1/velero-backup.json"
+
+	for _, content := range []string{"v1", "v2", "v3"} {
+		if err := store.PutObject("bucket", key, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := storedVersions(t, root, key); !equalKeys(got, []string{"v1", "v2"}) {
+		t.Errorf("prior versions = %q, want [v1 v2]", got)
+	}
+
+	if err := store.DeleteObject("bucket", key); err != nil {
+		t.Fatal(err)
+	}
+	if objects, err := store.ListObjects("bucket", "backups/"); err != nil || len(objects) != 0 {
+		t.Errorf("ListObjects() after the delete = %q, %v, want nothing", objects, err)
+	}
+	trashed, err := store.ListTrash("bucket", "backups/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trashed) != 1 || trashed[0].Key != key {
+		t.Fatalf("ListTrash() = %+v, want %s", trashed, key)
+	}
+
+	restored, err := store.RestoreTrash("bucket", "backups/")
+	if err != nil || !equalKeys(restored, []string{key}) {
+		t.Fatalf("RestoreTrash() = %q, %v, want %s", restored, err, key)
+	}
+	if got, err := readTestObject(store, "bucket", key); err != nil || got != "v3" {
+		t.Errorf("restored object = %q, %v, want v3", got, err)
+	}
+	if trashed, err := store.ListTrash("bucket", ""); err != nil || len(trashed) != 0 {
+		t.Errorf("ListTrash() after the restore = %+v, %v, want nothing", trashed, err)
+	}
+
+	// An object put again under the key is not replaced by the trashed copy.
+	if err := store.DeleteObject("bucket", key); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutObject("bucket", key, strings.NewReader("v4")); err != nil {
+		t.Fatal(err)
+	}
+	if restored, err := store.RestoreTrash("bucket", ""); err == nil || len(restored) != 0 {
+		t.Errorf("RestoreTrash() over an existing object = %q, %v, want nothing and an error", restored, err)
+	}
+	if got, err := readTestObject(store, "bucket", key); err != nil || got != "v4" {
+		t.Errorf("object after a conflicting restore = %q, %v, want v4", got, err)
+	}
+}
+
+// TestPurgeExpired checks that prior versions and trashed objects are
+// removed once the trash retention has passed, along with the directories
+// they leave empty.
+func TestPurgeExpired(t *testing.T) {
+	root := t.TempDir()
+	log := logrus.New()
+	log.SetOutput(testLogWriter{t})
+	store := NewFileObjectStore(log)
+	err := store.Init(map[string]string{
+		rootConfigKey:           root,
+		"bucket":                "bucket",
+		versioningConfigKey:     "true",
+		trashRetentionConfigKey: "0s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"backups/backup-1/a", "backups/backup-1/a", "backups/backup-1/b"} {
+		if err := store.PutObject("bucket", key, strings.NewReader(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.DeleteObject("bucket", "backups/backup-1/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	purged, err := store.location("bucket", "").purgeExpired("bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 2 {
+		t.Errorf("purgeExpired() removed %d objects, want the prior version and the trashed object", purged)
+	}
+	for _, dir := range []string{versionsDirName, trashDirName} {
+		entries, err := os.ReadDir(filepath.Join(root, "bucket", dir))
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		if len(entries) != 0 {
+			t.Errorf("%s holds %d entries after the purge, want none", dir, len(entries))
+		}
+	}
+	if got, err := readTestObject(store, "bucket", "backups/backup-1/a"); err != nil || got != "backups/backup-1/a" {
+		t.Errorf("current object after the purge = %q, %v, want it kept", got, err)
+	}
+}
@@ -0,0 +1,493 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Usage is tracked for each directory a quota applies to in a usage file in
+// that directory. Every change to the objects below the directory, or to their
+// prior versions and trashed copies, updates the file, under an exclusive
+// lock, so usage is only computed by walking the tree the first time a quota
+// is configured for the directory. Because the files live with the data, all
+// plugin processes and the command line share them.
+//
+// Objects that are being written reserve room in the usage of the
+// directories with a hard quota as they grow, so that concurrent writes
+// cannot together exceed the quota. A reservation is recorded under the name
+// of the object's temporary file, and dropped once that file is gone.
+const (
+	usageFileName     = internalNamePrefix + "usage.json"
+	usageLockFileName = internalNamePrefix + "usage.lock"
+
+	// usageVersion is the version of the usage file format.
+	usageVersion = 1
+
+	// quotaReservationIncrement is how much room a write reserves at a time.
+	quotaReservationIncrement = 4 << 20
+)
+
+// QuotaExceededError is returned when writing an object would take the usage
+// of a bucket or prefix over its hard quota.
+type QuotaExceededError struct {
+	Bucket, Prefix, Key string
+	// Quota is the hard quota in bytes.
+	Quota int64
+	// Usage is the number of bytes in use before the object was written.
+	Usage int64
+}
+
+func (e *QuotaExceededError) Error() string {
+	scope := "bucket " + e.Bucket
+	if e.Prefix != "" {
+		scope = fmt.Sprintf("prefix %s in bucket %s", e.Prefix, e.Bucket)
+	}
+	return fmt.Sprintf("writing %s would exceed the hard quota of %d bytes for %s, which has %d bytes in use", e.Key, e.Quota, scope, e.Usage)
+}
+
+// quota is a limit on the bytes stored below dir, which is either a bucket or
+// a prefix in a bucket. A limit of 0 means there is none.
+type quota struct {
+	bucket, prefix string
+	dir            string
+	hard, soft     int64
+}
+
+// objectUsage is the content of a usage file.
+type objectUsage struct {
+	Version int `json:"version"`
+	// Bytes is the total size on disk of the objects below the directory,
+	// including their prior versions and trashed copies.
+	Bytes int64 `json:"bytes"`
+	// Reserved holds the room reserved by each object being written, by the
+	// path of its temporary file relative to the directory.
+	Reserved map[string]int64 `json:"reserved,omitempty"`
+}
+
+// reserved returns the total room reserved by objects being written.
+func (u *objectUsage) reserved() int64 {
+	var total int64
+	for _, n := range u.Reserved {
+		total += n
+	}
+	return total
+}
+
+// parseQuota returns the size set for key in config, or 0 if it is not set.
+func parseQuota(config map[string]string, key string) (int64, error) {
+	value := config[key]
+	if value == "" {
+		return 0, nil
+	}
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil || quantity.Sign() <= 0 {
+		return 0, errors.Errorf("%s must be a positive size such as 500Gi, got %q", key, value)
+	}
+	return quantity.Value(), nil
+}
+
+// initQuotas sets up the quotas in config and the usage tracking they need.
+func (f *FileObjectStore) initQuotas(config map[string]string) error {
+	f.quotas = nil
+
+	bucketHard, err := parseQuota(config, bucketHardQuotaConfigKey)
+	if err != nil {
+		return err
+	}
+	bucketSoft, err := parseQuota(config, bucketSoftQuotaConfigKey)
+	if err != nil {
+		return err
+	}
+	prefixHard, err := parseQuota(config, prefixHardQuotaConfigKey)
+	if err != nil {
+		return err
+	}
+	prefixSoft, err := parseQuota(config, prefixSoftQuotaConfigKey)
+	if err != nil {
+		return err
+	}
+
+	bucket, prefix := config["bucket"], f.prefix
+	if bucketHard > 0 || bucketSoft > 0 {
+		f.quotas = append(f.quotas, quota{bucket: bucket, dir: f.bucketDir(bucket), hard: bucketHard, soft: bucketSoft})
+	}
+	if prefixHard > 0 || prefixSoft > 0 {
+		dir, err := f.resolvePath(bucket, "prefix", prefix)
+		if err != nil {
+			return err
+		}
+		if dir == f.bucketDir(bucket) {
+			return errors.Errorf("%s and %s require a prefix", prefixHardQuotaConfigKey, prefixSoftQuotaConfigKey)
+		}
+		f.quotas = append(f.quotas, quota{bucket: bucket, prefix: prefix, dir: dir, hard: prefixHard, soft: prefixSoft})
+	}
+
+	for _, q := range f.quotas {
+		used, err := f.loadUsage(q)
+		if err != nil {
+			return err
+		}
+		f.warnSoftQuota(q, used)
+	}
+	return nil
+}
+
+// reserveQuotas returns an error if storing an object at path, in place of
+// oldSize bytes, would exceed a hard quota whatever its size. Otherwise it
+// returns a writer to file that reserves room under the hard quotas as the
+// object is written through it, and fails once there is none left, along
+// with the function that releases the reservation. It must be called once
+// the usage of the object has been added, or it is aborted.
+func (f *FileObjectStore) reserveQuotas(key, path string, oldSize int64, file *atomicFile) (io.Writer, func(), error) {
+	r := &quotaReservation{f: f, key: key}
+	for _, q := range f.quotas {
+		if q.hard == 0 || !isWithin(q.dir, path) {
+			continue
+		}
+		tmp, err := filepath.Rel(q.dir, file.Name())
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		r.quotas = append(r.quotas, q)
+		r.names = append(r.names, tmp)
+	}
+	if len(r.quotas) == 0 {
+		return file, func() {}, nil
+	}
+
+	// A prior version is kept of the object being replaced, so it only
+	// makes room if versioning is off.
+	if !f.versioning {
+		r.credit = oldSize
+	}
+
+	w := &quotaWriter{w: file, reservation: r}
+	if err := r.reserve(0, &w.remaining); err != nil {
+		return nil, nil, err
+	}
+	return w, r.release, nil
+}
+
+// quotaReservation is the room an object being written has reserved under
+// the hard quotas it counts against.
+type quotaReservation struct {
+	f   *FileObjectStore
+	key string
+	// quotas are the hard quotas, and names the names the reservation is
+	// recorded under in the usage of their directories.
+	quotas []quota
+	names  []string
+	// credit is the number of bytes the object frees by replacing another.
+	credit   int64
+	reserved int64
+	released bool
+}
+
+// reserve reserves room for at least need more bytes, and up to
+// quotaReservationIncrement, and adds the room reserved to remaining. It
+// returns a *QuotaExceededError if a hard quota leaves less room than need,
+// or none at all. The usage of all directories is locked at once, so that
+// the room reserved is the same under every quota.
+func (r *quotaReservation) reserve(need int64, remaining *int64) error {
+	grant := max(need, quotaReservationIncrement)
+	usages := make([]*objectUsage, len(r.quotas))
+
+	var lockAll func(i int) error
+	lockAll = func(i int) error {
+		if i < len(r.quotas) {
+			return withUsageLock(r.quotas[i].dir, func() error {
+				usage, err := r.f.trackedUsage(r.quotas[i])
+				if err != nil {
+					return err
+				}
+				usages[i] = usage
+				return lockAll(i + 1)
+			})
+		}
+
+		for i, q := range r.quotas {
+			usage := usages[i]
+			pruneReservations(q.dir, usage)
+			room := q.hard - (usage.Bytes - r.credit + usage.reserved())
+			if room < need || room <= 0 {
+				return &QuotaExceededError{Bucket: q.bucket, Prefix: q.prefix, Key: r.key, Quota: q.hard, Usage: usage.Bytes}
+			}
+			grant = min(grant, room)
+		}
+		for i, q := range r.quotas {
+			usages[i].Reserved[r.names[i]] = r.reserved + grant
+			if err := writeUsage(q.dir, usages[i], r.f.fileMode); err != nil {
+				return err
+			}
+		}
+		r.reserved += grant
+		*remaining += grant
+		return nil
+	}
+	return lockAll(0)
+}
+
+// release drops the reservation, unless it was already. Failing to is only
+// logged, since the reservation is dropped anyway once the temporary file is
+// gone.
+func (r *quotaReservation) release() {
+	if r.released {
+		return
+	}
+	r.released = true
+
+	for i, q := range r.quotas {
+		err := withUsageLock(q.dir, func() error {
+			usage, err := readUsage(q.dir)
+			if err != nil || usage == nil {
+				return err
+			}
+			if _, ok := usage.Reserved[r.names[i]]; !ok {
+				return nil
+			}
+			delete(usage.Reserved, r.names[i])
+			return writeUsage(q.dir, usage, r.f.fileMode)
+		})
+		if err != nil {
+			r.f.log.WithError(err).WithField("dir", q.dir).Warnf("Error releasing reserved usage")
+		}
+	}
+}
+
+// pruneReservations drops the reservations in usage of objects whose
+// temporary file in dir is gone, because they were committed or aborted, or
+// the process writing them crashed and the file was cleaned up.
+func pruneReservations(dir string, usage *objectUsage) {
+	if usage.Reserved == nil {
+		usage.Reserved = make(map[string]int64)
+	}
+	for name := range usage.Reserved {
+		if _, err := os.Lstat(filepath.Join(dir, name)); os.IsNotExist(err) {
+			delete(usage.Reserved, name)
+		}
+	}
+}
+
+// warnSoftQuota logs a warning if used exceeds the soft quota of q.
+func (f *FileObjectStore) warnSoftQuota(q quota, used int64) {
+	if q.soft > 0 && used > q.soft {
+		f.log.WithField("bucket", q.bucket).WithField("prefix", q.prefix).Warnf("Usage of %d bytes exceeds the soft quota of %d bytes", used, q.soft)
+	}
+}
+
+// quotaWriter reserves more room whenever more is written to it than it has
+// reserved, and fails once the quotas have no more room.
+type quotaWriter struct {
+	w           io.Writer
+	reservation *quotaReservation
+	remaining   int64
+}
+
+func (q *quotaWriter) Write(p []byte) (int, error) {
+	if need := int64(len(p)) - q.remaining; need > 0 {
+		if err := q.reservation.reserve(need, &q.remaining); err != nil {
+			return 0, err
+		}
+	}
+	n, err := q.w.Write(p)
+	q.remaining -= int64(n)
+	return n, err
+}
+
+// storedSize returns the size on disk of the object at path, or 0 if there is none.
+func storedSize(path string) int64 {
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return 0
+	}
+	return info.Size()
+}
+
+// addUsage adds delta to the usage of every tracked directory that holds the
+// object at path, from its own directory up to and including the bucket.
+// Changes to the prior versions and trashed copies of an object are added
+// with the path of the object itself. Soft quotas of the store that are
+// exceeded as a result are logged.
+func (f *FileObjectStore) addUsage(bucket, path string, delta int64) error {
+	if delta == 0 {
+		return nil
+	}
+
+	bucketDir := f.bucketDir(bucket)
+	for dir := filepath.Dir(path); isWithin(bucketDir, dir); dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, usageFileName)); os.IsNotExist(err) {
+			continue
+		}
+
+		var used int64
+		err := withUsageLock(dir, func() error {
+			usage, err := readUsage(dir)
+			if err != nil || usage == nil {
+				return err
+			}
+			usage.Bytes += delta
+			if usage.Bytes < 0 {
+				usage.Bytes = 0
+			}
+			used = usage.Bytes
+			return writeUsage(dir, usage, f.fileMode)
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, q := range f.quotas {
+			if q.dir == dir && delta > 0 {
+				f.warnSoftQuota(q, used)
+			}
+		}
+		if dir == bucketDir {
+			break
+		}
+	}
+	return nil
+}
+
+// loadUsage returns the usage of the directory of q, computing it and
+// starting to track it if it is not tracked yet.
+func (f *FileObjectStore) loadUsage(q quota) (int64, error) {
+	var used int64
+	err := withUsageLock(q.dir, func() error {
+		usage, err := f.trackedUsage(q)
+		if err != nil {
+			return err
+		}
+		used = usage.Bytes
+		return nil
+	})
+	return used, err
+}
+
+// trackedUsage returns the usage of the directory of q, computing it and
+// starting to track it if it is not tracked yet. It must be called with the
+// usage lock of the directory held.
+func (f *FileObjectStore) trackedUsage(q quota) (*objectUsage, error) {
+	usage, err := readUsage(q.dir)
+	if err != nil || usage != nil {
+		return usage, err
+	}
+
+	f.log.WithField("dir", q.dir).Infof("Computing usage")
+	if usage, err = computeUsage(f.bucketDir(q.bucket), q.dir); err != nil {
+		return nil, err
+	}
+	if err := writeUsage(q.dir, usage, f.fileMode); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// computeUsage totals the size of the objects below dir, which is bucketDir
+// or a directory in it, and of their prior versions and trashed copies.
+func computeUsage(bucketDir, dir string) (*objectUsage, error) {
+	usage := &objectUsage{Version: usageVersion}
+	add := func(path string, d fs.DirEntry) error {
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		usage.Bytes += info.Size()
+		return nil
+	}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if isInternalName(d.Name()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return add(path, d)
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// Prior versions are kept as "<key>/<time>", and trashed objects as
+	// "<time>/<key>", so those of the objects below dir are found below
+	// its path relative to the bucket.
+	rel, err := filepath.Rel(bucketDir, dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := walkObjectFiles(filepath.Join(bucketDir, versionsDirName, rel), add); err != nil {
+		return nil, err
+	}
+	trashDir := filepath.Join(bucketDir, trashDirName)
+	entries, err := os.ReadDir(trashDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.WithStack(err)
+	}
+	for _, entry := range entries {
+		if err := walkObjectFiles(filepath.Join(trashDir, entry.Name(), rel), add); err != nil {
+			return nil, err
+		}
+	}
+	return usage, nil
+}
+
+// readUsage reads the usage file in dir. It returns nil and no error if dir
+// is not tracked.
+func readUsage(dir string) (*objectUsage, error) {
+	data, err := os.ReadFile(filepath.Join(dir, usageFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	usage := new(objectUsage)
+	if err := json.Unmarshal(data, usage); err != nil {
+		return nil, errors.Wrapf(err, "error decoding usage of %s", dir)
+	}
+	return usage, nil
+}
+
+func writeUsage(dir string, usage *objectUsage, perm os.FileMode) error {
+	data, err := json.Marshal(usage)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return writeFileAtomic(filepath.Join(dir, usageFileName), bytes.NewReader(data), perm)
+}
+
+// withUsageLock runs fn while holding the exclusive lock on the usage file in dir.
+func withUsageLock(dir string, fn func() error) error {
+	return withFileLock(filepath.Join(dir, usageLockFileName), fn)
+}
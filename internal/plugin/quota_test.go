@@ -0,0 +1,79 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// TestQuotaReservationsAreReleasedOnFailure checks that writes that exceed
+// the hard quota or fail to read their content leave no room reserved, so
+// that the quota is still available to the writes that follow.
+func TestQuotaReservationsAreReleasedOnFailure(t *testing.T) {
+	root := t.TempDir()
+	log := logrus.New()
+	log.SetOutput(testLogWriter{t})
+	store := NewFileObjectStore(log)
+	err := store.Init(map[string]string{
+		rootConfigKey:            root,
+		"bucket":                 "bucket",
+		bucketHardQuotaConfigKey: "1Ki",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNoReservations := func(t *testing.T) {
+		t.Helper()
+		usage, err := readUsage(filepath.Join(root, "bucket"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usage != nil && len(usage.Reserved) != 0 {
+			t.Errorf("usage has reservations %v after the write, want none", usage.Reserved)
+		}
+	}
+
+	var quotaErr *QuotaExceededError
+	err = store.PutObject("bucket", "backups/too-large", bytes.NewReader(testContent(2000)))
+	if !errors.As(err, &quotaErr) {
+		t.Errorf("PutObject() of 2000 bytes returned %v, want a QuotaExceededError", err)
+	}
+	checkNoReservations(t)
+
+	err = store.PutObject("bucket", "backups/failed", io.MultiReader(bytes.NewReader(testContent(500)), failingReader{}))
+	if err == nil {
+		t.Errorf("PutObject() of a failing reader succeeded, want an error")
+	}
+	checkNoReservations(t)
+
+	if err := store.PutObject("bucket", "backups/fits", bytes.NewReader(testContent(500))); err != nil {
+		t.Fatalf("PutObject() of 500 bytes after the failed writes returned %v, want it to fit", err)
+	}
+	checkNoReservations(t)
+
+	err = store.PutObject("bucket", "backups/over", bytes.NewReader(testContent(600)))
+	if !errors.As(err, &quotaErr) {
+		t.Errorf("PutObject() of 600 more bytes returned %v, want a QuotaExceededError", err)
+	}
+	checkNoReservations(t)
+}
@@ -0,0 +1,576 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	replicationSync  = "sync"
+	replicationAsync = "async"
+
+	// replicationDirName is the directory in the store root that holds a
+	// queue of keys waiting to be replicated for each replica.
+	replicationDirName = internalNamePrefix + "replication"
+	// replicationLockFileName is locked by the process draining a queue.
+	replicationLockFileName = internalNamePrefix + "lock"
+
+	// replicationRetryInterval is how often a queue is drained when nothing
+	// new is queued, which retries keys that failed to replicate.
+	replicationRetryInterval = time.Minute
+
+	// verifiedReadAheadSize is how much of an object GetObject reads ahead
+	// when there are replicas. A mismatch with the checksum is only found at
+	// the end of the content, so objects up to this size are verified before
+	// any of their content is returned, and a copy that does not match can
+	// always be failed over from.
+	verifiedReadAheadSize = 4 << 20
+)
+
+// replicationEntry is a queued key, or a prior version or trashed copy of it.
+// The replica is made to match the primary copy as it is when the entry is
+// processed, so entries can be processed more than once and in any number.
+type replicationEntry struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	// Path is the path relative to the bucket of the prior version or
+	// trashed copy of the key to replicate, if it is not the key itself.
+	Path string `json:"path,omitempty"`
+	// Prefix, DirMode and FileMode are the settings of the backup storage
+	// location the key was written through. Several locations can share a
+	// root, and so its queues, so the replica is written with these rather
+	// than the settings of the location that last configured the queue.
+	Prefix   string      `json:"prefix"`
+	DirMode  os.FileMode `json:"dirMode"`
+	FileMode os.FileMode `json:"fileMode"`
+}
+
+// replicationQueues are the async replication queues of this process, keyed by
+// queue directory.
+var (
+	replicationQueues     = make(map[string]*replicationQueue)
+	replicationQueuesLock sync.Mutex
+	replicationEntrySeq   int64
+)
+
+// replicationQueue is a durable queue of keys to replicate to one replica,
+// drained by a goroutine. Its store is only used for the settings that all
+// locations using the queue share, such as the root.
+type replicationQueue struct {
+	dir     string
+	replica string
+	log     logrus.FieldLogger
+	wake    chan struct{}
+
+	lock  sync.Mutex
+	store *FileObjectStore
+}
+
+// parseReplicas returns the replica roots in config, which must be absolute
+// and distinct from root.
+func parseReplicas(config map[string]string, root string) ([]string, error) {
+	value := config[replicasConfigKey]
+	if value == "" {
+		return nil, nil
+	}
+
+	var replicas []string
+	for _, replica := range strings.Split(value, ",") {
+		replica = strings.TrimSpace(replica)
+		if !filepath.IsAbs(replica) {
+			return nil, errors.Errorf("%s must be a comma-separated list of absolute paths, got %q", replicasConfigKey, value)
+		}
+		replica = filepath.Clean(replica)
+		if isWithin(root, replica) || isWithin(replica, root) {
+			return nil, errors.Errorf("replica %s must not overlap with root %s", replica, root)
+		}
+		replicas = append(replicas, replica)
+	}
+	return replicas, nil
+}
+
+// initReplication sets up replication as configured in config, and starts
+// draining the queues of the store root if replication is async.
+func (f *FileObjectStore) initReplication(config map[string]string) error {
+	f.replicas = nil
+	f.replicationQueues = nil
+
+	replicas, err := parseReplicas(config, f.root)
+	if err != nil {
+		return err
+	}
+	mode := config[replicationModeConfigKey]
+	switch mode {
+	case "", replicationSync, replicationAsync:
+	default:
+		return errors.Errorf("unsupported replication mode %q, must be %s or %s", mode, replicationSync, replicationAsync)
+	}
+
+	f.replicas = replicas
+	if mode != replicationAsync {
+		return nil
+	}
+
+	for _, replica := range replicas {
+		queue, err := f.getReplicationQueue(replica)
+		if err != nil {
+			return err
+		}
+		f.replicationQueues = append(f.replicationQueues, queue)
+	}
+	return nil
+}
+
+// getReplicationQueue returns the queue of the store for replica, and starts
+// draining it if this process is not doing so yet.
+func (f *FileObjectStore) getReplicationQueue(replica string) (*replicationQueue, error) {
+	sum := sha256.Sum256([]byte(replica))
+	dir := filepath.Join(f.root, replicationDirName, hex.EncodeToString(sum[:8]))
+
+	if err := os.MkdirAll(dir, f.dirMode); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if _, err := removeStaleTempFiles(dir); err != nil {
+		return nil, err
+	}
+
+	replicationQueuesLock.Lock()
+	defer replicationQueuesLock.Unlock()
+
+	// The queue keeps the most recent store for the root, whose location
+	// settings are replaced by those recorded in each entry.
+	store := *f
+	if queue, ok := replicationQueues[dir]; ok {
+		queue.lock.Lock()
+		queue.store = &store
+		queue.lock.Unlock()
+		queue.notify()
+		return queue, nil
+	}
+
+	queue := &replicationQueue{
+		dir:     dir,
+		replica: replica,
+		log:     f.log.WithField("replica", replica),
+		wake:    make(chan struct{}, 1),
+		store:   &store,
+	}
+	replicationQueues[dir] = queue
+	go queue.run()
+	return queue, nil
+}
+
+// replicate brings the replicas of the objects at paths, which are key or
+// its prior versions and trashed copies, up to date in order, or queues them
+// for that if replication is async.
+func (f *FileObjectStore) replicate(bucket, key string, paths ...string) error {
+	if len(f.replicationQueues) > 0 {
+		for _, path := range paths {
+			rel, err := f.bucketKey(bucket, path)
+			if err != nil {
+				return err
+			}
+			entry := replicationEntry{Bucket: bucket, Key: key, Prefix: f.prefix, DirMode: f.dirMode, FileMode: f.fileMode}
+			if rel != key {
+				entry.Path = rel
+			}
+			for _, queue := range f.replicationQueues {
+				if err := queue.add(entry, f.fileMode); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	var failed []string
+	for _, replica := range f.replicas {
+		for _, path := range paths {
+			if err := f.mirror(bucket, path, replica); err != nil {
+				f.log.WithError(err).WithField("replica", replica).Errorf("Error replicating object")
+				failed = append(failed, replica)
+				break
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("error replicating %s to %s", key, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// replicaPath returns the path that the object stored at path has in replica.
+func (f *FileObjectStore) replicaPath(path, replica string) (string, error) {
+	rel, err := filepath.Rel(f.root, path)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return filepath.Join(replica, rel), nil
+}
+
+// mirror makes the copy of the object at path in replica match it, removing
+// the copy and the directories left empty if the object no longer exists.
+func (f *FileObjectStore) mirror(bucket, path, replica string) error {
+	dst, err := f.replicaPath(path, replica)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+
+		root, err := f.replicaPath(f.pruneRoot(bucket, path), replica)
+		if err != nil {
+			return err
+		}
+		return pruneEmptyParents(filepath.Dir(dst), root)
+	}
+
+	// Like in PutObject, the directory can be pruned by a concurrent delete
+	// of a sibling key before the copy is created in it.
+	for attempt := 1; ; attempt++ {
+		err := f.copyObject(path, dst)
+		if err == nil || !os.IsNotExist(errors.Cause(err)) || attempt == 3 {
+			return err
+		}
+	}
+}
+
+// copyObject atomically copies the object at src to dst, along with the
+// metadata in its footer.
+func (f *FileObjectStore) copyObject(src, dst string) error {
+	object, err := openStoredObject(src)
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), f.dirMode); err != nil {
+		return errors.WithStack(err)
+	}
+
+	file, err := createAtomic(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, object.content); err != nil {
+		file.Abort()
+		return errors.Wrapf(err, "error copying %s", src)
+	}
+	if object.md != nil {
+		if err := writeObjectFooter(file, object.md); err != nil {
+			file.Abort()
+			return errors.Wrapf(err, "error copying %s", src)
+		}
+	}
+	return file.Commit(f.fileMode)
+}
+
+// openVerified returns the content of the object at path, read from the
+// first of its copies, starting with the primary, that can be opened. The
+// content is verified against its checksum as it is read, and reading fails
+// over to the next copy if the current one fails or does not match.
+// Failing over once content has been returned needs the next copy to start
+// with that content, which is not the case if the current copy returned
+// corrupt content, so the start of the object is read ahead.
+func (f *FileObjectStore) openVerified(bucket, key, path string) (io.ReadCloser, error) {
+	copies := []string{path}
+	for _, replica := range f.replicas {
+		copyPath, err := f.replicaPath(path, replica)
+		if err != nil {
+			return nil, err
+		}
+		copies = append(copies, copyPath)
+	}
+
+	r := &failoverReader{f: f, bucket: bucket, key: key, primary: path, copies: copies, sent: sha256.New()}
+	var firstErr error
+	for len(r.copies) > 0 {
+		err := r.next()
+		if err == nil {
+			break
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if r.current == nil {
+		return nil, firstErr
+	}
+
+	if err := r.readAhead(verifiedReadAheadSize); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// failoverReader reads an object from one of its copies at a time. When
+// reading a copy fails, including because it does not match its checksum,
+// it continues with the next copy, skipping the content it has returned
+// already, as long as the next copy starts with that content.
+type failoverReader struct {
+	f           *FileObjectStore
+	bucket, key string
+	primary     string
+	// copies are the paths of the copies not tried yet.
+	copies []string
+
+	current io.ReadCloser
+	// ahead is content read ahead from the current copy and not returned yet.
+	ahead []byte
+	// err is the error reading failed with once no copy was left.
+	err error
+	// sent is the hash of the sentSize bytes returned so far.
+	sent     hash.Hash
+	sentSize int64
+}
+
+// readAhead reads up to n bytes of content ahead. If reading fails, it starts
+// over from the next copy, since none of the content has been returned yet.
+func (r *failoverReader) readAhead(n int64) error {
+	for {
+		data, err := io.ReadAll(io.LimitReader(r.current, n))
+		if err == nil {
+			r.ahead = data
+			return nil
+		}
+
+		r.f.log.WithError(err).WithField("key", r.key).Warnf("Error reading copy of object")
+		if !r.failover() {
+			return err
+		}
+	}
+}
+
+func (r *failoverReader) Read(p []byte) (int, error) {
+	if len(r.ahead) > 0 {
+		n := copy(p, r.ahead)
+		r.ahead = r.ahead[n:]
+		r.sent.Write(p[:n])
+		r.sentSize += int64(n)
+		return n, nil
+	}
+
+	for {
+		if r.current == nil {
+			return 0, r.err
+		}
+		n, err := r.current.Read(p)
+		if err == nil || err == io.EOF {
+			r.sent.Write(p[:n])
+			r.sentSize += int64(n)
+			return n, err
+		}
+
+		// What was read along with the error is dropped, and read again
+		// from the next copy.
+		r.f.log.WithError(err).WithField("key", r.key).Warnf("Error reading copy of object")
+		if !r.failover() {
+			r.err = err
+		}
+	}
+}
+
+// failover switches to the next copy that can be used, and returns false if
+// there is none.
+func (r *failoverReader) failover() bool {
+	for len(r.copies) > 0 {
+		if r.next() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// next switches to the next copy, which must start with the content returned
+// so far. If it cannot, it leaves no copy open and returns why.
+func (r *failoverReader) next() error {
+	if r.current != nil {
+		r.current.Close()
+		r.current = nil
+	}
+
+	path := r.copies[0]
+	r.copies = r.copies[1:]
+	log := r.f.log.WithField("key", r.key).WithField("path", path)
+
+	body, err := r.f.openObject(r.bucket, r.key, path)
+	if err != nil {
+		log.WithError(err).Warnf("Copy of object is unusable")
+		return err
+	}
+
+	prefix := newHashingReader(io.LimitReader(body, r.sentSize))
+	_, err = io.Copy(io.Discard, prefix)
+	if err == nil && (prefix.size != r.sentSize || prefix.Sum() != hex.EncodeToString(r.sent.Sum(nil))) {
+		err = errors.Errorf("copy %s of object %s does not start with the content read so far", path, r.key)
+	}
+	if err != nil {
+		body.Close()
+		log.WithError(err).Warnf("Copy of object is unusable")
+		return err
+	}
+
+	if path != r.primary {
+		log.Warnf("Serving object from replica")
+	}
+	r.current = body
+	return nil
+}
+
+func (r *failoverReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	return r.current.Close()
+}
+
+// entryPath returns the path of the object that entry is for.
+func (f *FileObjectStore) entryPath(entry replicationEntry) (string, error) {
+	if entry.Path == "" {
+		return f.resolvePath(entry.Bucket, "key", entry.Key)
+	}
+
+	if err := validateBucket(entry.Bucket); err != nil {
+		return "", err
+	}
+	bucketDir := f.bucketDir(entry.Bucket)
+	path := filepath.Join(bucketDir, filepath.FromSlash(entry.Path))
+	versionsDir := filepath.Join(bucketDir, versionsDirName)
+	trashDir := filepath.Join(bucketDir, trashDirName)
+	if (!isWithin(versionsDir, path) && !isWithin(trashDir, path)) || path == versionsDir || path == trashDir {
+		return "", errors.Errorf("%q is not the path of a prior version or trashed object", entry.Path)
+	}
+	return path, nil
+}
+
+// add durably queues entry for replication and wakes the goroutine draining the queue.
+func (q *replicationQueue) add(entry replicationEntry, perm os.FileMode) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// Names sort in the order the entries were queued in.
+	name := fmt.Sprintf("%s-%d-%d", time.Now().UTC().Format(versionTimeFormat), os.Getpid(), atomic.AddInt64(&replicationEntrySeq, 1))
+	if err := writeFileAtomic(filepath.Join(q.dir, name), bytes.NewReader(data), perm); err != nil {
+		return errors.Wrapf(err, "error queueing %s for replication", entry.Key)
+	}
+
+	q.notify()
+	return nil
+}
+
+func (q *replicationQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *replicationQueue) run() {
+	for {
+		if err := q.drain(); err != nil {
+			q.log.WithError(err).Errorf("Error replicating queued objects, will retry")
+		}
+
+		select {
+		case <-q.wake:
+		case <-time.After(replicationRetryInterval):
+		}
+	}
+}
+
+// drain replicates the queued keys in order, removing each entry once it is
+// done. It stops at the first failure, so that keys are never replicated out
+// of order. Only one process drains a queue at a time.
+func (q *replicationQueue) drain() error {
+	q.lock.Lock()
+	store := q.store
+	q.lock.Unlock()
+
+	return withFileLock(filepath.Join(q.dir, replicationLockFileName), func() error {
+		entries, err := os.ReadDir(q.dir)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		var names []string
+		for _, entry := range entries {
+			if !isInternalName(entry.Name()) && !entry.IsDir() {
+				names = append(names, entry.Name())
+			}
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			entryPath := filepath.Join(q.dir, name)
+			data, err := os.ReadFile(entryPath)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			var entry replicationEntry
+			if err := json.Unmarshal(data, &entry); err != nil {
+				q.log.WithError(err).WithField("entry", name).Errorf("Dropping invalid replication entry")
+				os.Remove(entryPath)
+				continue
+			}
+
+			entryStore := *store
+			entryStore.bucket = entry.Bucket
+			entryStore.prefix = entry.Prefix
+			entryStore.dirMode = entry.DirMode
+			entryStore.fileMode = entry.FileMode
+			path, err := entryStore.entryPath(entry)
+			if err != nil {
+				q.log.WithError(err).WithField("entry", name).Errorf("Dropping invalid replication entry")
+				os.Remove(entryPath)
+				continue
+			}
+			if err := entryStore.mirror(entry.Bucket, path, q.replica); err != nil {
+				return errors.Wrapf(err, "error replicating %s", entry.Key)
+			}
+			if err := os.Remove(entryPath); err != nil && !os.IsNotExist(err) {
+				return errors.WithStack(err)
+			}
+		}
+		return nil
+	})
+}
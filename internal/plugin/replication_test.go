@@ -0,0 +1,165 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TestSyncReplication checks that objects are mirrored to the replicas as
+// they are put and deleted, and read from a replica when the primary copy is
+// missing or corrupt.
+func TestSyncReplication(t *testing.T) {
+	root, replica := t.TempDir(), t.TempDir()
+	log := logrus.New()
+	log.SetOutput(testLogWriter{t})
+	store := NewFileObjectStore(log)
+	if err := store.Init(map[string]string{rootConfigKey: root, "bucket": "bucket", replicasConfigKey: replica}); err != nil {
+		t.Fatal(err)
+	}
+
+	const key = "backups/backup-1/velero-backup.json"
+	if err := store.PutObject("bucket", key, strings.NewReader("content")); err != nil {
+		t.Fatal(err)
+	}
+	primaryPath := filepath.Join(root, "bucket", filepath.FromSlash(key))
+	replicaPath := filepath.Join(replica, "bucket", filepath.FromSlash(key))
+	if _, err := os.Stat(replicaPath); err != nil {
+		t.Fatalf("the object was not replicated: %v", err)
+	}
+
+	restorePrimary := func(t *testing.T) {
+		t.Helper()
+		data, err := os.ReadFile(replicaPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(primaryPath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(primaryPath, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, damage := range map[string]func() error{
+		"missing": func() error { return os.Remove(primaryPath) },
+		"corrupt": func() error {
+			data, err := os.ReadFile(primaryPath)
+			if err != nil {
+				return err
+			}
+			data[0] ^= 1
+			return os.WriteFile(primaryPath, data, 0644)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			restorePrimary(t)
+			if err := damage(); err != nil {
+				t.Fatal(err)
+			}
+
+			body, err := store.GetObject("bucket", key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := io.ReadAll(body)
+			body.Close()
+			if err != nil || string(content) != "content" {
+				t.Errorf("GetObject() with a %s primary copy returned %q, %v, want the replica", name, content, err)
+			}
+		})
+	}
+
+	restorePrimary(t)
+	if err := store.DeleteObject("bucket", key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(replica, "bucket", "backups")); !os.IsNotExist(err) {
+		t.Errorf("deleting the object left its directories in the replica: %v", err)
+	}
+}
+
+// TestAsyncReplicationKeepsLocationSettings checks that queued keys are
+// replicated with the settings of the location they were written through,
+// when another location shares the root and its queues.
+func TestAsyncReplicationKeepsLocationSettings(t *testing.T) {
+	root, replica := t.TempDir(), t.TempDir()
+	// The queues outlive the test, so they must not log to it.
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	store := NewFileObjectStore(log)
+	configs := []map[string]string{
+		{"bucket": "one", "prefix": "velero", fileModeConfigKey: "0600"},
+		{"bucket": "two", fileModeConfigKey: "0640"},
+	}
+	for _, config := range configs {
+		config[rootConfigKey] = root
+		config[replicasConfigKey] = replica
+		config[replicationModeConfigKey] = replicationAsync
+		if err := store.Init(config); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const key = "velero/backups/backup-1/velero-backup.json"
+	if err := store.PutObject("one", key, strings.NewReader("content")); err != nil {
+		t.Fatal(err)
+	}
+	replicaPath := filepath.Join(replica, "one", filepath.FromSlash(key))
+	waitFor(t, "the object to be replicated", func() bool {
+		_, err := os.Stat(replicaPath)
+		return err == nil
+	})
+	info, err := os.Stat(replicaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("the replica has mode %v, want the 0600 of its location", info.Mode().Perm())
+	}
+
+	if err := store.DeleteObject("one", key); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the deletion to be replicated", func() bool {
+		_, err := os.Stat(filepath.Join(replica, "one", "velero", "backups"))
+		return os.IsNotExist(err)
+	})
+	if _, err := os.Stat(filepath.Join(replica, "one", "velero")); err != nil {
+		t.Errorf("the prefix of the location was removed from the replica: %v", err)
+	}
+}
+
+// waitFor fails the test unless done returns true within a few seconds.
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); !done(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
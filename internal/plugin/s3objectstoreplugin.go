@@ -0,0 +1,703 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// s3URLConfigKey is the BSL config key for the endpoint of the S3-compatible
+	// service, e.g. "https://minio.example.com:9000". Buckets are addressed
+	// path-style, as "<s3Url>/<bucket>/<key>".
+	s3URLConfigKey = "s3Url"
+	// regionConfigKey is the BSL config key for the region requests are signed for.
+	regionConfigKey = "region"
+	// profileConfigKey is the BSL config key for the profile to read from the credentials file.
+	profileConfigKey = "profile"
+	// credentialsFileConfigKey is the config key Velero sets to the path of the
+	// credentials file given by the BSL's spec.credential.
+	credentialsFileConfigKey = "credentialsFile"
+	// caCertConfigKey is the config key Velero sets to the BSL's spec.objectStorage.caCert.
+	caCertConfigKey = "caCert"
+	// insecureSkipTLSVerifyConfigKey is the BSL config key to disable TLS certificate verification.
+	insecureSkipTLSVerifyConfigKey = "insecureSkipTLSVerify"
+	// partSizeConfigKey is the BSL config key for the size of the first parts
+	// of a multipart upload, e.g. "64Mi". Smaller objects are uploaded with a
+	// single request.
+	partSizeConfigKey = "partSize"
+
+	defaultS3Region = "us-east-1"
+	defaultProfile  = "default"
+
+	defaultPartSize = 16 * 1024 * 1024
+	// minPartSize and maxPartSize are the limits S3 puts on the size of all but
+	// the last part of a multipart upload.
+	minPartSize = 5 * 1024 * 1024
+	maxPartSize = 5 * 1024 * 1024 * 1024
+	// maxParts is the most parts S3 accepts for a multipart upload. The size
+	// of the parts doubles every partSizeDoublingInterval parts, as the size
+	// of an upload is not known in advance, so that objects much larger than
+	// maxParts times the configured part size can be uploaded.
+	maxParts                 = 10000
+	partSizeDoublingInterval = 1000
+	// maxSignedURLTTL is the longest validity S3 accepts for a presigned URL.
+	maxSignedURLTTL = 7 * 24 * time.Hour
+)
+
+// S3ObjectStore is an object store plugin for Velero that talks to an
+// S3-compatible service over its REST API, signing requests with AWS
+// Signature Version 4.
+type S3ObjectStore struct {
+	log logrus.FieldLogger
+
+	// locations are the stores configured by Init, one per backup storage
+	// location. The settings below are those of the location a store is for,
+	// and never change once Init has configured them.
+	locations *s3Locations
+
+	endpoint *url.URL
+	signer   *sigV4Signer
+	client   *http.Client
+	partSize int64
+}
+
+var _ velero.ObjectStore = (*S3ObjectStore)(nil)
+
+// NewS3ObjectStore instantiates an S3ObjectStore.
+func NewS3ObjectStore(log logrus.FieldLogger) *S3ObjectStore {
+	return &S3ObjectStore{
+		log:       log,
+		locations: &s3Locations{byBucket: make(map[string]map[string]*S3ObjectStore)},
+	}
+}
+
+// s3Locations are the settings of the backup storage locations an
+// S3ObjectStore was initialized for, looked up by the bucket and key of each
+// call, like the storeLocations of a FileObjectStore.
+type s3Locations struct {
+	lock sync.RWMutex
+	// byBucket holds the store configured for each location, by bucket and then prefix.
+	byBucket map[string]map[string]*S3ObjectStore
+	// latest is the store of the location initialized most recently.
+	latest *S3ObjectStore
+}
+
+func (l *s3Locations) add(bucket, prefix string, loc *S3ObjectStore) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.byBucket[bucket] == nil {
+		l.byBucket[bucket] = make(map[string]*S3ObjectStore)
+	}
+	l.byBucket[bucket][prefix] = loc
+	l.latest = loc
+}
+
+// location returns the store configured for the location that key, or
+// prefix, belongs to: the location in bucket with the longest prefix that
+// key is under. If no location in bucket has such a prefix, it is the
+// location initialized most recently, and if Init was never called, s itself.
+func (s *S3ObjectStore) location(bucket, key string) *S3ObjectStore {
+	s.locations.lock.RLock()
+	defer s.locations.lock.RUnlock()
+
+	var best *S3ObjectStore
+	bestPrefix := ""
+	for prefix, loc := range s.locations.byBucket[bucket] {
+		if prefix != "" && key != prefix && !strings.HasPrefix(key, prefix+"/") {
+			continue
+		}
+		if best == nil || len(prefix) > len(bestPrefix) {
+			best, bestPrefix = loc, prefix
+		}
+	}
+	switch {
+	case best != nil:
+		return best
+	case s.locations.latest != nil:
+		return s.locations.latest
+	default:
+		return s
+	}
+}
+
+// S3Error is returned when the S3 service responds to a request with an error.
+type S3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("S3 request failed with status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("S3 request failed with status %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Init initializes the plugin. After v0.10.0, this can be called multiple times.
+// Velero calls Init with the config of each BackupStorageLocation that uses the
+// plugin, and the settings of a location apply to the keys under its bucket and
+// prefix. Calling Init again for a location replaces its settings.
+func (s *S3ObjectStore) Init(config map[string]string) error {
+	s.log.Infof("S3ObjectStore.Init called")
+
+	if config[s3URLConfigKey] == "" {
+		return errors.Errorf("%s is required", s3URLConfigKey)
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(config[s3URLConfigKey], "/"))
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return errors.Errorf("%s must be an http or https URL, got %q", s3URLConfigKey, config[s3URLConfigKey])
+	}
+
+	region := config[regionConfigKey]
+	if region == "" {
+		region = defaultS3Region
+	}
+	profile := config[profileConfigKey]
+	if profile == "" {
+		profile = defaultProfile
+	}
+	credentials, err := loadS3Credentials(config[credentialsFileConfigKey], profile)
+	if err != nil {
+		return err
+	}
+
+	partSize := int64(defaultPartSize)
+	if value := config[partSizeConfigKey]; value != "" {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil || quantity.Value() < minPartSize || quantity.Value() > maxPartSize {
+			return errors.Errorf("%s must be a size between 5Mi and 5Gi, got %q", partSizeConfigKey, value)
+		}
+		partSize = quantity.Value()
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: config[insecureSkipTLSVerifyConfigKey] == "true"} // #nosec G402 -- opt-in through config
+	if caCert := config[caCertConfigKey]; caCert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(caCert)) {
+			return errors.Errorf("%s does not contain any PEM-encoded certificates", caCertConfigKey)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	// The settings are configured on a new store, which replaces the one of
+	// the location, so that calls for other locations never see them.
+	prefix := strings.Trim(config["prefix"], "/")
+	s.locations.add(config["bucket"], prefix, &S3ObjectStore{
+		log:       s.log,
+		locations: s.locations,
+		endpoint:  endpoint,
+		signer:    &sigV4Signer{credentials: credentials, region: region, now: time.Now},
+		client:    &http.Client{Transport: transport},
+		partSize:  partSize,
+	})
+	return nil
+}
+
+// PutObject uploads body with a single request if it is smaller than the part
+// size, and as a multipart upload otherwise.
+func (s *S3ObjectStore) PutObject(bucket, key string, body io.Reader) error {
+	return s.location(bucket, key).putObject(bucket, key, body)
+}
+
+func (s *S3ObjectStore) putObject(bucket, key string, body io.Reader) error {
+	log := s.log.WithFields(logrus.Fields{
+		"bucket": bucket,
+		"key":    key,
+	})
+	log.Infof("PutObject")
+
+	part, err := newPartBuffer()
+	if err != nil {
+		return err
+	}
+	defer part.Close()
+
+	if err := part.fill(body, s.partSize); err != nil {
+		return errors.Wrapf(err, "error reading body of %s", key)
+	}
+	if part.size < s.partSize {
+		resp, err := s.sendBody(http.MethodPut, bucket, key, nil, part.reader(), part.size, part.hash)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, err = io.Copy(io.Discard, resp.Body)
+		return errors.WithStack(err)
+	}
+
+	log.Infof("Starting multipart upload")
+	return s.putMultipart(bucket, key, part, body)
+}
+
+// putMultipart uploads body as a multipart upload, whose first part is
+// already in part.
+func (s *S3ObjectStore) putMultipart(bucket, key string, part *partBuffer, body io.Reader) (err error) {
+	resp, err := s.do(http.MethodPost, bucket, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(resp, &initiated); err != nil || initiated.UploadID == "" {
+		return errors.Errorf("error starting multipart upload of %s: invalid response", key)
+	}
+
+	uploadID := url.Values{"uploadId": {initiated.UploadID}}
+	defer func() {
+		if err != nil {
+			// Abort so that the service does not keep the uploaded parts around.
+			if _, abortErr := s.do(http.MethodDelete, bucket, key, uploadID, nil); abortErr != nil {
+				s.log.WithError(abortErr).Warnf("Error aborting multipart upload of %s", key)
+			}
+		}
+	}()
+
+	type completedPart struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var completed struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}
+
+	for number := 1; part.size > 0 || number == 1; number++ {
+		if number > maxParts {
+			return errors.Errorf("error uploading %s: it does not fit in the %d parts of a multipart upload", key, maxParts)
+		}
+		query := url.Values{
+			"partNumber": {strconv.Itoa(number)},
+			"uploadId":   {initiated.UploadID},
+		}
+		etag, err := s.doForETag(http.MethodPut, bucket, key, query, part)
+		if err != nil {
+			return errors.Wrapf(err, "error uploading part %d of %s", number, key)
+		}
+		completed.Parts = append(completed.Parts, completedPart{PartNumber: number, ETag: etag})
+
+		if part.size < s.multipartPartSize(number) {
+			break
+		}
+		if err := part.fill(body, s.multipartPartSize(number+1)); err != nil {
+			return errors.Wrapf(err, "error reading body of %s", key)
+		}
+	}
+
+	payload, err := xml.Marshal(completed)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp, err = s.do(http.MethodPost, bucket, key, uploadID, payload)
+	if err != nil {
+		return err
+	}
+
+	// CompleteMultipartUpload can fail after responding with 200 OK, in
+	// which case the error is in the response body.
+	if s3Err := parseS3Error(http.StatusOK, resp); s3Err.Code != "" {
+		return s3Err
+	}
+	return nil
+}
+
+// multipartPartSize returns the size of part number of a multipart upload:
+// the configured part size, doubled for every partSizeDoublingInterval parts
+// before it, up to maxPartSize.
+func (s *S3ObjectStore) multipartPartSize(number int) int64 {
+	doublings := (number - 1) / partSizeDoublingInterval
+	if doublings >= 32 || s.partSize<<doublings > maxPartSize {
+		return maxPartSize
+	}
+	return s.partSize << doublings
+}
+
+// ObjectExists checks if there is an object with the given key in the bucket.
+func (s *S3ObjectStore) ObjectExists(bucket, key string) (bool, error) {
+	return s.location(bucket, key).objectExists(bucket, key)
+}
+
+func (s *S3ObjectStore) objectExists(bucket, key string) (bool, error) {
+	log := s.log.WithFields(logrus.Fields{
+		"bucket": bucket,
+		"key":    key,
+	})
+	log.Infof("ObjectExists")
+
+	_, err := s.do(http.MethodHead, bucket, key, nil, nil)
+	var s3Err *S3Error
+	if errors.As(err, &s3Err) && s3Err.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetObject retrieves the object with the given key from the bucket.
+func (s *S3ObjectStore) GetObject(bucket, key string) (io.ReadCloser, error) {
+	return s.location(bucket, key).getObject(bucket, key)
+}
+
+func (s *S3ObjectStore) getObject(bucket, key string) (io.ReadCloser, error) {
+	log := s.log.WithFields(logrus.Fields{
+		"bucket": bucket,
+		"key":    key,
+	})
+	log.Infof("GetObject")
+
+	resp, err := s.send(http.MethodGet, bucket, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// ListCommonPrefixes gets a list of all object key prefixes that start with
+// the specified prefix and stop at the next instance of the provided delimiter.
+func (s *S3ObjectStore) ListCommonPrefixes(bucket, prefix, delimiter string) ([]string, error) {
+	return s.location(bucket, prefix).listCommonPrefixes(bucket, prefix, delimiter)
+}
+
+func (s *S3ObjectStore) listCommonPrefixes(bucket, prefix, delimiter string) ([]string, error) {
+	log := s.log.WithFields(logrus.Fields{
+		"bucket":    bucket,
+		"delimiter": delimiter,
+		"prefix":    prefix,
+	})
+	log.Infof("ListCommonPrefixes")
+
+	var prefixes []string
+	err := s.list(bucket, prefix, delimiter, func(result *listBucketResult) {
+		for _, commonPrefix := range result.CommonPrefixes {
+			prefixes = append(prefixes, commonPrefix.Prefix)
+		}
+	})
+	return prefixes, err
+}
+
+// ListObjects gets a list of all keys in the specified bucket that have the given prefix.
+func (s *S3ObjectStore) ListObjects(bucket, prefix string) ([]string, error) {
+	return s.location(bucket, prefix).listObjects(bucket, prefix)
+}
+
+func (s *S3ObjectStore) listObjects(bucket, prefix string) ([]string, error) {
+	log := s.log.WithFields(logrus.Fields{
+		"bucket": bucket,
+		"prefix": prefix,
+	})
+	log.Infof("ListObjects")
+
+	var keys []string
+	err := s.list(bucket, prefix, "", func(result *listBucketResult) {
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+	})
+	return keys, err
+}
+
+// listBucketResult is the response to a ListObjectsV2 request.
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// list calls fn with every page of the ListObjectsV2 results for prefix and delimiter.
+func (s *S3ObjectStore) list(bucket, prefix, delimiter string, fn func(*listBucketResult)) error {
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {prefix},
+	}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+
+	for {
+		resp, err := s.do(http.MethodGet, bucket, "", query, nil)
+		if err != nil {
+			return err
+		}
+
+		result := new(listBucketResult)
+		if err := xml.Unmarshal(resp, result); err != nil {
+			return errors.Wrapf(err, "error decoding listing of bucket %s", bucket)
+		}
+		fn(result)
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// DeleteObject removes the object with the specified key from the given bucket.
+func (s *S3ObjectStore) DeleteObject(bucket, key string) error {
+	return s.location(bucket, key).deleteObject(bucket, key)
+}
+
+func (s *S3ObjectStore) deleteObject(bucket, key string) error {
+	log := s.log.WithFields(logrus.Fields{
+		"bucket": bucket,
+		"key":    key,
+	})
+	log.Infof("DeleteObject")
+
+	_, err := s.do(http.MethodDelete, bucket, key, nil, nil)
+	return err
+}
+
+// CreateSignedURL creates a presigned URL for downloading an object, valid for ttl.
+func (s *S3ObjectStore) CreateSignedURL(bucket, key string, ttl time.Duration) (string, error) {
+	return s.location(bucket, key).createSignedURL(bucket, key, ttl)
+}
+
+func (s *S3ObjectStore) createSignedURL(bucket, key string, ttl time.Duration) (string, error) {
+	log := s.log.WithFields(logrus.Fields{
+		"bucket": bucket,
+		"key":    key,
+	})
+	log.Infof("CreateSignedURL")
+
+	if ttl <= 0 || ttl > maxSignedURLTTL {
+		return "", errors.Errorf("signed URL TTL must be between 1s and %s, got %s", maxSignedURLTTL, ttl)
+	}
+	return s.signer.presign(http.MethodGet, s.objectURL(bucket, key, nil), ttl), nil
+}
+
+// objectURL returns the path-style URL of an object, or of the bucket if key is empty.
+func (s *S3ObjectStore) objectURL(bucket, key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	// Send the path exactly as it is encoded for signing.
+	u.RawPath = canonicalURI(&u)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+// send signs and sends a request, returning the response if it succeeded and
+// an *S3Error otherwise. The caller must close the response body.
+func (s *S3ObjectStore) send(method, bucket, key string, query url.Values, payload []byte) (*http.Response, error) {
+	if payload == nil {
+		return s.sendBody(method, bucket, key, query, nil, 0, emptyPayloadHash)
+	}
+	return s.sendBody(method, bucket, key, query, bytes.NewReader(payload), int64(len(payload)), sha256Hex(payload))
+}
+
+// sendBody is like send, for a payload of size bytes read from body, whose
+// SHA-256 is payloadHash.
+func (s *S3ObjectStore) sendBody(method, bucket, key string, query url.Values, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(bucket, key, query).String(), body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	s.signer.sign(req, payloadHash)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error sending %s request for %s/%s", method, bucket, key)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		return nil, parseS3Error(resp.StatusCode, data)
+	}
+	return resp, nil
+}
+
+// do sends a request like send and returns the whole response body.
+func (s *S3ObjectStore) do(method, bucket, key string, query url.Values, payload []byte) ([]byte, error) {
+	resp, err := s.send(method, bucket, key, query, payload)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	return data, errors.WithStack(err)
+}
+
+// doForETag sends a request with the content of part as its payload, and
+// returns the ETag of the response.
+func (s *S3ObjectStore) doForETag(method, bucket, key string, query url.Values, part *partBuffer) (string, error) {
+	resp, err := s.sendBody(method, bucket, key, query, part.reader(), part.size, part.hash)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return "", errors.New("response has no ETag")
+	}
+	return etag, nil
+}
+
+func parseS3Error(statusCode int, body []byte) *S3Error {
+	s3Err := &S3Error{StatusCode: statusCode}
+	if bytes.Contains(body, []byte("<Error>")) {
+		xml.Unmarshal(body, s3Err)
+	}
+	return s3Err
+}
+
+// partBuffer holds a part of an upload in a temp file, as parts can be as
+// large as maxPartSize, and must be read completely to be signed before they
+// are sent.
+type partBuffer struct {
+	file *os.File
+	// size is the number of bytes in the part, and hash their SHA-256.
+	size int64
+	hash string
+}
+
+func newPartBuffer() (*partBuffer, error) {
+	file, err := os.CreateTemp("", "velero-s3-part-")
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating a temp file for upload parts")
+	}
+	return &partBuffer{file: file, hash: emptyPayloadHash}, nil
+}
+
+// fill replaces the content of the buffer with up to size bytes read from body.
+func (b *partBuffer) fill(body io.Reader, size int64) error {
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := b.file.Truncate(0); err != nil {
+		return errors.WithStack(err)
+	}
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(b.file, hash), io.LimitReader(body, size))
+	b.size = n
+	b.hash = hex.EncodeToString(hash.Sum(nil))
+	return errors.WithStack(err)
+}
+
+// reader returns a reader of the content of the buffer.
+func (b *partBuffer) reader() io.Reader {
+	return io.NewSectionReader(b.file, 0, b.size)
+}
+
+// Close removes the temp file of the buffer.
+func (b *partBuffer) Close() error {
+	b.file.Close()
+	return errors.WithStack(os.Remove(b.file.Name()))
+}
+
+// loadS3Credentials reads access keys for profile from a credentials file in
+// the format of ~/.aws/credentials. If path is empty, the keys are read from
+// the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN env vars.
+func loadS3Credentials(path, profile string) (s3Credentials, error) {
+	if path == "" {
+		credentials := s3Credentials{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		if credentials.AccessKeyID == "" || credentials.SecretAccessKey == "" {
+			return s3Credentials{}, errors.New("no credentials file is configured and AWS_ACCESS_KEY_ID or AWS_SECRET_ACCESS_KEY is not set")
+		}
+		return credentials, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return s3Credentials{}, errors.Wrap(err, "error opening credentials file")
+	}
+	defer file.Close()
+
+	var credentials s3Credentials
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+			continue
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.TrimSpace(strings.TrimPrefix(strings.TrimSuffix(line, "]"), "["))
+			continue
+		}
+		if section != profile {
+			continue
+		}
+
+		name, value, _ := strings.Cut(line, "=")
+		switch strings.TrimSpace(name) {
+		case "aws_access_key_id":
+			credentials.AccessKeyID = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			credentials.SecretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			credentials.SessionToken = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return s3Credentials{}, errors.Wrap(err, "error reading credentials file")
+	}
+
+	if credentials.AccessKeyID == "" || credentials.SecretAccessKey == "" {
+		return s3Credentials{}, errors.Errorf("profile %s in the credentials file has no aws_access_key_id or aws_secret_access_key", profile)
+	}
+	return credentials, nil
+}
@@ -0,0 +1,334 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Signed URLs are served by a SignedURLServer that runs outside of the plugin
+// processes, which Velero starts and stops for every call. The plugin only
+// signs URLs: Init records the location in a registration file in the root
+// of its store, from which the server loads the location's settings when a
+// URL for it is requested. Registrations are keyed by the root, bucket and
+// prefix of the location, so that locations sharing a root have their own.
+const (
+	// signedURLPathPrefix is the URL path under which the server serves objects,
+	// followed by "<store ID>/<bucket>/<key>".
+	signedURLPathPrefix = "/objects/"
+
+	expiresQueryParam   = "expires"
+	signatureQueryParam = "signature"
+
+	// signedURLRegistrationsDirName is the directory in the store root that
+	// holds a registration file, "<store ID>.json", for each location that
+	// issues signed URLs.
+	signedURLRegistrationsDirName = internalNamePrefix + "signed-urls"
+)
+
+// signedURLRegistration is the content of a registration file.
+type signedURLRegistration struct {
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix"`
+	// KeyFile is the path of the file holding the key URLs are signed with.
+	// The server must have it at the same path as the plugin.
+	KeyFile string `json:"keyFile"`
+	// Config is the config of the location that reading its objects needs.
+	Config map[string]string `json:"config"`
+}
+
+// signedURLConfigKeys are the BSL config keys registrations keep.
+var signedURLConfigKeys = []string{rootConfigKey, "bucket", "prefix", encryptionKeyFileConfigKey, replicasConfigKey}
+
+// signedURLStoreID returns the ID that identifies a location in its URLs.
+func signedURLStoreID(root, bucket, prefix string) string {
+	sum := sha256.Sum256([]byte(root + "\n" + bucket + "\n" + prefix))
+	return hex.EncodeToString(sum[:8])
+}
+
+// registerSignedURLs writes the registration file of the location of f, with
+// config, unless it already has this content.
+func (f *FileObjectStore) registerSignedURLs(id, keyFile string, config map[string]string) error {
+	reg := signedURLRegistration{Bucket: f.bucket, Prefix: f.prefix, KeyFile: keyFile, Config: make(map[string]string)}
+	for _, key := range signedURLConfigKeys {
+		if value := config[key]; value != "" {
+			reg.Config[key] = value
+		}
+	}
+	reg.Config[rootConfigKey] = f.root
+	data, err := json.Marshal(reg)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	dir := filepath.Join(f.root, signedURLRegistrationsDirName)
+	path := filepath.Join(dir, id+".json")
+	if existing, err := os.ReadFile(path); err == nil && bytes.Equal(existing, data) {
+		return nil
+	}
+	if err := os.MkdirAll(dir, f.dirMode); err != nil {
+		return errors.WithStack(err)
+	}
+	return writeFileAtomic(path, bytes.NewReader(data), 0600)
+}
+
+// signURL returns the URL under baseURL for an object of the location with
+// ID storeID, signed with key.
+func signURL(key []byte, baseURL, storeID, bucket, objectKey string, expires time.Time) string {
+	objectPath := storeID + "/" + bucket + "/" + objectKey
+	expiresUnix := strconv.FormatInt(expires.Unix(), 10)
+
+	escaped := strings.Split(objectPath, "/")
+	for i := range escaped {
+		escaped[i] = url.PathEscape(escaped[i])
+	}
+
+	query := url.Values{}
+	query.Set(expiresQueryParam, expiresUnix)
+	query.Set(signatureQueryParam, signature(key, objectPath, expiresUnix))
+
+	return strings.TrimSuffix(baseURL, "/") + signedURLPathPrefix + strings.Join(escaped, "/") + "?" + query.Encode()
+}
+
+// SignedURLServer is an HTTP handler that serves objects from FileObjectStores
+// to holders of a URL signed by CreateSignedURL. It serves the locations
+// registered in the roots it is given.
+type SignedURLServer struct {
+	log   logrus.FieldLogger
+	roots []string
+
+	lock   sync.Mutex
+	stores map[string]*signedURLStore
+}
+
+// signedURLStore is a location served by a SignedURLServer, as loaded from
+// its registration file.
+type signedURLStore struct {
+	// registration is the content of the file it was loaded from.
+	registration []byte
+	bucket       string
+	prefix       string
+	config       map[string]string
+	key          []byte
+
+	// store is opened for the first request whose signature is valid, or
+	// nil until then. The server's lock guards it.
+	store *FileObjectStore
+}
+
+// NewSignedURLServer returns a server for the locations registered in roots,
+// or in the default root of locations if roots is empty.
+func NewSignedURLServer(log logrus.FieldLogger, roots []string) *SignedURLServer {
+	if len(roots) == 0 {
+		roots = []string{getRoot()}
+	}
+	return &SignedURLServer{
+		log:    log,
+		roots:  roots,
+		stores: make(map[string]*signedURLStore),
+	}
+}
+
+// store returns the location with ID id, loading it again if its
+// registration has changed, or nil if no root has it. Its object store is
+// not opened until a request is authenticated, see open.
+func (s *SignedURLServer) store(id string) (*signedURLStore, error) {
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return nil, nil
+	}
+
+	for _, root := range s.roots {
+		data, err := os.ReadFile(filepath.Join(root, signedURLRegistrationsDirName, id+".json"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		if store, ok := s.stores[id]; ok && bytes.Equal(store.registration, data) {
+			return store, nil
+		}
+
+		var reg signedURLRegistration
+		if err := json.Unmarshal(data, &reg); err != nil {
+			return nil, errors.Wrapf(err, "error decoding registration of store %s", id)
+		}
+		key, err := readSigningKey(reg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		loaded := &signedURLStore{registration: data, bucket: reg.Bucket, prefix: reg.Prefix, config: reg.Config, key: key}
+		s.stores[id] = loaded
+		return loaded, nil
+	}
+	return nil, nil
+}
+
+// open returns the object store of store, the location with ID id, opening
+// it on first use. Opening a store initializes it, which changes its root,
+// so it is only done for requests whose signature has been verified.
+func (s *SignedURLServer) open(id string, store *signedURLStore) (*FileObjectStore, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if store.store == nil {
+		opened, err := OpenFileObjectStore(s.log, store.config)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error opening store %s", id)
+		}
+		s.log.WithField("bucket", store.bucket).WithField("prefix", store.prefix).Infof("Serving signed URLs for store %s", id)
+		store.store = opened
+	}
+	return store.store, nil
+}
+
+// ServeHTTP serves the object named by the request path, provided the URL's
+// signature is valid and has not expired.
+func (s *SignedURLServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, signedURLPathPrefix) {
+		http.NotFound(w, r)
+		return
+	}
+
+	objectPath := strings.TrimPrefix(r.URL.Path, signedURLPathPrefix)
+	parts := strings.SplitN(objectPath, "/", 3)
+	if len(parts) != 3 {
+		http.NotFound(w, r)
+		return
+	}
+	storeID, bucket, key := parts[0], parts[1], parts[2]
+
+	log := s.log.WithFields(logrus.Fields{
+		"bucket": bucket,
+		"key":    key,
+	})
+
+	store, err := s.store(storeID)
+	if err != nil {
+		log.WithError(err).Errorf("Error loading store for signed URL")
+		http.Error(w, "error loading store", http.StatusInternalServerError)
+		return
+	}
+	if store == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	expiresUnix := r.URL.Query().Get(expiresQueryParam)
+	expires, err := strconv.ParseInt(expiresUnix, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid or missing expiry", http.StatusForbidden)
+		return
+	}
+	expected := signature(store.key, objectPath, expiresUnix)
+	if !hmac.Equal([]byte(expected), []byte(r.URL.Query().Get(signatureQueryParam))) {
+		log.Warnf("Rejected request with an invalid signature")
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > expires {
+		http.Error(w, "signed URL has expired", http.StatusForbidden)
+		return
+	}
+
+	// A location's URLs only ever name its own objects.
+	if bucket != store.bucket || (store.prefix != "" && !strings.HasPrefix(key, store.prefix+"/")) {
+		http.NotFound(w, r)
+		return
+	}
+
+	objects, err := s.open(storeID, store)
+	if err != nil {
+		log.WithError(err).Errorf("Error opening store for signed URL")
+		http.Error(w, "error opening store", http.StatusInternalServerError)
+		return
+	}
+	body, err := objects.GetObject(bucket, key)
+	if err != nil {
+		var invalidPath *InvalidPathError
+		switch {
+		case os.IsNotExist(errors.Cause(err)):
+			http.NotFound(w, r)
+		case errors.As(err, &invalidPath):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			log.WithError(err).Errorf("Error opening object for signed URL")
+			http.Error(w, "error reading object", http.StatusInternalServerError)
+		}
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		// The status has already been sent, so abort the connection to make
+		// sure the client does not mistake a partial download for a complete one.
+		log.WithError(err).Errorf("Error serving object for signed URL")
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// signature computes the hex-encoded HMAC-SHA256 of an object path and expiry time.
+func signature(key []byte, objectPath, expires string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(objectPath))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// readSigningKey loads an HMAC key from a file, such as a mounted Secret.
+func readSigningKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading signing key")
+	}
+
+	key = bytes.TrimSpace(key)
+	if len(key) < 32 {
+		return nil, errors.Errorf("signing key in %s must be at least 32 bytes long", path)
+	}
+	return key, nil
+}
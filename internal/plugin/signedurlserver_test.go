@@ -0,0 +1,171 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// getSignedURL requests signedURL from server, and returns the status and body
+// of the response.
+func getSignedURL(t *testing.T, server *SignedURLServer, signedURL string) (int, string) {
+	t.Helper()
+
+	u, err := url.Parse(signedURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, u.RequestURI(), nil))
+	return recorder.Code, recorder.Body.String()
+}
+
+func newTestSignedURLServer(t *testing.T, root string) *SignedURLServer {
+	t.Helper()
+
+	log := logrus.New()
+	log.SetOutput(testLogWriter{t})
+	return NewSignedURLServer(log, []string{root})
+}
+
+func TestSignedURLServer(t *testing.T) {
+	root := t.TempDir()
+	store := newTestFileObjectStore(t, root)
+	key := "backups/a b+c/velero-backup.json"
+	if err := store.PutObject("bucket", key, strings.NewReader("content")); err != nil {
+		t.Fatal(err)
+	}
+	server := newTestSignedURLServer(t, root)
+
+	signedURL, err := store.CreateSignedURL("bucket", key, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, body := getSignedURL(t, server, signedURL); status != http.StatusOK || body != "content" {
+		t.Errorf("GET of signed URL returned %d %q, want 200 \"content\"", status, body)
+	}
+
+	tests := []struct {
+		name       string
+		signedURL  func() string
+		wantStatus int
+	}{
+		{
+			name: "tampered signature",
+			signedURL: func() string {
+				u, _ := url.Parse(signedURL)
+				query := u.Query()
+				query.Set(signatureQueryParam, strings.Repeat("0", 64))
+				u.RawQuery = query.Encode()
+				return u.String()
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "other key",
+			signedURL: func() string {
+				return strings.Replace(signedURL, "velero-backup.json", "velero-backup.json2", 1)
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "later expiry",
+			signedURL: func() string {
+				u, _ := url.Parse(signedURL)
+				query := u.Query()
+				query.Set(expiresQueryParam, "9999999999")
+				u.RawQuery = query.Encode()
+				return u.String()
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "expired",
+			signedURL: func() string {
+				loc := store.location("bucket", key)
+				return signURL(loc.signedURLKey, loc.signedURLBaseURL, loc.signedURLStoreID, "bucket", key, time.Now().Add(-time.Minute))
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "unknown store",
+			signedURL: func() string {
+				loc := store.location("bucket", key)
+				return signURL(loc.signedURLKey, loc.signedURLBaseURL, "0123456789abcdef", "bucket", key, time.Now().Add(time.Hour))
+			},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name: "other bucket",
+			signedURL: func() string {
+				loc := store.location("bucket", key)
+				return signURL(loc.signedURLKey, loc.signedURLBaseURL, loc.signedURLStoreID, "other", key, time.Now().Add(time.Hour))
+			},
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status, _ := getSignedURL(t, server, test.signedURL()); status != test.wantStatus {
+				t.Errorf("GET returned %d, want %d", status, test.wantStatus)
+			}
+		})
+	}
+}
+
+// TestSignedURLServerOpensStoresForValidSignatures checks that the server
+// leaves the root of a location alone until a request for it is
+// authenticated.
+func TestSignedURLServerOpensStoresForValidSignatures(t *testing.T) {
+	root := t.TempDir()
+	store := newTestFileObjectStore(t, root)
+	key := "backups/backup-1/velero-backup.json"
+	signedURL, err := store.CreateSignedURL("bucket", key, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Opening the store creates the directory of its bucket again.
+	bucketDir := filepath.Join(root, "bucket")
+	if err := os.RemoveAll(bucketDir); err != nil {
+		t.Fatal(err)
+	}
+	server := newTestSignedURLServer(t, root)
+
+	forged := strings.Replace(signedURL, "signature=", "signature=0", 1)
+	if status, _ := getSignedURL(t, server, forged); status != http.StatusForbidden {
+		t.Errorf("GET with a forged signature returned %d, want 403", status)
+	}
+	if _, err := os.Stat(bucketDir); !os.IsNotExist(err) {
+		t.Errorf("a request with a forged signature opened the store: %v", err)
+	}
+
+	if status, _ := getSignedURL(t, server, signedURL); status != http.StatusNotFound {
+		t.Errorf("GET of a missing object returned %d, want 404", status)
+	}
+	if _, err := os.Stat(bucketDir); err != nil {
+		t.Errorf("an authenticated request did not open the store: %v", err)
+	}
+}
@@ -0,0 +1,414 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Velero tags snapshots with the names of their backup and PV, and with the
+// labels of the backup, such as velero.io/schedule-name. It does not tag them
+// with the PVC, so the snapshotter adds the PVC the PV was bound to when
+// GetVolumeID was called for it, under the key Velero labels resources with.
+const (
+	// BackupTagKey is the tag Velero sets on snapshots to the name of their backup.
+	BackupTagKey = "velero.io/backup"
+	// PVCTagKey is the tag the snapshotter sets to the <namespace>/<name> of the PVC.
+	PVCTagKey = "velero.io/pvc-namespace-name"
+)
+
+// The retention config keys make the snapshotter delete snapshots it no longer
+// needs to keep. Velero still references snapshots that are only old, so the
+// count and age rules are only applied by PruneSnapshots, when an operator
+// asks for it; orphaned snapshots are also deleted after every snapshot taken.
+const (
+	// retainLastConfigKey is the VSL config key for the number of most recent
+	// snapshots of each PVC that PruneSnapshots keeps. Older ones are deleted.
+	retainLastConfigKey = "retainLast"
+	// retainForConfigKey is the VSL config key for how long snapshots are
+	// kept by PruneSnapshots, such as 720h.
+	retainForConfigKey = "retainFor"
+	// backupBucketConfigKey is the VSL config key for the bucket of the file
+	// object store that backups are stored in. If it is set, snapshots whose
+	// backup is not in it are orphaned, and deleted.
+	backupBucketConfigKey = "backupBucket"
+	// backupRootConfigKey is the VSL config key for the root directory of the
+	// file object store that backups are stored in, like its BSL's root.
+	backupRootConfigKey = "backupRoot"
+	// backupPrefixConfigKey is the VSL config key for the prefix of the BSL
+	// that backups are stored in.
+	backupPrefixConfigKey = "backupPrefix"
+	// backupConfigKeyPrefix is prepended to the other BSL config keys of the
+	// FileObjectStore, such as encryptionKeyFile, to give the VSL config keys
+	// that configure it for looking up backups, such as backupEncryptionKeyFile.
+	backupConfigKeyPrefix = "backup"
+	// orphanGracePeriodConfigKey is the VSL config key for how long a snapshot
+	// is kept before it is considered orphaned. Velero only uploads a backup
+	// when it has finished, long after its first snapshots were taken.
+	orphanGracePeriodConfigKey = "orphanGracePeriod"
+
+	defaultOrphanGracePeriod = 24 * time.Hour
+
+	// backupMetadataFileName is the object every backup in a BSL has.
+	backupMetadataFileName = "velero-backup.json"
+)
+
+// CatalogSnapshot is a snapshot in the catalog of a NoOpVolumeSnapshotter.
+type CatalogSnapshot struct {
+	ID string `json:"id"`
+	Snapshot
+}
+
+// ExpiredSnapshot is a snapshot that the retention rules delete.
+type ExpiredSnapshot struct {
+	CatalogSnapshot
+	// Reason is the rule the snapshot is deleted by.
+	Reason string `json:"reason"`
+}
+
+// claim returns the PVC the snapshot was taken of, or its volume ID if the PVC
+// is not known.
+func (s Snapshot) claim() string {
+	if pvc := s.Tags[PVCTagKey]; pvc != "" {
+		return pvc
+	}
+	return s.VolID
+}
+
+// rememberClaim records the PVC that pv, whose volume ID is volumeID, is
+// bound to in the catalog, for tagging the snapshot Velero takes of it next.
+// Velero may call GetVolumeID and CreateSnapshot in different plugin
+// processes, so the claim must be in the state file they share.
+func (p *NoOpVolumeSnapshotter) rememberClaim(settings *snapshotterSettings, volumeID string, pv *v1.PersistentVolume) error {
+	if pv.Spec.ClaimRef == nil || pv.Spec.ClaimRef.Name == "" {
+		return nil
+	}
+	pvc := pv.Spec.ClaimRef.Namespace + "/" + pv.Spec.ClaimRef.Name
+	err := p.withState(settings, func(state *snapshotterState) error {
+		state.Claims[volumeID] = pvc
+		return nil
+	})
+	return errors.Wrapf(err, "error recording the PVC of volume %s", volumeID)
+}
+
+// claimTags returns tags with the PVC of volumeID added, if it is known.
+func (p *NoOpVolumeSnapshotter) claimTags(settings *snapshotterSettings, volumeID string, tags map[string]string) (map[string]string, error) {
+	if tags[PVCTagKey] != "" {
+		return tags, nil
+	}
+	var pvc string
+	err := p.withState(settings, func(state *snapshotterState) error {
+		pvc = state.Claims[volumeID]
+		return nil
+	})
+	if err != nil || pvc == "" {
+		return tags, err
+	}
+
+	tagged := make(map[string]string, len(tags)+1)
+	for key, value := range tags {
+		tagged[key] = value
+	}
+	tagged[PVCTagKey] = pvc
+	return tagged, nil
+}
+
+// tagRequirement is one comma-separated part of a tag selector: key=value,
+// key!=value, key, or !key.
+type tagRequirement struct {
+	key, value string
+	negate     bool
+	hasValue   bool
+}
+
+// parseTagSelector parses a selector of comma-separated tag requirements,
+// all of which a snapshot must meet to match it.
+func parseTagSelector(selector string) ([]tagRequirement, error) {
+	var requirements []tagRequirement
+	if strings.TrimSpace(selector) == "" {
+		return requirements, nil
+	}
+
+	for _, part := range strings.Split(selector, ",") {
+		part = strings.TrimSpace(part)
+		var req tagRequirement
+		if key, value, ok := strings.Cut(part, "!="); ok {
+			req = tagRequirement{key: key, value: value, negate: true, hasValue: true}
+		} else if key, value, ok := strings.Cut(part, "="); ok {
+			req = tagRequirement{key: key, value: value, hasValue: true}
+		} else if key, ok := strings.CutPrefix(part, "!"); ok {
+			req = tagRequirement{key: key, negate: true}
+		} else {
+			req = tagRequirement{key: part}
+		}
+		req.key = strings.TrimSpace(req.key)
+		if req.key == "" {
+			return nil, errors.Errorf("invalid tag selector %q, must be comma-separated key=value, key!=value, key or !key", part)
+		}
+		requirements = append(requirements, req)
+	}
+	return requirements, nil
+}
+
+func matchesTags(requirements []tagRequirement, tags map[string]string) bool {
+	for _, req := range requirements {
+		value, ok := tags[req.key]
+		matches := ok && (!req.hasValue || value == req.value)
+		if matches == req.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// ListSnapshots returns the snapshots in the catalog whose tags match
+// selector, oldest first. selector is made of comma-separated key=value,
+// key!=value, key and !key requirements; an empty one matches all snapshots.
+func (p *NoOpVolumeSnapshotter) ListSnapshots(selector string) ([]CatalogSnapshot, error) {
+	return p.listSnapshots(p.current(), selector)
+}
+
+func (p *NoOpVolumeSnapshotter) listSnapshots(settings *snapshotterSettings, selector string) ([]CatalogSnapshot, error) {
+	requirements, err := parseTagSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []CatalogSnapshot
+	err = p.withState(settings, func(state *snapshotterState) error {
+		for id, snapshot := range state.Snapshots {
+			if matchesTags(requirements, snapshot.Tags) {
+				snapshots = append(snapshots, CatalogSnapshot{ID: id, Snapshot: snapshot})
+			}
+		}
+		return nil
+	})
+	sortSnapshots(snapshots)
+	return snapshots, err
+}
+
+func sortSnapshots(snapshots []CatalogSnapshot) {
+	sort.Slice(snapshots, func(i, j int) bool {
+		if !snapshots[i].CreatedAt.Equal(snapshots[j].CreatedAt) {
+			return snapshots[i].CreatedAt.Before(snapshots[j].CreatedAt)
+		}
+		return snapshots[i].ID < snapshots[j].ID
+	})
+}
+
+// retentionPolicy decides which snapshots are deleted. Its zero value keeps
+// them all.
+type retentionPolicy struct {
+	last   int
+	maxAge time.Duration
+
+	// backups is the store the backups of snapshots are looked for in, or
+	// nil if orphaned snapshots are kept.
+	backups           *FileObjectStore
+	backupBucket      string
+	backupPrefix      string
+	orphanGracePeriod time.Duration
+}
+
+// parseRetentionPolicy returns the retention policy configured by config.
+func parseRetentionPolicy(log logrus.FieldLogger, config map[string]string) (*retentionPolicy, error) {
+	r := &retentionPolicy{orphanGracePeriod: defaultOrphanGracePeriod}
+
+	if value := config[retainLastConfigKey]; value != "" {
+		last, err := strconv.Atoi(value)
+		if err != nil || last < 1 {
+			return nil, errors.Errorf("%s must be a positive integer, got %q", retainLastConfigKey, value)
+		}
+		r.last = last
+	}
+
+	if value := config[retainForConfigKey]; value != "" {
+		maxAge, err := time.ParseDuration(value)
+		if err != nil || maxAge <= 0 {
+			return nil, errors.Errorf("%s must be a positive duration, got %q", retainForConfigKey, value)
+		}
+		r.maxAge = maxAge
+	}
+
+	if value := config[orphanGracePeriodConfigKey]; value != "" {
+		grace, err := time.ParseDuration(value)
+		if err != nil || grace < 0 {
+			return nil, errors.Errorf("%s must be a non-negative duration, got %q", orphanGracePeriodConfigKey, value)
+		}
+		r.orphanGracePeriod = grace
+	}
+
+	if bucket := config[backupBucketConfigKey]; bucket != "" {
+		prefix := strings.Trim(config[backupPrefixConfigKey], "/")
+		storeConfig := locationConfig(config, backupConfigKeyPrefix)
+		storeConfig["prefix"] = prefix
+		store, err := OpenFileObjectStoreReadOnly(log, storeConfig)
+		if err != nil {
+			return nil, errors.Wrap(err, "error initializing the object store backups are looked for in")
+		}
+		r.backups = store
+		r.backupBucket = bucket
+		r.backupPrefix = prefix
+	}
+
+	return r, nil
+}
+
+// orphans returns the policy with only the orphan rule of r, which deletes
+// snapshots no backup references anymore, or nil if r does not have it.
+func (r *retentionPolicy) orphans() *retentionPolicy {
+	if r.backups == nil {
+		return nil
+	}
+	return &retentionPolicy{
+		backups:           r.backups,
+		backupBucket:      r.backupBucket,
+		backupPrefix:      r.backupPrefix,
+		orphanGracePeriod: r.orphanGracePeriod,
+	}
+}
+
+// expired returns the snapshots that the policy deletes at now, oldest
+// first.
+func (r *retentionPolicy) expired(snapshots []CatalogSnapshot, now time.Time) ([]ExpiredSnapshot, error) {
+	if r.backups != nil {
+		if err := r.checkBackupLocation(); err != nil {
+			return nil, errors.Wrap(err, "refusing to delete snapshots as orphaned")
+		}
+	}
+	sortSnapshots(snapshots)
+
+	// Snapshots are counted from the newest.
+	newer := make(map[string]int)
+	reasons := make([]string, len(snapshots))
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		claim := snapshots[i].claim()
+		if r.last > 0 && newer[claim] >= r.last {
+			reasons[i] = "older than the last " + strconv.Itoa(r.last) + " snapshots of " + claim
+		}
+		newer[claim]++
+	}
+
+	backups := make(map[string]bool)
+	var expired []ExpiredSnapshot
+	for i, snapshot := range snapshots {
+		if reasons[i] == "" && r.maxAge > 0 && now.Sub(snapshot.CreatedAt) > r.maxAge {
+			reasons[i] = "older than " + r.maxAge.String()
+		}
+		if backup := snapshot.Tags[BackupTagKey]; reasons[i] == "" && r.backups != nil && backup != "" && now.Sub(snapshot.CreatedAt) > r.orphanGracePeriod {
+			exists, ok := backups[backup]
+			if !ok {
+				var err error
+				if exists, err = r.backupExists(backup); err != nil {
+					return nil, err
+				}
+				backups[backup] = exists
+			}
+			if !exists {
+				reasons[i] = "backup " + backup + " no longer exists"
+			}
+		}
+
+		if reasons[i] != "" {
+			expired = append(expired, ExpiredSnapshot{CatalogSnapshot: snapshot, Reason: reasons[i]})
+		}
+	}
+	return expired, nil
+}
+
+// checkBackupLocation returns an error unless the backups directory of the
+// backup location exists and holds at least one backup. A mistyped root,
+// bucket or prefix would otherwise make every snapshot look orphaned.
+func (r *retentionPolicy) checkBackupLocation() error {
+	store := r.backups.location(r.backupBucket, r.backupPrefix)
+	dir, err := store.resolvePath(r.backupBucket, "prefix", path.Join(r.backupPrefix, "backups"))
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return errors.Errorf("backup directory %s does not exist, check %s, %s and %s", dir, backupRootConfigKey, backupBucketConfigKey, backupPrefixConfigKey)
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, entry.Name(), backupMetadataFileName)); err == nil {
+			return nil
+		}
+	}
+	return errors.Errorf("backup directory %s holds no backups", dir)
+}
+
+func (r *retentionPolicy) backupExists(backup string) (bool, error) {
+	if strings.Contains(backup, "/") {
+		return false, nil
+	}
+	exists, err := r.backups.ObjectExists(r.backupBucket, path.Join(r.backupPrefix, "backups", backup, backupMetadataFileName))
+	return exists, errors.Wrapf(err, "error looking for backup %s", backup)
+}
+
+// PruneSnapshots deletes the snapshots that the retention rules of the
+// snapshotter's config no longer keep, and returns them. With dryRun, it
+// only returns them. Snapshots that cannot be deleted are left in the
+// catalog, and reported in the returned error.
+func (p *NoOpVolumeSnapshotter) PruneSnapshots(dryRun bool) ([]ExpiredSnapshot, error) {
+	settings := p.current()
+	return p.pruneSnapshots(settings, settings.retention, dryRun)
+}
+
+// pruneSnapshots deletes the snapshots in the catalog of settings that policy
+// no longer keeps.
+func (p *NoOpVolumeSnapshotter) pruneSnapshots(settings *snapshotterSettings, policy *retentionPolicy, dryRun bool) ([]ExpiredSnapshot, error) {
+	snapshots, err := p.listSnapshots(settings, "")
+	if err != nil {
+		return nil, err
+	}
+	expired, err := policy.expired(snapshots, time.Now())
+	if err != nil || dryRun {
+		return expired, err
+	}
+
+	deleted := make([]ExpiredSnapshot, 0, len(expired))
+	var failed []string
+	for _, snapshot := range expired {
+		if err := p.deleteSnapshot(settings, snapshot.ID); err != nil {
+			p.WithError(err).Warnf("Error deleting expired snapshot %s (%s)", snapshot.ID, snapshot.Reason)
+			failed = append(failed, snapshot.ID)
+			continue
+		}
+		p.Infof("Deleted expired snapshot %s (%s)", snapshot.ID, snapshot.Reason)
+		deleted = append(deleted, snapshot)
+	}
+	if len(failed) > 0 {
+		return deleted, errors.Errorf("error deleting expired snapshots: %s", strings.Join(failed, ", "))
+	}
+	return deleted, nil
+}
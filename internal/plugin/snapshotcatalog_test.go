@@ -0,0 +1,212 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// TestOnlyOrphansArePrunedAutomatically checks that CreateSnapshot only
+// deletes snapshots whose backup is gone, and that the count and age rules
+// are applied by PruneSnapshots alone.
+func TestOnlyOrphansArePrunedAutomatically(t *testing.T) {
+	backupRoot := t.TempDir()
+	backups := newTestFileObjectStore(t, backupRoot)
+	if err := backups.PutObject("bucket", "backups/backup-1/"+backupMetadataFileName, strings.NewReader("{}")); err != nil {
+		t.Fatal(err)
+	}
+
+	config := newTestSnapshotterConfig(t.TempDir())
+	config[retainLastConfigKey] = "1"
+	config[retainForConfigKey] = "1ns"
+	config[backupBucketConfigKey] = "bucket"
+	config[backupRootConfigKey] = backupRoot
+	config[backupConfigKeyPrefix+"Versioning"] = "true"
+	config[orphanGracePeriodConfigKey] = "0s"
+	p := newTestSnapshotter(t)
+	if err := p.Init(config); err != nil {
+		t.Fatal(err)
+	}
+
+	volumeID := newTestVolume(t)
+	var kept []string
+	for i := 0; i < 3; i++ {
+		snapshotID, err := p.CreateSnapshot(volumeID, "zone-a", map[string]string{BackupTagKey: "backup-1", PVCTagKey: "app/data"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept = append(kept, snapshotID)
+	}
+	if _, err := p.CreateSnapshot(volumeID, "zone-a", map[string]string{BackupTagKey: "backup-2", PVCTagKey: "app/data"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := snapshotIDs(t, p); !equalKeys(got, sortedKeys(kept)) {
+		t.Fatalf("snapshots after CreateSnapshot = %q, want the orphan deleted and the others kept, %q", got, sortedKeys(kept))
+	}
+
+	pruned, err := p.PruneSnapshots(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned) != 3 {
+		t.Errorf("PruneSnapshots deleted %d snapshots, want all 3 older than retainFor", len(pruned))
+	}
+	if got := snapshotIDs(t, p); len(got) != 0 {
+		t.Errorf("snapshots after PruneSnapshots = %q, want none", got)
+	}
+}
+
+// TestMisconfiguredBackupLocationDeletesNothing checks that snapshots are
+// not deleted as orphaned when the backup location they are looked up in
+// does not exist or holds no backups, and that it is not created.
+func TestMisconfiguredBackupLocationDeletesNothing(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		setUp  func(t *testing.T, backups *FileObjectStore)
+	}{
+		{
+			name:   "wrong prefix",
+			prefix: "typo",
+			setUp: func(t *testing.T, backups *FileObjectStore) {
+				if err := backups.PutObject("bucket", "velero/backups/backup-1/"+backupMetadataFileName, strings.NewReader("{}")); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name:   "no backups",
+			prefix: "velero",
+			setUp: func(t *testing.T, backups *FileObjectStore) {
+				if err := backups.PutObject("bucket", "velero/backups/backup-1/velero-backup-logs.gz", strings.NewReader("")); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backupRoot := t.TempDir()
+			test.setUp(t, newTestFileObjectStore(t, backupRoot))
+
+			config := newTestSnapshotterConfig(t.TempDir())
+			config[backupBucketConfigKey] = "bucket"
+			config[backupRootConfigKey] = backupRoot
+			config[backupPrefixConfigKey] = test.prefix
+			config[orphanGracePeriodConfigKey] = "0s"
+			p := newTestSnapshotter(t)
+			if err := p.Init(config); err != nil {
+				t.Fatal(err)
+			}
+
+			volumeID := newTestVolume(t)
+			var kept []string
+			for _, backup := range []string{"backup-1", "backup-2"} {
+				snapshotID, err := p.CreateSnapshot(volumeID, "zone-a", map[string]string{BackupTagKey: backup})
+				if err != nil {
+					t.Fatal(err)
+				}
+				kept = append(kept, snapshotID)
+			}
+
+			if pruned, err := p.PruneSnapshots(false); err == nil || len(pruned) != 0 {
+				t.Errorf("PruneSnapshots() = %d snapshots, %v, want none and an error", len(pruned), err)
+			}
+			if got := snapshotIDs(t, p); !equalKeys(got, sortedKeys(kept)) {
+				t.Errorf("snapshots = %q, want all kept, %q", got, sortedKeys(kept))
+			}
+			if _, err := os.Stat(filepath.Join(backupRoot, "bucket", "typo")); !os.IsNotExist(err) {
+				t.Errorf("the misconfigured backup location was created: %v", err)
+			}
+		})
+	}
+}
+
+// TestClaimsAreSharedThroughTheStateFile checks that the PVC recorded by
+// GetVolumeID tags the snapshot another snapshotter sharing the state file
+// takes, as when Velero calls them in different plugin processes.
+func TestClaimsAreSharedThroughTheStateFile(t *testing.T) {
+	config := newTestSnapshotterConfig(t.TempDir())
+	volumeID := newTestVolume(t)
+	pv := &v1.PersistentVolume{
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				HostPath: &v1.HostPathVolumeSource{Path: volumeID},
+			},
+			ClaimRef: &v1.ObjectReference{Namespace: "app", Name: "data"},
+		},
+	}
+	pv.ObjectMeta = metav1.ObjectMeta{Name: "pv-1"}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := newTestSnapshotter(t)
+	if err := first.Init(config); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := first.GetVolumeID(&unstructured.Unstructured{Object: content}); err != nil || got != volumeID {
+		t.Fatalf("GetVolumeID() = %q, %v, want %q", got, err, volumeID)
+	}
+
+	second := newTestSnapshotter(t)
+	if err := second.Init(config); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.CreateSnapshot(volumeID, "zone-a", map[string]string{BackupTagKey: "backup-1"}); err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := second.ListSnapshots(PVCTagKey + "=app/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 1 {
+		t.Errorf("ListSnapshots found %d snapshots of app/data, want 1", len(snapshots))
+	}
+}
+
+// snapshotIDs returns the IDs of the snapshots in the catalog of p, sorted.
+func snapshotIDs(t *testing.T, p *NoOpVolumeSnapshotter) []string {
+	t.Helper()
+
+	snapshots, err := p.ListSnapshots("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		ids = append(ids, snapshot.ID)
+	}
+	return sortedKeys(ids)
+}
+
+func sortedKeys(keys []string) []string {
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	return sorted
+}
@@ -0,0 +1,267 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Snapshots can be exported to a bucket of a FileObjectStore, typically the
+// one of the backup storage location, so that they can be restored in another
+// cluster. An exported snapshot is a set of objects:
+//
+//	<exportPrefix>/plugins/example-volume-snapshotter/snapshots/<backup>/<name>/manifest.json
+//	<exportPrefix>/plugins/example-volume-snapshotter/snapshots/<backup>/<name>/chunks/<hash>
+//
+// where name is derived from the snapshot ID, so that a snapshot can be found
+// by its ID alone. Velero marks a backup storage location unavailable if its
+// prefix holds directories other than its own, and leaves plugins/ to plugins,
+// so exports can share the prefix of the location. The manifest is written last, so a snapshot without one is
+// incomplete and never restored from.
+const (
+	// exportBucketConfigKey is the VSL config key for the bucket snapshots are
+	// exported to. Snapshots are only exported if it is set.
+	exportBucketConfigKey = "exportBucket"
+	// exportRootConfigKey is the VSL config key for the root directory of the
+	// FileObjectStore the bucket is in.
+	exportRootConfigKey = "exportRoot"
+	// exportPrefixConfigKey is the VSL config key for the prefix of the keys of
+	// exported snapshots in the bucket, like the prefix of a BSL.
+	exportPrefixConfigKey = "exportPrefix"
+	// exportConfigKeyPrefix is prepended to the BSL config keys of the
+	// FileObjectStore, such as objectLockMode, to give the VSL config keys
+	// that configure it for exported snapshots, such as exportObjectLockMode.
+	exportConfigKeyPrefix = "export"
+
+	exportDirName = "plugins/example-volume-snapshotter/snapshots"
+
+	exportManifestVersion = 1
+)
+
+// exportedSnapshot is the manifest of an exported snapshot. It only refers to
+// the chunks exported with it, so it can be restored from anywhere.
+type exportedSnapshot struct {
+	Version    int               `json:"version"`
+	SnapshotID string            `json:"snapshotID"`
+	VolID      string            `json:"volID"`
+	AZ         string            `json:"az"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	CreatedAt  time.Time         `json:"createdAt"`
+	Entries    []manifestEntry   `json:"entries"`
+}
+
+// snapshotExporter exports snapshots to, and restores them from, a bucket.
+type snapshotExporter struct {
+	store  *FileObjectStore
+	bucket string
+	prefix string
+}
+
+// newSnapshotExporter returns the exporter configured by config, or nil if
+// snapshots are not to be exported. Unless the export config keys say
+// otherwise, the object store compresses and encrypts exported snapshots with
+// the settings of the snapshotter.
+func newSnapshotExporter(log logrus.FieldLogger, config map[string]string) (*snapshotExporter, error) {
+	bucket := config[exportBucketConfigKey]
+	if bucket == "" {
+		return nil, nil
+	}
+
+	storeConfig := locationConfig(config, exportConfigKeyPrefix)
+	for _, key := range []string{encryptionKeyFileConfigKey, compressionConfigKey} {
+		if _, ok := storeConfig[key]; !ok {
+			storeConfig[key] = config[key]
+		}
+	}
+	prefix := strings.Trim(config[exportPrefixConfigKey], "/")
+	storeConfig["prefix"] = prefix
+
+	store, err := OpenFileObjectStore(log, storeConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "error initializing the object store snapshots are exported to")
+	}
+
+	return &snapshotExporter{store: store, bucket: bucket, prefix: prefix}, nil
+}
+
+// exportName returns the name snapshotID is exported under.
+func exportName(snapshotID string) string {
+	sum := sha256.Sum256([]byte(snapshotID))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (e *snapshotExporter) key(elem ...string) string {
+	return path.Join(append([]string{e.prefix, exportDirName}, elem...)...)
+}
+
+// export uploads snapshot, whose ID is snapshotID, and returns the prefix of
+// the keys it was uploaded under. If it fails after uploading started, it
+// returns the prefix along with the error, so that the partial upload can be
+// removed. Chunked snapshots are decoded with kr.
+func (e *snapshotExporter) export(log logrus.FieldLogger, snapshotID string, snapshot Snapshot, kr *keyring) (string, error) {
+	backup := snapshot.Tags[BackupTagKey]
+	if backup == "" || strings.Contains(backup, "/") {
+		return "", errors.Errorf("snapshot %s has no valid %s tag to export it under", snapshotID, BackupTagKey)
+	}
+	dir := e.key(backup, exportName(snapshotID))
+
+	uploaded := make(map[string]bool)
+	put := func(hash string, body io.Reader) error {
+		if uploaded[hash] {
+			return nil
+		}
+		if err := e.store.PutObject(e.bucket, path.Join(dir, snapshotChunksDirName, hash), body); err != nil {
+			return err
+		}
+		uploaded[hash] = true
+		return nil
+	}
+
+	var manifest *snapshotManifest
+	var err error
+	if snapshot.chunked() {
+		encoding := snapshot.encoding(kr)
+		if manifest, err = readManifest(snapshot.Path, encoding); err != nil {
+			return dir, err
+		}
+		for _, entry := range manifest.Entries {
+			for _, hash := range entry.Chunks {
+				r, err := encoding.openDecoded(chunkPath(filepath.Join(snapshot.Path, snapshotChunksDirName), hash))
+				if err != nil {
+					return dir, err
+				}
+				err = put(hash, r)
+				r.Close()
+				if err != nil {
+					return dir, err
+				}
+			}
+		}
+	} else {
+		manifest, err = scanVolume(log, snapshot.Path, func(string) bool { return false }, func(chunk []byte) (string, error) {
+			sum := sha256.Sum256(chunk)
+			hash := hex.EncodeToString(sum[:])
+			return hash, put(hash, bytes.NewReader(chunk))
+		}, nil)
+		if err != nil {
+			return dir, err
+		}
+	}
+
+	data, err := json.Marshal(exportedSnapshot{
+		Version:    exportManifestVersion,
+		SnapshotID: snapshotID,
+		VolID:      snapshot.VolID,
+		AZ:         snapshot.AZ,
+		Tags:       snapshot.Tags,
+		CreatedAt:  snapshot.CreatedAt,
+		Entries:    manifest.Entries,
+	})
+	if err != nil {
+		return dir, errors.WithStack(err)
+	}
+	if err := e.store.PutObject(e.bucket, path.Join(dir, manifestFileName), bytes.NewReader(data)); err != nil {
+		return dir, err
+	}
+
+	log.Infof("Exported snapshot %s with %d chunks to %s", snapshotID, len(uploaded), dir)
+	return dir, nil
+}
+
+// find returns the prefix and manifest of the exported snapshot with ID
+// snapshotID, or "" if it has not been exported.
+func (e *snapshotExporter) find(snapshotID string) (string, *exportedSnapshot, error) {
+	backups, err := e.store.ListCommonPrefixes(e.bucket, e.key()+"/", "/")
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, backup := range backups {
+		dir := path.Join(backup, exportName(snapshotID))
+		exists, err := e.store.ObjectExists(e.bucket, path.Join(dir, manifestFileName))
+		if err != nil {
+			return "", nil, err
+		}
+		if !exists {
+			continue
+		}
+
+		exported, err := e.readExported(dir)
+		if err != nil {
+			return "", nil, err
+		}
+		if exported.SnapshotID == snapshotID {
+			return dir, exported, nil
+		}
+	}
+	return "", nil, nil
+}
+
+func (e *snapshotExporter) readExported(dir string) (*exportedSnapshot, error) {
+	r, err := e.store.GetObject(e.bucket, path.Join(dir, manifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	exported := new(exportedSnapshot)
+	if err := json.NewDecoder(r).Decode(exported); err != nil {
+		return nil, errors.Wrapf(err, "error decoding the manifest of exported snapshot %s", dir)
+	}
+	if exported.Version != exportManifestVersion {
+		return nil, errors.Errorf("exported snapshot %s has manifest version %d, only %d is supported", dir, exported.Version, exportManifestVersion)
+	}
+	return exported, nil
+}
+
+// fetch recreates the directory tree of the exported snapshot at dir, whose
+// manifest is exported, at dst.
+func (e *snapshotExporter) fetch(log logrus.FieldLogger, dir string, exported *exportedSnapshot, dst string) error {
+	err := materialize(log, &snapshotManifest{Entries: exported.Entries}, dst, func(hash string) (io.ReadCloser, error) {
+		return e.store.GetObject(e.bucket, path.Join(dir, snapshotChunksDirName, hash))
+	})
+	return errors.Wrapf(err, "error restoring exported snapshot %s", dir)
+}
+
+// remove deletes the exported snapshot at dir, starting with its manifest.
+func (e *snapshotExporter) remove(dir string) error {
+	if err := e.store.DeleteObject(e.bucket, path.Join(dir, manifestFileName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	keys, err := e.store.ListObjects(e.bucket, dir+"/")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := e.store.DeleteObject(e.bucket, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// veleroTopLevelDirs are the directories Velero allows directly under the
+// prefix of a backup storage location. It marks a location unavailable if
+// there are any others.
+var veleroTopLevelDirs = map[string]bool{
+	"backups":  true,
+	"restores": true,
+	"restic":   true,
+	"metadata": true,
+	"plugins":  true,
+	"kopia":    true,
+}
+
+// TestExportRoundTrip checks that a snapshot exported in one cluster is
+// restored in another that only shares the export location, that exports
+// leave the prefix of a backup storage location valid for Velero, and that
+// deleting the snapshot deletes the export.
+func TestExportRoundTrip(t *testing.T) {
+	exportRoot := t.TempDir()
+	withExport := func(config map[string]string) map[string]string {
+		config[exportBucketConfigKey] = "velero"
+		config[exportRootConfigKey] = exportRoot
+		config[exportPrefixConfigKey] = "cluster-a"
+		return config
+	}
+
+	volumeID := newTestVolume(t)
+	if err := os.MkdirAll(filepath.Join(volumeID, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(volumeID, "dir", "nested"), []byte("nested"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, compression := range []string{"", compressionGzip} {
+		t.Run("compression "+compression, func(t *testing.T) {
+			sourceConfig := withExport(newTestSnapshotterConfig(t.TempDir()))
+			sourceConfig[compressionConfigKey] = compression
+			source := newTestSnapshotter(t)
+			if err := source.Init(sourceConfig); err != nil {
+				t.Fatal(err)
+			}
+			snapshotID, err := source.CreateSnapshot(volumeID, "zone-a", map[string]string{BackupTagKey: "backup-1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			entries, err := os.ReadDir(filepath.Join(exportRoot, "velero", "cluster-a"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range entries {
+				if !isInternalName(entry.Name()) && !veleroTopLevelDirs[entry.Name()] {
+					t.Errorf("export created %s under the prefix, which Velero does not allow", entry.Name())
+				}
+			}
+
+			target := newTestSnapshotter(t)
+			targetConfig := withExport(newTestSnapshotterConfig(t.TempDir()))
+			targetConfig[compressionConfigKey] = compression
+			if err := target.Init(targetConfig); err != nil {
+				t.Fatal(err)
+			}
+			restored, err := target.CreateVolumeFromSnapshot(snapshotID, "", "zone-a", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range map[string]string{"data": "data", "dir/nested": "nested"} {
+				got, err := os.ReadFile(filepath.Join(restored, filepath.FromSlash(name)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != want {
+					t.Errorf("restored %s = %q, want %q", name, got, want)
+				}
+			}
+
+			if err := source.DeleteSnapshot(snapshotID); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := target.CreateVolumeFromSnapshot(snapshotID, "", "zone-a", nil); err == nil {
+				t.Errorf("the snapshot was still restored from its export after it was deleted")
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// stateFileConfigKey is the VSL config key for the path of the file the
+	// snapshotter keeps its catalog of volumes and snapshots in. It should be
+	// on a persistent volume for snapshots to survive restarts of the Velero pod.
+	stateFileConfigKey = "stateFile"
+
+	defaultStateFile = "/tmp/velero-volume-snapshotter/state.json"
+)
+
+// snapshotterState is the catalog of the volumes and snapshots a
+// NoOpVolumeSnapshotter knows about, as stored in its state file.
+type snapshotterState struct {
+	Volumes   map[string]Volume   `json:"volumes"`
+	Snapshots map[string]Snapshot `json:"snapshots"`
+	// Claims are the PVCs of the volumes GetVolumeID was called for, by volume ID.
+	Claims map[string]string `json:"claims,omitempty"`
+}
+
+// loadSnapshotterState reads the state file at path. A missing file is an empty catalog.
+func loadSnapshotterState(path string) (*snapshotterState, error) {
+	state := &snapshotterState{
+		Volumes:   make(map[string]Volume),
+		Snapshots: make(map[string]Snapshot),
+		Claims:    make(map[string]string),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, errors.Wrapf(err, "error decoding snapshotter state file %s", path)
+	}
+
+	if state.Volumes == nil {
+		state.Volumes = make(map[string]Volume)
+	}
+	if state.Snapshots == nil {
+		state.Snapshots = make(map[string]Snapshot)
+	}
+	if state.Claims == nil {
+		state.Claims = make(map[string]string)
+	}
+	return state, nil
+}
+
+// encode returns the content of the state file for s.
+func (s *snapshotterState) encode() ([]byte, error) {
+	data, err := json.MarshalIndent(s, "", "  ")
+	return data, errors.WithStack(err)
+}
+
+// withState runs fn with the current catalog in the state file of settings,
+// and saves the catalog afterwards if fn succeeded and changed it. The mutex
+// serializes the calls of this process, and a lock file those of all plugin
+// processes sharing the state file.
+func (p *NoOpVolumeSnapshotter) withState(settings *snapshotterSettings, fn func(state *snapshotterState) error) error {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+
+	path := settings.stateFile
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return withFileLock(path+".lock", func() error {
+		state, err := loadSnapshotterState(path)
+		if err != nil {
+			return err
+		}
+		before, err := state.encode()
+		if err != nil {
+			return err
+		}
+		if err := fn(state); err != nil {
+			return err
+		}
+		after, err := state.encode()
+		if err != nil || bytes.Equal(before, after) {
+			return err
+		}
+		return writeFileAtomic(path, bytes.NewReader(after), 0600)
+	})
+}
@@ -0,0 +1,326 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Every snapshot records the content it was taken with, so that it can be
+// verified long before it is needed. Chunked snapshots have the hashes of
+// their chunks in their own manifest. Copy snapshots get a manifest of the same
+// format next to the copy, named after it with contentManifestSuffix, which
+// lists the hashes of the chunks the copied files would be split into.
+const contentManifestSuffix = ".manifest.json"
+
+// SnapshotVerification is the outcome of verifying the data of a snapshot.
+type SnapshotVerification struct {
+	SnapshotID string
+	VolumeID   string
+	CreatedAt  time.Time
+	// Skipped is why the content of the snapshot could not be checked, if it
+	// could not, e.g. because it is encrypted with a key that is not in the
+	// keyring.
+	Skipped string
+	// Files and Chunks are the numbers of files and chunks that were checked.
+	Files  int
+	Chunks int
+	// Problems describe the missing and corrupted content that was found. A
+	// snapshot without problems restores the content it was taken with.
+	Problems []string
+}
+
+func (v *SnapshotVerification) problem(format string, args ...interface{}) {
+	v.Problems = append(v.Problems, fmt.Sprintf(format, args...))
+}
+
+// VerifySnapshots rechecks the data of the snapshot with ID snapshotID, or of
+// every snapshot in the catalog if it is empty, against the content recorded
+// when it was taken. The results are ordered by snapshot ID. Snapshots deleted
+// while they are verified are left out.
+func (p *NoOpVolumeSnapshotter) VerifySnapshots(snapshotID string) ([]SnapshotVerification, error) {
+	settings := p.current()
+	snapshots := make(map[string]Snapshot)
+	err := p.withState(settings, func(state *snapshotterState) error {
+		if snapshotID == "" {
+			for id, snapshot := range state.Snapshots {
+				snapshots[id] = snapshot
+			}
+			return nil
+		}
+		snapshot, ok := state.Snapshots[snapshotID]
+		if !ok {
+			return errors.New("Snapshot " + snapshotID + " not found")
+		}
+		snapshots[snapshotID] = snapshot
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(snapshots))
+	for id := range snapshots {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	results := make([]SnapshotVerification, 0, len(ids))
+	for _, id := range ids {
+		snapshot := snapshots[id]
+		result := SnapshotVerification{SnapshotID: id, VolumeID: snapshot.VolID, CreatedAt: snapshot.CreatedAt}
+		if snapshot.chunked() {
+			verifyChunkedSnapshot(snapshot, settings.keyring, &result)
+		} else {
+			verifyCopySnapshot(snapshot, &result)
+		}
+		if len(result.Problems) > 0 {
+			p.Infof("Snapshot %s has %d problems", id, len(result.Problems))
+		}
+		results = append(results, result)
+	}
+
+	// Problems with snapshots that were deleted meanwhile are likely to be
+	// caused by the deletion.
+	err = p.withState(settings, func(state *snapshotterState) error {
+		kept := results[:0]
+		for _, result := range results {
+			if _, ok := state.Snapshots[result.SnapshotID]; ok {
+				kept = append(kept, result)
+			}
+		}
+		results = kept
+		return nil
+	})
+	return results, err
+}
+
+// writeContentManifest records the content of the copy snapshot in dir in a
+// manifest next to it, and returns the path of the manifest.
+func writeContentManifest(log logrus.FieldLogger, dir string) (string, error) {
+	manifest, err := scanVolume(log, dir, func(string) bool { return false }, hashChunk, nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "error recording the content of snapshot %s", dir)
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	path := dir + contentManifestSuffix
+	return path, writeFileAtomic(path, bytes.NewReader(data), 0600)
+}
+
+// hashChunk returns the hash a chunk is named after.
+func hashChunk(chunk []byte) (string, error) {
+	sum := sha256.Sum256(chunk)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// verifyChunkedSnapshot checks that every chunk that the manifest of the
+// chunked snapshot refers to is present, decodes with kr and has the right
+// hash, and that the chunks of every file add up to its size.
+func verifyChunkedSnapshot(snapshot Snapshot, kr *keyring, result *SnapshotVerification) {
+	if snapshot.KeyID != "" && (kr == nil || kr.keys[snapshot.KeyID] == nil) {
+		result.Skipped = "the snapshot is encrypted with key " + snapshot.KeyID + ", which is not in the keyring"
+		return
+	}
+	encoding := snapshot.encoding(kr)
+	manifest, err := readManifest(snapshot.Path, encoding)
+	if os.IsNotExist(errors.Cause(err)) {
+		result.problem("the snapshot manifest is missing")
+		return
+	}
+	if err != nil {
+		result.problem("the snapshot manifest cannot be read: %v", err)
+		return
+	}
+
+	// Chunks shared by several files are only read once.
+	chunks := filepath.Join(snapshot.Path, snapshotChunksDirName)
+	sizes := make(map[string]int64)
+	failed := make(map[string]error)
+	for _, entry := range manifest.Entries {
+		if entry.Type != manifestFile {
+			continue
+		}
+		result.Files++
+
+		var size int64
+		complete := true
+		for _, hash := range entry.Chunks {
+			if !isChunkHash(hash) {
+				result.problem("%s refers to invalid chunk %q", entry.Path, hash)
+				complete = false
+				continue
+			}
+			if _, ok := sizes[hash]; !ok && failed[hash] == nil {
+				result.Chunks++
+				if n, err := verifyChunk(chunkPath(chunks, hash), hash, encoding); err != nil {
+					failed[hash] = err
+				} else {
+					sizes[hash] = n
+				}
+			}
+			if err := failed[hash]; err != nil {
+				result.problem("%s: %v", entry.Path, err)
+				complete = false
+				continue
+			}
+			size += sizes[hash]
+		}
+		if complete && size != entry.Size {
+			result.problem("%s has %d bytes in its chunks, expected %d", entry.Path, size, entry.Size)
+		}
+	}
+}
+
+// verifyChunk checks that the chunk at path decodes with encoding and hashes
+// to hash, and returns its decoded size.
+func verifyChunk(path, hash string, encoding chunkEncoding) (int64, error) {
+	r, err := encoding.openDecoded(path)
+	if os.IsNotExist(errors.Cause(err)) {
+		return 0, errors.Errorf("chunk %s is missing", hash)
+	}
+	if err != nil {
+		return 0, errors.Errorf("chunk %s is corrupt: %v", hash, err)
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return 0, errors.Errorf("chunk %s is corrupt: %v", hash, err)
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != hash {
+		return 0, errors.Errorf("chunk %s is corrupt, its content hashes to %s", hash, actual)
+	}
+	return n, nil
+}
+
+// verifyCopySnapshot checks the copy snapshot against its content manifest:
+// every entry must be present with the same type, symlinks must have the same
+// target, and files the same size and chunk hashes.
+func verifyCopySnapshot(snapshot Snapshot, result *SnapshotVerification) {
+	if _, err := os.Stat(snapshot.Path); err != nil {
+		result.problem("the snapshot data cannot be read: %v", err)
+		return
+	}
+	data, err := os.ReadFile(snapshot.Manifest)
+	if err != nil {
+		result.problem("the content manifest cannot be read: %v", err)
+		return
+	}
+	manifest := new(snapshotManifest)
+	if err := json.Unmarshal(data, manifest); err != nil {
+		result.problem("the content manifest cannot be decoded: %v", err)
+		return
+	}
+
+	for _, entry := range manifest.Entries {
+		target := filepath.Join(snapshot.Path, filepath.FromSlash(entry.Path))
+		if !isWithin(snapshot.Path, target) {
+			result.problem("the content manifest has invalid path %q", entry.Path)
+			continue
+		}
+		info, err := os.Lstat(target)
+		if os.IsNotExist(err) {
+			result.problem("%s is missing", entry.Path)
+			continue
+		}
+		if err != nil {
+			result.problem("%s cannot be read: %v", entry.Path, err)
+			continue
+		}
+
+		switch entry.Type {
+		case manifestDir:
+			if !info.IsDir() {
+				result.problem("%s is no longer a directory", entry.Path)
+			}
+
+		case manifestSymlink:
+			if info.Mode()&fs.ModeSymlink == 0 {
+				result.problem("%s is no longer a symlink", entry.Path)
+			} else if link, err := os.Readlink(target); err != nil || link != entry.Target {
+				result.problem("%s no longer links to %s", entry.Path, entry.Target)
+			}
+
+		case manifestHardlink:
+			if !info.Mode().IsRegular() {
+				result.problem("%s is no longer a file", entry.Path)
+			}
+
+		case manifestFile:
+			result.Files++
+			switch {
+			case !info.Mode().IsRegular():
+				result.problem("%s is no longer a file", entry.Path)
+			case info.Size() != entry.Size:
+				result.problem("%s has %d bytes, expected %d", entry.Path, info.Size(), entry.Size)
+			default:
+				if err := verifyFile(target, entry, result); err != nil {
+					result.problem("%s cannot be read: %v", entry.Path, err)
+				}
+			}
+
+		default:
+			result.problem("the content manifest has unknown type %q for %s", entry.Type, entry.Path)
+		}
+	}
+}
+
+// verifyFile splits the file at path into chunks and compares their hashes
+// with those recorded for it in entry.
+func verifyFile(path string, entry manifestEntry, result *SnapshotVerification) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	chunker := newChunker(file)
+	var chunk []byte
+	for i := 0; ; i++ {
+		if chunk, err = chunker.next(chunk); err == io.EOF {
+			if i != len(entry.Chunks) {
+				result.problem("%s is corrupt, it has %d chunks, expected %d", entry.Path, i, len(entry.Chunks))
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+		result.Chunks++
+		hash, _ := hashChunk(chunk)
+		if i >= len(entry.Chunks) || hash != entry.Chunks[i] {
+			result.problem("%s is corrupt from chunk %d on", entry.Path, i)
+			return nil
+		}
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// catalogSnapshot returns the catalog entry of the snapshot snapshotID of p.
+func catalogSnapshot(t *testing.T, p *NoOpVolumeSnapshotter, snapshotID string) Snapshot {
+	t.Helper()
+
+	var snapshot Snapshot
+	err := p.withState(p.current(), func(state *snapshotterState) error {
+		snapshot = state.Snapshots[snapshotID]
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snapshot
+}
+
+// snapshotDataFiles returns the regular files below the data of snapshot
+// that hold file content: the copied files of a copy snapshot, and the
+// chunks of a chunked one.
+func snapshotDataFiles(t *testing.T, snapshot Snapshot) []string {
+	t.Helper()
+
+	dir := snapshot.Path
+	if snapshot.chunked() {
+		dir = filepath.Join(dir, snapshotChunksDirName)
+	}
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if info.Size() > 0 {
+				files = append(files, path)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatalf("snapshot %s has no data files", snapshot.Path)
+	}
+	return files
+}
+
+// TestVerifySnapshotsDetectsDamage checks that VerifySnapshots reports no
+// problems for intact snapshots, and reports data that was changed or
+// removed after the snapshot was taken.
+func TestVerifySnapshotsDetectsDamage(t *testing.T) {
+	damages := map[string]func(t *testing.T, path string){
+		"changed": func(t *testing.T, path string) {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data[0] ^= 1
+			if err := os.WriteFile(path, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+		},
+		"removed": func(t *testing.T, path string) {
+			if err := os.Remove(path); err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+
+	for name, options := range map[string]map[string]string{
+		"copy":         {},
+		"deduplicated": {deduplicateConfigKey: "true"},
+		"compressed":   {compressionConfigKey: compressionGzip},
+	} {
+		for damage, apply := range damages {
+			t.Run(name+" "+damage, func(t *testing.T) {
+				config := newTestSnapshotterConfig(t.TempDir())
+				for key, value := range options {
+					config[key] = value
+				}
+				p := newTestSnapshotter(t)
+				if err := p.Init(config); err != nil {
+					t.Fatal(err)
+				}
+				snapshotID, err := p.CreateSnapshot(newTestVolumeTree(t), "zone-a", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				results, err := p.VerifySnapshots(snapshotID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(results) != 1 || results[0].Skipped != "" || len(results[0].Problems) != 0 || results[0].Files == 0 {
+					t.Fatalf("VerifySnapshots() of an intact snapshot = %+v, want it checked without problems", results)
+				}
+
+				apply(t, snapshotDataFiles(t, catalogSnapshot(t, p, snapshotID))[0])
+				results, err = p.VerifySnapshots(snapshotID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(results) != 1 || len(results[0].Problems) == 0 {
+					t.Errorf("VerifySnapshots() of a snapshot with %s data = %+v, want problems", damage, results)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// zoneMappingConfigKey is the VSL config key for comma-separated
+	// <from>=<to> pairs of zones that snapshots taken in one zone are restored
+	// into the other, for restoring into a cluster with different zones.
+	zoneMappingConfigKey = "zoneMapping"
+	// nodeMappingConfigKey is the VSL config key for comma-separated
+	// <from>=<to> pairs of node names that restored PVs' node affinity is
+	// rewritten with.
+	nodeMappingConfigKey = "nodeMapping"
+
+	// nodeNameField is the node field that node selector terms can match on.
+	nodeNameField = "metadata.name"
+)
+
+// zoneLabels are the labels and node affinity keys that hold a zone.
+var zoneLabels = []string{v1.LabelTopologyZone, v1.LabelFailureDomainBetaZone}
+
+// parseMapping parses the <from>=<to> pairs set for key in config.
+func parseMapping(config map[string]string, key string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	if config[key] == "" {
+		return mapping, nil
+	}
+
+	for _, pair := range strings.Split(config[key], ",") {
+		from, to, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || from == "" || to == "" {
+			return nil, errors.Errorf("invalid %s entry %q, must be <from>=<to>", key, pair)
+		}
+		if _, ok := mapping[from]; ok {
+			return nil, errors.Errorf("%s maps %s more than once", key, from)
+		}
+		mapping[from] = to
+	}
+	return mapping, nil
+}
+
+// restoreZone returns the zone a volume created from a snapshot taken in
+// snapshotAZ is created in, when Velero asks for requestedAZ. Velero asks for
+// the zone the snapshot was taken in, which is mapped if zoneMapping maps it;
+// asking for any zone other than that or its mapping is an error.
+func (s *snapshotterSettings) restoreZone(snapshotAZ, requestedAZ string) (string, error) {
+	zone := snapshotAZ
+	if mapped, ok := s.zoneMapping[snapshotAZ]; ok {
+		zone = mapped
+	}
+
+	switch {
+	case requestedAZ == "" || requestedAZ == zone:
+		return zone, nil
+	case snapshotAZ == "":
+		return requestedAZ, nil
+	case requestedAZ == snapshotAZ:
+		return zone, nil
+	default:
+		return "", errors.Errorf("a snapshot taken in zone %s can only be restored into zone %s, not %s", snapshotAZ, zone, requestedAZ)
+	}
+}
+
+// rewriteTopology maps the zones and node names in the labels and node
+// affinity of pv with zoneMapping and nodeMapping.
+func (s *snapshotterSettings) rewriteTopology(log logrus.FieldLogger, pv *v1.PersistentVolume) {
+	for _, label := range zoneLabels {
+		if zone, ok := pv.Labels[label]; ok {
+			pv.Labels[label] = mapTopology(log, s.zoneMapping, label, zone)
+		}
+	}
+
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return
+	}
+	for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		for _, req := range term.MatchExpressions {
+			switch {
+			case req.Key == v1.LabelHostname:
+				mapValues(log, s.nodeMapping, req.Key, req.Values)
+			case isZoneLabel(req.Key):
+				mapValues(log, s.zoneMapping, req.Key, req.Values)
+			}
+		}
+		for _, req := range term.MatchFields {
+			if req.Key == nodeNameField {
+				mapValues(log, s.nodeMapping, req.Key, req.Values)
+			}
+		}
+	}
+}
+
+func mapValues(log logrus.FieldLogger, mapping map[string]string, key string, values []string) {
+	for i, value := range values {
+		values[i] = mapTopology(log, mapping, key, value)
+	}
+}
+
+// mapTopology returns what mapping maps value of key to. Values that are not
+// mapped are kept, with a warning if mapping is not empty, as the target
+// cluster is then likely not to have them.
+func mapTopology(log logrus.FieldLogger, mapping map[string]string, key, value string) string {
+	if mapped, ok := mapping[value]; ok {
+		log.Infof("Rewriting %s %s to %s", key, value, mapped)
+		return mapped
+	}
+	if len(mapping) > 0 {
+		log.Warnf("No mapping for %s %s, keeping it", key, value)
+	}
+	return value
+}
+
+func isZoneLabel(key string) bool {
+	for _, label := range zoneLabels {
+		if key == label {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestParseMapping(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{value: "", want: map[string]string{}},
+		{value: "zone-a=zone-b", want: map[string]string{"zone-a": "zone-b"}},
+		{value: "zone-a=zone-b, zone-b=zone-a", want: map[string]string{"zone-a": "zone-b", "zone-b": "zone-a"}},
+		{value: "zone-a", wantErr: true},
+		{value: "zone-a=", wantErr: true},
+		{value: "=zone-b", wantErr: true},
+		{value: "zone-a=zone-b,zone-a=zone-c", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := parseMapping(map[string]string{zoneMappingConfigKey: test.value}, zoneMappingConfigKey)
+		if (err != nil) != test.wantErr || (!test.wantErr && !reflect.DeepEqual(got, test.want)) {
+			t.Errorf("parseMapping(%q) = %v, %v, want %v and an error: %t", test.value, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+// TestRestoreZone checks that volumes are restored into the mapped zone of
+// their snapshot whether Velero asks for the snapshot's zone or the mapped
+// one, and that asking for any other zone fails.
+func TestRestoreZone(t *testing.T) {
+	settings := &snapshotterSettings{zoneMapping: map[string]string{"zone-a": "zone-b"}}
+	tests := []struct {
+		snapshotAZ, requestedAZ string
+		want                    string
+		wantErr                 bool
+	}{
+		{snapshotAZ: "zone-a", requestedAZ: "", want: "zone-b"},
+		{snapshotAZ: "zone-a", requestedAZ: "zone-a", want: "zone-b"},
+		{snapshotAZ: "zone-a", requestedAZ: "zone-b", want: "zone-b"},
+		{snapshotAZ: "zone-a", requestedAZ: "zone-c", wantErr: true},
+		{snapshotAZ: "zone-c", requestedAZ: "zone-c", want: "zone-c"},
+		{snapshotAZ: "zone-c", requestedAZ: "zone-a", wantErr: true},
+		{snapshotAZ: "", requestedAZ: "zone-c", want: "zone-c"},
+	}
+
+	for _, test := range tests {
+		got, err := settings.restoreZone(test.snapshotAZ, test.requestedAZ)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("restoreZone(%q, %q) = %q, %v, want %q and an error: %t", test.snapshotAZ, test.requestedAZ, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+// TestSetVolumeIDRewritesTopology checks that the zones and node names of
+// restored PVs are mapped, in their labels as in their node affinity, and
+// that what is not mapped is kept.
+func TestSetVolumeIDRewritesTopology(t *testing.T) {
+	config := newTestSnapshotterConfig(t.TempDir())
+	config[zoneMappingConfigKey] = "zone-a=zone-b"
+	config[nodeMappingConfigKey] = "node-1=node-2"
+	p := newTestSnapshotter(t)
+	if err := p.Init(config); err != nil {
+		t.Fatal(err)
+	}
+
+	affinity := func(zone, node string) *v1.VolumeNodeAffinity {
+		return &v1.VolumeNodeAffinity{Required: &v1.NodeSelector{NodeSelectorTerms: []v1.NodeSelectorTerm{{
+			MatchExpressions: []v1.NodeSelectorRequirement{
+				{Key: v1.LabelTopologyZone, Operator: v1.NodeSelectorOpIn, Values: []string{zone, "zone-c"}},
+				{Key: v1.LabelHostname, Operator: v1.NodeSelectorOpIn, Values: []string{node}},
+				{Key: "example.com/rack", Operator: v1.NodeSelectorOpIn, Values: []string{"zone-a"}},
+			},
+			MatchFields: []v1.NodeSelectorRequirement{
+				{Key: nodeNameField, Operator: v1.NodeSelectorOpIn, Values: []string{node}},
+			},
+		}}}}
+	}
+	newPV := func(zone, node, path string) *v1.PersistentVolume {
+		pv := &v1.PersistentVolume{Spec: pvSpec(v1.PersistentVolumeSource{HostPath: &v1.HostPathVolumeSource{Path: path}})}
+		pv.Name = "pv-1"
+		pv.Labels = map[string]string{
+			v1.LabelTopologyZone:          zone,
+			v1.LabelFailureDomainBetaZone: zone,
+			"app":                         "zone-a",
+		}
+		pv.Spec.NodeAffinity = affinity(zone, node)
+		return pv
+	}
+
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(newPV("zone-a", "node-1", "/data/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err := p.SetVolumeID(&unstructured.Unstructured{Object: content}, "/data/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := new(v1.PersistentVolume)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(updated.UnstructuredContent(), got); err != nil {
+		t.Fatal(err)
+	}
+
+	want := newPV("zone-b", "node-2", "/data/b")
+	// Values of unrelated keys are kept, even where they look like zones.
+	if !reflect.DeepEqual(got.Labels, want.Labels) {
+		t.Errorf("SetVolumeID() labels = %v, want %v", got.Labels, want.Labels)
+	}
+	if !reflect.DeepEqual(got.Spec.NodeAffinity, want.Spec.NodeAffinity) {
+		t.Errorf("SetVolumeID() node affinity = %v, want %v", got.Spec.NodeAffinity, want.Spec.NodeAffinity)
+	}
+}
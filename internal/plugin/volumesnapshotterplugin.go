@@ -18,7 +18,12 @@ package plugin
 
 import (
 	"math/rand"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -30,27 +35,130 @@ import (
 
 // Volume keeps track of volumes created by this plugin
 type Volume struct {
-	volType, az string
-	iops        int64
+	VolType string `json:"volType"`
+	AZ      string `json:"az"`
+	IOPS    int64  `json:"iops"`
+	// NotReadyPolls counts the times IsVolumeReady reported the volume as not
+	// ready because of fault injection.
+	NotReadyPolls int `json:"notReadyPolls,omitempty"`
 }
 
 // Snapshot keeps track of snapshots created by this plugin
 type Snapshot struct {
-	volID, az string
-	tags      map[string]string
+	VolID string            `json:"volID"`
+	AZ    string            `json:"az"`
+	Tags  map[string]string `json:"tags,omitempty"`
+	// Path is the directory holding the snapshot's copy of the volume data.
+	Path string `json:"path,omitempty"`
+	// Deduplicated is whether Path holds a deduplicated snapshot rather than a copy.
+	Deduplicated bool `json:"deduplicated,omitempty"`
+	// Manifest is the path of the content manifest of a copy snapshot. It is
+	// empty for chunked snapshots, which keep theirs in Path.
+	Manifest string `json:"manifest,omitempty"`
+	// Compression, Encryption and KeyID record how the data of a snapshot is
+	// encoded: the compression algorithm, the encryption algorithm, and the ID
+	// of the key in the keyring that the data keys are wrapped with.
+	Compression string    `json:"compression,omitempty"`
+	Encryption  string    `json:"encryption,omitempty"`
+	KeyID       string    `json:"keyID,omitempty"`
+	CreatedAt   time.Time `json:"createdAt,omitempty"`
+	// Export is the prefix of the keys the snapshot was exported under, if it was.
+	Export string `json:"export,omitempty"`
 }
 
-// NoOpVolumeSnapshotter is a plugin for containing state for the blockstore
+// chunked returns true if Path holds a chunked snapshot rather than a copy.
+// Snapshots are chunked if they are deduplicated, compressed or encrypted.
+func (s Snapshot) chunked() bool {
+	return s.Deduplicated || s.Compression != compressionNone || s.Encryption != ""
+}
+
+// encoding returns how the data of a chunked snapshot is encoded, with the
+// keys to decrypt it in kr.
+func (s Snapshot) encoding(kr *keyring) chunkEncoding {
+	return chunkEncoding{keyring: kr, keyID: s.KeyID, compression: s.Compression}
+}
+
+// chunkStore returns the directory of the chunk store a deduplicated snapshot
+// shares its chunks with.
+func (s Snapshot) chunkStore() string {
+	return filepath.Join(filepath.Dir(s.Path), chunkStoreName(s.Compression, s.KeyID))
+}
+
+// NoOpVolumeSnapshotter is a plugin for containing state for the blockstore.
+// Its catalog of volumes and snapshots is kept in a state file, so that it
+// survives restarts of the plugin process.
 type NoOpVolumeSnapshotter struct {
-	config map[string]string
 	logrus.FieldLogger
-	volumes   map[string]Volume
-	snapshots map[string]Snapshot
+
+	// lock guards settings. stateLock serializes the changes this
+	// process makes to the catalog.
+	lock      sync.Mutex
+	stateLock sync.Mutex
+
+	// settings are those of the config of the last Init call. Read them with
+	// current.
+	settings *snapshotterSettings
+}
+
+// snapshotterSettings are the settings of a NoOpVolumeSnapshotter. Init
+// replaces them as a whole, and they are never changed afterwards, so that
+// every call works with the settings that were current when it began, even
+// if Init is called for another config meanwhile.
+type snapshotterSettings struct {
+	config    map[string]string
+	stateFile string
+
+	// snapshotDir holds the copies of volume data taken by CreateSnapshot, and
+	// volumeDir the volumes created from them by CreateVolumeFromSnapshot.
+	snapshotDir string
+	volumeDir   string
+	deduplicate bool
+
+	// keyring holds the keys snapshots are encrypted with, or is nil if
+	// encryption is not configured. compression is the algorithm snapshots
+	// are compressed with, or compressionNone.
+	keyring     *keyring
+	compression string
+
+	// volumeSources are the types of PV sources the snapshotter claims, and
+	// nfsMountDir and csiMountDir where the data of NFS and CSI volumes is found.
+	volumeSources []string
+	nfsMountDir   string
+	csiMountDir   string
+
+	// zoneMapping and nodeMapping map the zones and node names of the cluster
+	// snapshots are taken in to those of the cluster they are restored into.
+	zoneMapping map[string]string
+	nodeMapping map[string]string
+
+	faults *faultInjector
+
+	// exporter exports snapshots to an object store, or is nil if they are not exported.
+	exporter *snapshotExporter
+
+	retention *retentionPolicy
 }
 
 // NewNoOpVolumeSnapshotter instantiates a NoOpVolumeSnapshotter.
 func NewNoOpVolumeSnapshotter(log logrus.FieldLogger) *NoOpVolumeSnapshotter {
-	return &NoOpVolumeSnapshotter{FieldLogger: log}
+	return &NoOpVolumeSnapshotter{
+		FieldLogger: log,
+		settings: &snapshotterSettings{
+			stateFile:     defaultStateFile,
+			snapshotDir:   defaultSnapshotDir,
+			volumeDir:     defaultVolumeDir,
+			volumeSources: []string{volumeSourceHostPath},
+			faults:        &faultInjector{},
+			retention:     &retentionPolicy{},
+		},
+	}
+}
+
+// current returns the settings of the snapshotter.
+func (p *NoOpVolumeSnapshotter) current() *snapshotterSettings {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.settings
 }
 
 var _ vsv1.VolumeSnapshotter = (*NoOpVolumeSnapshotter)(nil)
@@ -60,38 +168,173 @@ var _ vsv1.VolumeSnapshotter = (*NoOpVolumeSnapshotter)(nil)
 // cannot be initialized from the provided config. Note that after v0.10.0, this will happen multiple times.
 func (p *NoOpVolumeSnapshotter) Init(config map[string]string) error {
 	p.Infof("Init called", config)
-	p.config = config
 
-	// Make sure we don't overwrite data, now that we can re-initialize the plugin
-	if p.volumes == nil {
-		p.volumes = make(map[string]Volume)
+	stateFile := config[stateFileConfigKey]
+	if stateFile == "" {
+		stateFile = defaultStateFile
 	}
-	if p.snapshots == nil {
-		p.snapshots = make(map[string]Snapshot)
+	if !filepath.IsAbs(stateFile) {
+		return errors.Errorf("%s must be an absolute path, got %q", stateFileConfigKey, stateFile)
 	}
 
-	return nil
+	snapshotDir, err := parseDirConfig(config, snapshotDirConfigKey, defaultSnapshotDir)
+	if err != nil {
+		return err
+	}
+	volumeDir, err := parseDirConfig(config, volumeDirConfigKey, defaultVolumeDir)
+	if err != nil {
+		return err
+	}
+	sources, err := parseVolumeSources(config[volumeSourcesConfigKey])
+	if err != nil {
+		return err
+	}
+	nfsMountDir, err := parseDirConfig(config, nfsMountDirConfigKey, "")
+	if err != nil {
+		return err
+	}
+	csiMountDir, err := parseDirConfig(config, csiMountDirConfigKey, "")
+	if err != nil {
+		return err
+	}
+	zoneMapping, err := parseMapping(config, zoneMappingConfigKey)
+	if err != nil {
+		return err
+	}
+	nodeMapping, err := parseMapping(config, nodeMappingConfigKey)
+	if err != nil {
+		return err
+	}
+	faults, err := parseFaultInjector(config)
+	if err != nil {
+		return err
+	}
+	var kr *keyring
+	if keyFile := config[encryptionKeyFileConfigKey]; keyFile != "" {
+		if kr, err = loadKeyring(keyFile); err != nil {
+			return err
+		}
+	}
+	compression := config[compressionConfigKey]
+	if err := validateCompression(compression); err != nil {
+		return err
+	}
+	exporter, err := newSnapshotExporter(p, config)
+	if err != nil {
+		return err
+	}
+	retention, err := parseRetentionPolicy(p, config)
+	if err != nil {
+		return err
+	}
+
+	settings := &snapshotterSettings{
+		config:        config,
+		stateFile:     filepath.Clean(stateFile),
+		snapshotDir:   snapshotDir,
+		volumeDir:     volumeDir,
+		deduplicate:   config[deduplicateConfigKey] == "true",
+		keyring:       kr,
+		compression:   compression,
+		volumeSources: sources,
+		nfsMountDir:   nfsMountDir,
+		csiMountDir:   csiMountDir,
+		zoneMapping:   zoneMapping,
+		nodeMapping:   nodeMapping,
+		faults:        faults,
+		exporter:      exporter,
+		retention:     retention,
+	}
+	p.lock.Lock()
+	p.settings = settings
+	p.lock.Unlock()
+
+	cleanUpSnapshotDirOnce(p, snapshotDir)
+
+	// Fail early if the state file is unreadable, rather than on first use.
+	return p.withState(settings, func(state *snapshotterState) error {
+		p.Infof("Loaded %d volumes and %d snapshots from %s", len(state.Volumes), len(state.Snapshots), settings.stateFile)
+		return nil
+	})
 }
 
 // CreateVolumeFromSnapshot creates a new volume in the specified
 // availability zone, initialized from the provided snapshot,
 // and with the specified type and IOPS (if using provisioned IOPS).
 func (p *NoOpVolumeSnapshotter) CreateVolumeFromSnapshot(snapshotID, volumeType, volumeAZ string, iops *int64) (string, error) {
-	p.Infof("CreateVolumeFromSnapshot called", snapshotID, volumeType, volumeAZ, *iops)
-	var volumeID string
-	for {
-		volumeID := snapshotID + ".vol." + strconv.FormatUint(rand.Uint64(), 10)
-		if _, ok := p.volumes[volumeID]; ok {
-			// Duplicate ? Retry
-			continue
+	p.Infof("CreateVolumeFromSnapshot called", snapshotID, volumeType, volumeAZ, iops)
+	settings := p.current()
+	settings.faults.delay(p, operationCreateVolumeFromSnapshot)
+
+	var snapshot Snapshot
+	var found bool
+	err := p.withState(settings, func(state *snapshotterState) error {
+		snapshot, found = state.Snapshots[snapshotID]
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// Snapshots taken in another cluster are found in the object store they
+	// were exported to.
+	var exportDir string
+	var exported *exportedSnapshot
+	if !found && settings.exporter != nil {
+		if exportDir, exported, err = settings.exporter.find(snapshotID); err != nil {
+			return "", errors.Wrapf(err, "error looking for exported snapshot %s", snapshotID)
+		}
+		if found = exported != nil; found {
+			snapshot = Snapshot{VolID: exported.VolID, AZ: exported.AZ, Tags: exported.Tags, CreatedAt: exported.CreatedAt}
 		}
-		break
+	}
+	if !found {
+		return "", errors.New("Snapshot " + snapshotID + " not found")
+	}
+
+	if err := settings.faults.fail(p, operationCreateVolumeFromSnapshot, snapshot.VolID, snapshot.Tags); err != nil {
+		return "", err
+	}
+	zone, err := settings.restoreZone(snapshot.AZ, volumeAZ)
+	if err != nil {
+		return "", errors.Wrapf(err, "error creating volume from snapshot %s", snapshotID)
+	}
+
+	// The new volume is a copy of the snapshot, so that the snapshot stays
+	// intact and can be restored again.
+	volumeID, path, err := settings.newVolume(snapshot.VolID)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case exported != nil:
+		p.Infof("Fetching exported snapshot %s to %s", exportDir, path)
+		err = settings.exporter.fetch(p, exportDir, exported, path)
+	case snapshot.chunked():
+		p.Infof("Copying snapshot %s to %s", snapshot.Path, path)
+		err = restoreChunkedSnapshot(p, snapshot.Path, path, snapshot.encoding(settings.keyring))
+	default:
+		p.Infof("Copying snapshot %s to %s", snapshot.Path, path)
+		err = copyTree(p, snapshot.Path, path, func(string) bool { return false })
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "error creating volume from snapshot %s", snapshotID)
 	}
 
-	p.volumes[volumeID] = Volume{
-		volType: volumeType,
-		az:      volumeAZ,
-		iops:    *iops,
+	err = p.withState(settings, func(state *snapshotterState) error {
+		volume := Volume{
+			VolType: volumeType,
+			AZ:      zone,
+		}
+		if iops != nil {
+			volume.IOPS = *iops
+		}
+		state.Volumes[volumeID] = volume
+		return nil
+	})
+	if err != nil {
+		os.RemoveAll(path)
+		return "", err
 	}
 	return volumeID, nil
 }
@@ -100,48 +343,172 @@ func (p *NoOpVolumeSnapshotter) CreateVolumeFromSnapshot(snapshotID, volumeType,
 // the specified volume in the given availability zone.
 func (p *NoOpVolumeSnapshotter) GetVolumeInfo(volumeID, volumeAZ string) (string, *int64, error) {
 	p.Infof("GetVolumeInfo called", volumeID, volumeAZ)
-	if val, ok := p.volumes[volumeID]; ok {
-		iops := val.iops
-		return val.volType, &iops, nil
+
+	var volume Volume
+	err := p.withState(p.current(), func(state *snapshotterState) error {
+		val, ok := state.Volumes[volumeID]
+		if !ok {
+			return errors.New("Volume " + volumeID + " not found")
+		}
+		volume = val
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
 	}
-	return "", nil, errors.New("Volume " + volumeID + " not found")
+
+	iops := volume.IOPS
+	return volume.VolType, &iops, nil
 }
 
 // IsVolumeReady Check if the volume is ready.
 func (p *NoOpVolumeSnapshotter) IsVolumeReady(volumeID, volumeAZ string) (ready bool, err error) {
 	p.Infof("IsVolumeReady called", volumeID, volumeAZ)
-	return true, nil
+	settings := p.current()
+	faults := settings.faults
+	faults.delay(p, operationIsVolumeReady)
+	if err := faults.fail(p, operationIsVolumeReady, volumeID, nil); err != nil {
+		return false, err
+	}
+	if faults.notReadyPolls == 0 {
+		return true, nil
+	}
+
+	// The polls are counted in the catalog, as Velero can poll from more
+	// than one plugin process.
+	ready = true
+	err = p.withState(settings, func(state *snapshotterState) error {
+		volume, ok := state.Volumes[volumeID]
+		if !ok || volume.NotReadyPolls >= faults.notReadyPolls {
+			return nil
+		}
+		volume.NotReadyPolls++
+		state.Volumes[volumeID] = volume
+		ready = false
+		p.Infof("Reporting volume %s as not ready, %d of %d times", volumeID, volume.NotReadyPolls, faults.notReadyPolls)
+		return nil
+	})
+	return ready, err
 }
 
 // CreateSnapshot creates a snapshot of the specified volume, and applies any provided
 // set of tags to the snapshot.
 func (p *NoOpVolumeSnapshotter) CreateSnapshot(volumeID, volumeAZ string, tags map[string]string) (string, error) {
 	p.Infof("CreateSnapshot called", volumeID, volumeAZ, tags)
+	settings := p.current()
+	settings.faults.delay(p, operationCreateSnapshot)
+	tags, err := p.claimTags(settings, volumeID, tags)
+	if err != nil {
+		return "", err
+	}
+	if err := settings.faults.fail(p, operationCreateSnapshot, volumeID, tags); err != nil {
+		return "", err
+	}
+
+	// The volume's data must be mounted into the Velero pod, hostPath and
+	// local volumes at their own path. It is copied before the snapshot is
+	// recorded, so that the catalog never refers to an incomplete copy.
+	dataPath, err := settings.volumeDataPath(volumeID)
+	if err != nil {
+		return "", err
+	}
+	src, err := filepath.EvalSymlinks(dataPath)
+	if err != nil {
+		return "", errors.Wrapf(err, "error reading volume %s, is it mounted into the Velero pod at %s?", volumeID, dataPath)
+	}
+	path, err := newDataDir(settings.snapshotDir, "snap-")
+	if err != nil {
+		return "", err
+	}
+	skip := func(dir string) bool {
+		// A volume can contain the snapshotter's own directories, as with a
+		// hostPath of /tmp; copying them would copy the snapshot into itself.
+		return isWithin(settings.snapshotDir, dir) || isWithin(settings.volumeDir, dir)
+	}
+	snapshot := Snapshot{
+		VolID:        volumeID,
+		AZ:           volumeAZ,
+		Tags:         tags,
+		Path:         path,
+		Deduplicated: settings.deduplicate,
+		Compression:  settings.compression,
+	}
+	if settings.keyring != nil {
+		snapshot.Encryption = encryptionAlgorithm
+		snapshot.KeyID = settings.keyring.activeID
+	}
+	encoding := snapshot.encoding(settings.keyring)
+
+	switch {
+	case snapshot.Deduplicated:
+		var prev string
+		if prev, err = p.latestDedupSnapshot(settings, snapshot); err != nil {
+			return "", err
+		}
+		p.Infof("Taking deduplicated snapshot of volume %s to %s", src, path)
+		err = createChunkedSnapshot(p, src, path, snapshot.chunkStore(), prev, encoding, skip)
+	case snapshot.chunked():
+		p.Infof("Taking chunked snapshot of volume %s to %s", src, path)
+		err = createChunkedSnapshot(p, src, path, "", "", encoding, skip)
+	default:
+		p.Infof("Copying volume %s to %s", src, path)
+		if err = copyTree(p, src, path, skip); err == nil {
+			if snapshot.Manifest, err = writeContentManifest(p, path); err != nil {
+				os.RemoveAll(path)
+			}
+		}
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "error snapshotting volume %s", volumeID)
+	}
+
 	var snapshotID string
-	for {
-		snapshotID = volumeID + ".snap." + strconv.FormatUint(rand.Uint64(), 10)
-		p.Infof("CreateSnapshot trying to create snapshot", snapshotID)
-		if _, ok := p.snapshots[snapshotID]; ok {
-			// Duplicate ? Retry
-			continue
+	err = p.withState(settings, func(state *snapshotterState) error {
+		for {
+			snapshotID = volumeID + ".snap." + strconv.FormatUint(rand.Uint64(), 10)
+			p.Infof("CreateSnapshot trying to create snapshot", snapshotID)
+			if _, ok := state.Snapshots[snapshotID]; ok {
+				// Duplicate ? Retry
+				continue
+			}
+			break
+		}
+
+		// Remember the "original" volume, only required for the first
+		// time.
+		if _, exists := state.Volumes[volumeID]; !exists {
+			state.Volumes[volumeID] = Volume{
+				VolType: "orignalVolumeType",
+				AZ:      volumeAZ,
+				IOPS:    100,
+			}
 		}
-		break
+
+		// Remember the snapshot
+		snapshot.CreatedAt = time.Now().UTC()
+		state.Snapshots[snapshotID] = snapshot
+		return nil
+	})
+	if err != nil {
+		p.removeSnapshotData(snapshotID, snapshot)
+		return "", err
 	}
 
-	// Remember the "original" volume, only required for the first
-	// time.
-	if _, exists := p.volumes[volumeID]; !exists {
-		p.volumes[volumeID] = Volume{
-			volType: "orignalVolumeType",
-			az:      volumeAZ,
-			iops:    100,
+	if settings.exporter != nil {
+		if err := p.exportSnapshot(settings, snapshotID, snapshot); err != nil {
+			return "", errors.Wrapf(err, "error exporting snapshot of volume %s", volumeID)
 		}
 	}
 
-	// Remember the snapshot
-	p.snapshots[snapshotID] = Snapshot{volID: volumeID,
-		az:   volumeAZ,
-		tags: tags}
+	// Only orphaned snapshots are deleted automatically; the count and age
+	// rules would delete snapshots that backups still reference, so they are
+	// left to PruneSnapshots. Failing to delete orphans does not fail the
+	// new snapshot.
+	if orphans := settings.retention.orphans(); orphans != nil {
+		if _, err := p.pruneSnapshots(settings, orphans, false); err != nil {
+			p.WithError(err).Error("Error deleting orphaned snapshots")
+		}
+	}
 
 	p.Infof("CreateSnapshot returning", snapshotID)
 	return snapshotID, nil
@@ -150,10 +517,122 @@ func (p *NoOpVolumeSnapshotter) CreateSnapshot(volumeID, volumeAZ string, tags m
 // DeleteSnapshot deletes the specified volume snapshot.
 func (p *NoOpVolumeSnapshotter) DeleteSnapshot(snapshotID string) error {
 	p.Infof("DeleteSnapshot called", snapshotID)
-	delete(p.snapshots, snapshotID)
+	return p.deleteSnapshot(p.current(), snapshotID)
+}
+
+func (p *NoOpVolumeSnapshotter) deleteSnapshot(settings *snapshotterSettings, snapshotID string) error {
+	settings.faults.delay(p, operationDeleteSnapshot)
+
+	// The snapshot is removed from the catalog first, so that it cannot be
+	// restored from while its data is being removed.
+	var snapshot Snapshot
+	var found bool
+	err := p.withState(settings, func(state *snapshotterState) error {
+		snapshot, found = state.Snapshots[snapshotID]
+		if err := settings.faults.fail(p, operationDeleteSnapshot, snapshot.VolID, snapshot.Tags); err != nil {
+			return err
+		}
+		delete(state.Snapshots, snapshotID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Deleting a backup in another cluster that the snapshot was exported to
+	// deletes the exported copy.
+	if !found && settings.exporter != nil {
+		dir, exported, err := settings.exporter.find(snapshotID)
+		if err != nil || exported == nil {
+			return err
+		}
+		snapshot.Export = dir
+	}
+	if snapshot.Export != "" {
+		if settings.exporter == nil {
+			p.Warnf("Snapshot %s was exported to %s, which is kept as %s is not set", snapshotID, snapshot.Export, exportBucketConfigKey)
+		} else if err := settings.exporter.remove(snapshot.Export); err != nil {
+			return errors.Wrapf(err, "error removing exported snapshot %s", snapshot.Export)
+		}
+	}
+
+	return p.removeSnapshotData(snapshotID, snapshot)
+}
+
+// removeSnapshotData removes the data of snapshot, which has been removed
+// from the catalog.
+func (p *NoOpVolumeSnapshotter) removeSnapshotData(snapshotID string, snapshot Snapshot) error {
+	if snapshot.Manifest != "" {
+		if err := os.Remove(snapshot.Manifest); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "error removing content manifest of snapshot %s", snapshotID)
+		}
+	}
+	if !snapshot.Deduplicated {
+		return errors.Wrapf(os.RemoveAll(snapshot.Path), "error removing data of snapshot %s", snapshotID)
+	}
+
+	chunks, err := deleteDedupSnapshot(snapshot.Path, snapshot.chunkStore())
+	if err != nil {
+		return errors.Wrapf(err, "error removing data of snapshot %s", snapshotID)
+	}
+	p.Infof("Removed %d chunks no longer used by any snapshot", chunks)
 	return nil
 }
 
+// exportSnapshot exports the snapshot just recorded as snapshotID, and records
+// where it was exported to. If that fails, the snapshot is removed again, so
+// that no backup refers to a snapshot that cannot be restored elsewhere.
+func (p *NoOpVolumeSnapshotter) exportSnapshot(settings *snapshotterSettings, snapshotID string, snapshot Snapshot) error {
+	dir, err := settings.exporter.export(p, snapshotID, snapshot, settings.keyring)
+	if err == nil {
+		err = p.withState(settings, func(state *snapshotterState) error {
+			recorded, ok := state.Snapshots[snapshotID]
+			if !ok {
+				return errors.Errorf("snapshot %s was deleted while it was exported", snapshotID)
+			}
+			recorded.Export = dir
+			state.Snapshots[snapshotID] = recorded
+			return nil
+		})
+	}
+	if err == nil {
+		return nil
+	}
+
+	if dir != "" {
+		if err := settings.exporter.remove(dir); err != nil {
+			p.WithError(err).Warnf("Error removing partially exported snapshot %s", dir)
+		}
+	}
+	removeErr := p.withState(settings, func(state *snapshotterState) error {
+		delete(state.Snapshots, snapshotID)
+		return nil
+	})
+	if removeErr == nil {
+		removeErr = p.removeSnapshotData(snapshotID, snapshot)
+	}
+	if removeErr != nil {
+		p.WithError(removeErr).Warnf("Error removing snapshot %s after failing to export it", snapshotID)
+	}
+	return err
+}
+
+// latestDedupSnapshot returns the path of the most recent deduplicated
+// snapshot of the volume of next that shares its chunk store, or "" if there
+// is none.
+func (p *NoOpVolumeSnapshotter) latestDedupSnapshot(settings *snapshotterSettings, next Snapshot) (string, error) {
+	var latest Snapshot
+	err := p.withState(settings, func(state *snapshotterState) error {
+		for _, snapshot := range state.Snapshots {
+			if snapshot.VolID == next.VolID && snapshot.Deduplicated && snapshot.chunkStore() == next.chunkStore() && snapshot.CreatedAt.After(latest.CreatedAt) {
+				latest = snapshot
+			}
+		}
+		return nil
+	})
+	return latest.Path, err
+}
+
 // GetVolumeID returns the specific identifier for the PersistentVolume.
 func (p *NoOpVolumeSnapshotter) GetVolumeID(unstructuredPV runtime.Unstructured) (string, error) {
 	p.Infof("GetVolumeID called", unstructuredPV)
@@ -163,15 +642,23 @@ func (p *NoOpVolumeSnapshotter) GetVolumeID(unstructuredPV runtime.Unstructured)
 		return "", errors.WithStack(err)
 	}
 
-	if pv.Spec.HostPath == nil {
-		return "", nil
-	}
-
-	if pv.Spec.HostPath.Path == "" {
-		return "", errors.New("spec.hostPath.path not found")
+	// PVs with sources the snapshotter does not claim get no volume ID, so
+	// that Velero does not snapshot them with this plugin.
+	settings := p.current()
+	for _, source := range settings.volumeSources {
+		volumeID, err := volumeSources[source].getID(&pv.Spec)
+		if err != nil {
+			return "", err
+		}
+		if volumeID == "" {
+			continue
+		}
+		if err := p.rememberClaim(settings, volumeID, pv); err != nil {
+			return "", err
+		}
+		return volumeID, nil
 	}
-
-	return pv.Spec.HostPath.Path, nil
+	return "", nil
 }
 
 // SetVolumeID sets the specific identifier for the PersistentVolume.
@@ -183,11 +670,21 @@ func (p *NoOpVolumeSnapshotter) SetVolumeID(unstructuredPV runtime.Unstructured,
 		return nil, errors.WithStack(err)
 	}
 
-	if pv.Spec.HostPath == nil {
-		return nil, errors.New("spec.hostPath.path not found")
+	settings := p.current()
+	found := false
+	for _, source := range settings.volumeSources {
+		set, err := volumeSources[source].setID(&pv.Spec, volumeID)
+		if err != nil {
+			return nil, err
+		}
+		if found = set; found {
+			break
+		}
 	}
-
-	pv.Spec.HostPath.Path = volumeID
+	if !found {
+		return nil, errors.Errorf("PV has none of the volume sources %s", strings.Join(settings.volumeSources, ", "))
+	}
+	settings.rewriteTopology(p, pv)
 
 	res, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
 	if err != nil {
@@ -0,0 +1,195 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// newTestVolume returns the ID of a hostPath volume holding a file.
+func newTestVolume(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "data"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// newTestSnapshotterConfig returns a config with the state file and data
+// directories of the snapshotter in dir.
+func newTestSnapshotterConfig(dir string) map[string]string {
+	return map[string]string{
+		stateFileConfigKey:   filepath.Join(dir, "state.json"),
+		snapshotDirConfigKey: filepath.Join(dir, "snapshots"),
+		volumeDirConfigKey:   filepath.Join(dir, "volumes"),
+	}
+}
+
+func newTestSnapshotter(t *testing.T) *NoOpVolumeSnapshotter {
+	t.Helper()
+
+	log := logrus.New()
+	log.SetOutput(testLogWriter{t})
+	return NewNoOpVolumeSnapshotter(log)
+}
+
+func TestWithStateWritesOnlyChanges(t *testing.T) {
+	config := newTestSnapshotterConfig(t.TempDir())
+	p := newTestSnapshotter(t)
+	if err := p.Init(config); err != nil {
+		t.Fatal(err)
+	}
+
+	volumeID := newTestVolume(t)
+	snapshotID, err := p.CreateSnapshot(volumeID, "zone-a", map[string]string{"velero.io/backup": "backup-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateFile := config[stateFileConfigKey]
+	written, err := os.Stat(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The state file is replaced whenever it is written, so an unchanged
+	// file shows it was not.
+	reads := map[string]func() error{
+		"Init": func() error { return p.Init(config) },
+		"GetVolumeInfo": func() error {
+			_, _, err := p.GetVolumeInfo(volumeID, "zone-a")
+			return err
+		},
+		"IsVolumeReady": func() error {
+			_, err := p.IsVolumeReady(volumeID, "zone-a")
+			return err
+		},
+		"ListSnapshots": func() error {
+			_, err := p.ListSnapshots("")
+			return err
+		},
+		"VerifySnapshots": func() error {
+			_, err := p.VerifySnapshots("")
+			return err
+		},
+		"PruneSnapshots": func() error {
+			_, err := p.PruneSnapshots(true)
+			return err
+		},
+		"DeleteSnapshot of a missing snapshot": func() error { return p.DeleteSnapshot("missing") },
+	}
+	for name, read := range reads {
+		if err := read(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		info, err := os.Stat(stateFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(written, info) {
+			t.Errorf("%s rewrote the state file", name)
+		}
+	}
+
+	if err := p.DeleteSnapshot(snapshotID); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(written, info) {
+		t.Errorf("DeleteSnapshot did not write the state file")
+	}
+}
+
+// TestSettingsAreConsistentWithinCalls checks that each call works with the
+// settings of a single Init call, even when Init switches between configs
+// concurrently: every snapshot must be recorded in the state file of the
+// config whose snapshot directory holds its data.
+func TestSettingsAreConsistentWithinCalls(t *testing.T) {
+	configs := []map[string]string{
+		newTestSnapshotterConfig(t.TempDir()),
+		newTestSnapshotterConfig(t.TempDir()),
+	}
+	p := newTestSnapshotter(t)
+	if err := p.Init(configs[0]); err != nil {
+		t.Fatal(err)
+	}
+	volumeID := newTestVolume(t)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			if err := p.Init(configs[i%2]); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				snapshotID, err := p.CreateSnapshot(volumeID, "zone-a", map[string]string{"velero.io/backup": fmt.Sprintf("backup-%d-%d", i, j)})
+				if err != nil {
+					errs <- err
+					return
+				}
+				if j%2 == 0 {
+					// The snapshot may be in the catalog of the other config
+					// by now, in which case it is not found and kept.
+					if err := p.DeleteSnapshot(snapshotID); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for _, config := range configs {
+		state, err := loadSnapshotterState(config[stateFileConfigKey])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for id, snapshot := range state.Snapshots {
+			if !isWithin(config[snapshotDirConfigKey], snapshot.Path) {
+				t.Errorf("snapshot %s in %s has its data in %s, outside of %s", id, config[stateFileConfigKey], snapshot.Path, config[snapshotDirConfigKey])
+			}
+			if _, err := os.Stat(snapshot.Path); err != nil {
+				t.Errorf("data of snapshot %s is missing: %v", id, err)
+			}
+		}
+	}
+}
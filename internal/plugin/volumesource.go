@@ -0,0 +1,286 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// volumeSourcesConfigKey is the VSL config key for the comma-separated
+	// types of PV sources the snapshotter claims. PVs of other types are left
+	// to other snapshotters.
+	volumeSourcesConfigKey = "volumeSources"
+	// nfsMountDirConfigKey is the VSL config key for the directory NFS servers
+	// are mounted in, each at <nfsMountDir>/<server>.
+	nfsMountDirConfigKey = "nfsMountDir"
+	// csiMountDirConfigKey is the VSL config key for the directory the data of
+	// CSI volumes is found in, each at <csiMountDir>/<volumeHandle>.
+	csiMountDirConfigKey = "csiMountDir"
+)
+
+// Types of PV sources.
+const (
+	volumeSourceHostPath = "hostPath"
+	volumeSourceLocal    = "local"
+	volumeSourceNFS      = "nfs"
+	volumeSourceCSI      = "csi"
+)
+
+// The IDs of hostPath and local volumes are their paths, and those of NFS and
+// CSI volumes are nfs://<server><path> and csi://<driver>/<volumeHandle>, so
+// that the type of a volume can be told from its ID.
+const (
+	nfsVolumeIDPrefix = "nfs://"
+	csiVolumeIDPrefix = "csi://"
+)
+
+// volumeSource gets and sets the volume ID of PVs with one type of source.
+type volumeSource struct {
+	// getID returns the volume ID of the PV, or "" if it has no source of this type.
+	getID func(spec *v1.PersistentVolumeSpec) (string, error)
+	// setID points the PV at the volume with the given ID, or returns false
+	// if it has no source of this type.
+	setID func(spec *v1.PersistentVolumeSpec, volumeID string) (bool, error)
+}
+
+var volumeSources = map[string]volumeSource{
+	volumeSourceHostPath: {getID: getHostPathVolumeID, setID: setHostPathVolumeID},
+	volumeSourceLocal:    {getID: getLocalVolumeID, setID: setLocalVolumeID},
+	volumeSourceNFS:      {getID: getNFSVolumeID, setID: setNFSVolumeID},
+	volumeSourceCSI:      {getID: getCSIVolumeID, setID: setCSIVolumeID},
+}
+
+// parseVolumeSources returns the source types listed in value, hostPath if it is empty.
+func parseVolumeSources(value string) ([]string, error) {
+	if value == "" {
+		return []string{volumeSourceHostPath}, nil
+	}
+
+	var sources []string
+	for _, source := range strings.Split(value, ",") {
+		source = strings.TrimSpace(source)
+		if _, ok := volumeSources[source]; !ok {
+			valid := make([]string, 0, len(volumeSources))
+			for name := range volumeSources {
+				valid = append(valid, name)
+			}
+			sort.Strings(valid)
+			return nil, errors.Errorf("unsupported %s %q, must be one of %s", volumeSourcesConfigKey, source, strings.Join(valid, ", "))
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+func getHostPathVolumeID(spec *v1.PersistentVolumeSpec) (string, error) {
+	if spec.HostPath == nil {
+		return "", nil
+	}
+	if spec.HostPath.Path == "" {
+		return "", errors.New("spec.hostPath.path not found")
+	}
+	return spec.HostPath.Path, nil
+}
+
+func setHostPathVolumeID(spec *v1.PersistentVolumeSpec, volumeID string) (bool, error) {
+	if spec.HostPath == nil {
+		return false, nil
+	}
+	if isTypedVolumeID(volumeID) {
+		return true, errors.Errorf("volume %s cannot back a hostPath PV", volumeID)
+	}
+	spec.HostPath.Path = volumeID
+	return true, nil
+}
+
+func getLocalVolumeID(spec *v1.PersistentVolumeSpec) (string, error) {
+	if spec.Local == nil {
+		return "", nil
+	}
+	if spec.Local.Path == "" {
+		return "", errors.New("spec.local.path not found")
+	}
+	return spec.Local.Path, nil
+}
+
+func setLocalVolumeID(spec *v1.PersistentVolumeSpec, volumeID string) (bool, error) {
+	if spec.Local == nil {
+		return false, nil
+	}
+	if isTypedVolumeID(volumeID) || !filepath.IsAbs(volumeID) {
+		return true, errors.Errorf("volume %s cannot back a local PV", volumeID)
+	}
+	spec.Local.Path = volumeID
+	return true, nil
+}
+
+func getNFSVolumeID(spec *v1.PersistentVolumeSpec) (string, error) {
+	if spec.NFS == nil {
+		return "", nil
+	}
+	if spec.NFS.Server == "" || spec.NFS.Path == "" {
+		return "", errors.New("spec.nfs.server or spec.nfs.path not found")
+	}
+	return nfsVolumeID(spec.NFS.Server, spec.NFS.Path), nil
+}
+
+func setNFSVolumeID(spec *v1.PersistentVolumeSpec, volumeID string) (bool, error) {
+	if spec.NFS == nil {
+		return false, nil
+	}
+	server, exportPath, err := parseNFSVolumeID(volumeID)
+	if err != nil {
+		return true, err
+	}
+	spec.NFS.Server = server
+	spec.NFS.Path = exportPath
+	return true, nil
+}
+
+func getCSIVolumeID(spec *v1.PersistentVolumeSpec) (string, error) {
+	if spec.CSI == nil {
+		return "", nil
+	}
+	if spec.CSI.Driver == "" || spec.CSI.VolumeHandle == "" {
+		return "", errors.New("spec.csi.driver or spec.csi.volumeHandle not found")
+	}
+	return csiVolumeIDPrefix + spec.CSI.Driver + "/" + spec.CSI.VolumeHandle, nil
+}
+
+func setCSIVolumeID(spec *v1.PersistentVolumeSpec, volumeID string) (bool, error) {
+	if spec.CSI == nil {
+		return false, nil
+	}
+	driver, handle, err := parseCSIVolumeID(volumeID)
+	if err != nil {
+		return true, err
+	}
+	if driver != spec.CSI.Driver {
+		return true, errors.Errorf("volume %s belongs to CSI driver %s, but the PV uses %s", volumeID, driver, spec.CSI.Driver)
+	}
+	spec.CSI.VolumeHandle = handle
+	return true, nil
+}
+
+func isTypedVolumeID(volumeID string) bool {
+	return strings.HasPrefix(volumeID, nfsVolumeIDPrefix) || strings.HasPrefix(volumeID, csiVolumeIDPrefix)
+}
+
+func nfsVolumeID(server, exportPath string) string {
+	return nfsVolumeIDPrefix + server + path.Clean("/"+exportPath)
+}
+
+func parseNFSVolumeID(volumeID string) (string, string, error) {
+	rest := strings.TrimPrefix(volumeID, nfsVolumeIDPrefix)
+	i := strings.Index(rest, "/")
+	if rest == volumeID || i <= 0 {
+		return "", "", errors.Errorf("volume %s is not an NFS volume", volumeID)
+	}
+	return rest[:i], rest[i:], nil
+}
+
+func parseCSIVolumeID(volumeID string) (string, string, error) {
+	rest := strings.TrimPrefix(volumeID, csiVolumeIDPrefix)
+	i := strings.Index(rest, "/")
+	if rest == volumeID || i <= 0 || i == len(rest)-1 {
+		return "", "", errors.Errorf("volume %s is not a CSI volume", volumeID)
+	}
+	return rest[:i], rest[i+1:], nil
+}
+
+// volumeDataPath returns the path the data of volumeID is found at in the Velero pod.
+func (s *snapshotterSettings) volumeDataPath(volumeID string) (string, error) {
+	switch {
+	case strings.HasPrefix(volumeID, nfsVolumeIDPrefix):
+		server, exportPath, err := parseNFSVolumeID(volumeID)
+		if err != nil {
+			return "", err
+		}
+		return mountedPath(s.nfsMountDir, nfsMountDirConfigKey, volumeID, server, exportPath)
+
+	case strings.HasPrefix(volumeID, csiVolumeIDPrefix):
+		_, handle, err := parseCSIVolumeID(volumeID)
+		if err != nil {
+			return "", err
+		}
+		return mountedPath(s.csiMountDir, csiMountDirConfigKey, volumeID, handle)
+
+	case filepath.IsAbs(volumeID):
+		return volumeID, nil
+
+	default:
+		return "", errors.Errorf("volume %s has no data the snapshotter can access", volumeID)
+	}
+}
+
+// mountedPath joins elems to mountDir, which configKey configures, making sure
+// the result does not escape it.
+func mountedPath(mountDir, configKey, volumeID string, elems ...string) (string, error) {
+	if mountDir == "" {
+		return "", errors.Errorf("%s must be set to snapshot volume %s", configKey, volumeID)
+	}
+	dataPath := filepath.Join(append([]string{mountDir}, elems...)...)
+	if dataPath == mountDir || !isWithin(mountDir, dataPath) {
+		return "", errors.Errorf("volume %s resolves outside of %s", volumeID, configKey)
+	}
+	return dataPath, nil
+}
+
+// newVolume returns the ID and data path of a new volume of the same type as
+// sourceID, for a volume created from a snapshot of sourceID. New NFS volumes
+// are created next to the source volume on the same server, new CSI volumes in
+// csiMountDir, and others in volumeDir.
+func (s *snapshotterSettings) newVolume(sourceID string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(sourceID, nfsVolumeIDPrefix):
+		server, exportPath, err := parseNFSVolumeID(sourceID)
+		if err != nil {
+			return "", "", err
+		}
+		name, err := newDataDir("", "vol-")
+		if err != nil {
+			return "", "", err
+		}
+		volumeID := nfsVolumeID(server, path.Join(path.Dir(exportPath), name))
+		dataPath, err := s.volumeDataPath(volumeID)
+		return volumeID, dataPath, err
+
+	case strings.HasPrefix(sourceID, csiVolumeIDPrefix):
+		driver, _, err := parseCSIVolumeID(sourceID)
+		if err != nil {
+			return "", "", err
+		}
+		name, err := newDataDir("", "vol-")
+		if err != nil {
+			return "", "", err
+		}
+		volumeID := csiVolumeIDPrefix + driver + "/" + name
+		dataPath, err := s.volumeDataPath(volumeID)
+		return volumeID, dataPath, err
+
+	default:
+		dataPath, err := newDataDir(s.volumeDir, "vol-")
+		return dataPath, dataPath, err
+	}
+}
@@ -0,0 +1,205 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// toUnstructuredPV returns a PV with spec as Velero passes it to the plugin.
+func toUnstructuredPV(t *testing.T, spec v1.PersistentVolumeSpec) runtime.Unstructured {
+	t.Helper()
+
+	pv := &v1.PersistentVolume{Spec: spec}
+	pv.Name = "pv-1"
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &unstructured.Unstructured{Object: content}
+}
+
+// fromUnstructuredPV returns the spec of a PV the plugin returned.
+func fromUnstructuredPV(t *testing.T, pv runtime.Unstructured) v1.PersistentVolumeSpec {
+	t.Helper()
+
+	typed := new(v1.PersistentVolume)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(pv.UnstructuredContent(), typed); err != nil {
+		t.Fatal(err)
+	}
+	return typed.Spec
+}
+
+func pvSpec(source v1.PersistentVolumeSource) v1.PersistentVolumeSpec {
+	return v1.PersistentVolumeSpec{PersistentVolumeSource: source}
+}
+
+// TestVolumeSources checks the volume IDs of PVs of every source type, that
+// PVs of sources the snapshotter does not claim get none, and that volume
+// IDs are set back into PVs of the same type only.
+func TestVolumeSources(t *testing.T) {
+	tests := []struct {
+		name      string
+		sources   string
+		spec      v1.PersistentVolumeSpec
+		wantID    string
+		newID     string
+		wantSpec  v1.PersistentVolumeSpec
+		wantSetOK bool
+	}{
+		{
+			name:      "hostPath",
+			spec:      pvSpec(v1.PersistentVolumeSource{HostPath: &v1.HostPathVolumeSource{Path: "/data/a"}}),
+			wantID:    "/data/a",
+			newID:     "/data/b",
+			wantSpec:  pvSpec(v1.PersistentVolumeSource{HostPath: &v1.HostPathVolumeSource{Path: "/data/b"}}),
+			wantSetOK: true,
+		},
+		{
+			name:      "local",
+			sources:   "local",
+			spec:      pvSpec(v1.PersistentVolumeSource{Local: &v1.LocalVolumeSource{Path: "/mnt/disks/a"}}),
+			wantID:    "/mnt/disks/a",
+			newID:     "/mnt/disks/b",
+			wantSpec:  pvSpec(v1.PersistentVolumeSource{Local: &v1.LocalVolumeSource{Path: "/mnt/disks/b"}}),
+			wantSetOK: true,
+		},
+		{
+			name:      "nfs",
+			sources:   "hostPath,nfs",
+			spec:      pvSpec(v1.PersistentVolumeSource{NFS: &v1.NFSVolumeSource{Server: "nfs.example.com", Path: "/exports/a"}}),
+			wantID:    "nfs://nfs.example.com/exports/a",
+			newID:     "nfs://nfs.example.com/exports/b",
+			wantSpec:  pvSpec(v1.PersistentVolumeSource{NFS: &v1.NFSVolumeSource{Server: "nfs.example.com", Path: "/exports/b"}}),
+			wantSetOK: true,
+		},
+		{
+			name:      "csi",
+			sources:   "csi",
+			spec:      pvSpec(v1.PersistentVolumeSource{CSI: &v1.CSIPersistentVolumeSource{Driver: "hostpath.csi.k8s.io", VolumeHandle: "a"}}),
+			wantID:    "csi://hostpath.csi.k8s.io/a",
+			newID:     "csi://hostpath.csi.k8s.io/b",
+			wantSpec:  pvSpec(v1.PersistentVolumeSource{CSI: &v1.CSIPersistentVolumeSource{Driver: "hostpath.csi.k8s.io", VolumeHandle: "b"}}),
+			wantSetOK: true,
+		},
+		{
+			name:    "csi volume of another driver",
+			sources: "csi",
+			spec:    pvSpec(v1.PersistentVolumeSource{CSI: &v1.CSIPersistentVolumeSource{Driver: "hostpath.csi.k8s.io", VolumeHandle: "a"}}),
+			wantID:  "csi://hostpath.csi.k8s.io/a",
+			newID:   "csi://other.csi.k8s.io/b",
+		},
+		{
+			name:   "nfs volume into a hostPath PV",
+			spec:   pvSpec(v1.PersistentVolumeSource{HostPath: &v1.HostPathVolumeSource{Path: "/data/a"}}),
+			wantID: "/data/a",
+			newID:  "nfs://nfs.example.com/exports/b",
+		},
+		{
+			name: "source not claimed",
+			spec: pvSpec(v1.PersistentVolumeSource{NFS: &v1.NFSVolumeSource{Server: "nfs.example.com", Path: "/exports/a"}}),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := newTestSnapshotterConfig(t.TempDir())
+			config[volumeSourcesConfigKey] = test.sources
+			p := newTestSnapshotter(t)
+			if err := p.Init(config); err != nil {
+				t.Fatal(err)
+			}
+
+			volumeID, err := p.GetVolumeID(toUnstructuredPV(t, test.spec))
+			if err != nil || volumeID != test.wantID {
+				t.Errorf("GetVolumeID() = %q, %v, want %q", volumeID, err, test.wantID)
+			}
+			if test.newID == "" {
+				return
+			}
+
+			pv, err := p.SetVolumeID(toUnstructuredPV(t, test.spec), test.newID)
+			if !test.wantSetOK {
+				if err == nil {
+					t.Errorf("SetVolumeID(%s) succeeded, want an error", test.newID)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fromUnstructuredPV(t, pv); !equalSpecSources(got, test.wantSpec) {
+				t.Errorf("SetVolumeID(%s) returned %+v, want %+v", test.newID, got.PersistentVolumeSource, test.wantSpec.PersistentVolumeSource)
+			}
+		})
+	}
+}
+
+func equalSpecSources(a, b v1.PersistentVolumeSpec) bool {
+	return a.PersistentVolumeSource.String() == b.PersistentVolumeSource.String()
+}
+
+// TestNFSVolumeRoundTrip checks that NFS volumes are read through their
+// mount, that volumes created from their snapshots are next to them on the
+// same server, and that volume IDs cannot resolve outside of the mounts.
+func TestNFSVolumeRoundTrip(t *testing.T) {
+	mountDir := t.TempDir()
+	config := newTestSnapshotterConfig(t.TempDir())
+	config[volumeSourcesConfigKey] = "nfs"
+	config[nfsMountDirConfigKey] = mountDir
+	p := newTestSnapshotter(t)
+	if err := p.Init(config); err != nil {
+		t.Fatal(err)
+	}
+
+	exportDir := filepath.Join(mountDir, "nfs.example.com", "exports", "a")
+	if err := os.MkdirAll(exportDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(exportDir, "data"), []byte("nfs data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	snapshotID, err := p.CreateSnapshot("nfs://nfs.example.com/exports/a", "zone-a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	volumeID, err := p.CreateVolumeFromSnapshot(snapshotID, "", "zone-a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(volumeID, "nfs://nfs.example.com/exports/") {
+		t.Fatalf("CreateVolumeFromSnapshot() = %s, want a volume next to the source", volumeID)
+	}
+	restored := filepath.Join(mountDir, "nfs.example.com", filepath.FromSlash(strings.TrimPrefix(volumeID, "nfs://nfs.example.com/")))
+	if data, err := os.ReadFile(filepath.Join(restored, "data")); err != nil || string(data) != "nfs data" {
+		t.Errorf("restored volume holds %q, %v, want the snapshot data", data, err)
+	}
+
+	for _, volumeID := range []string{"nfs://../exports/a", "nfs://nfs.example.com/../../x"} {
+		if _, err := p.CreateSnapshot(volumeID, "zone-a", nil); err == nil {
+			t.Errorf("CreateSnapshot(%s) succeeded, want it rejected", volumeID)
+		}
+	}
+}
@@ -17,14 +17,28 @@ limitations under the License.
 package main
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/sirupsen/logrus"
 	"github.com/vmware-tanzu/velero-plugin-example/internal/plugin"
 	"github.com/vmware-tanzu/velero/pkg/plugin/framework"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	framework.NewServer().
 		RegisterObjectStore("example.io/object-store-plugin", newObjectStorePlugin).
+		RegisterObjectStore("example.io/s3-object-store-plugin", newS3ObjectStorePlugin).
 		RegisterVolumeSnapshotter("example.io/volume-snapshotter-plugin", newNoOpVolumeSnapshotterPlugin).
 		RegisterRestoreItemAction("example.io/restore-plugin", newRestorePlugin).
 		RegisterRestoreItemActionV2("example.io/restore-pluginv2", newRestorePluginV2).
@@ -45,6 +59,10 @@ func newObjectStorePlugin(logger logrus.FieldLogger) (interface{}, error) {
 	return plugin.NewFileObjectStore(logger), nil
 }
 
+func newS3ObjectStorePlugin(logger logrus.FieldLogger) (interface{}, error) {
+	return plugin.NewS3ObjectStore(logger), nil
+}
+
 func newRestorePlugin(logger logrus.FieldLogger) (interface{}, error) {
 	return plugin.NewRestorePlugin(logger), nil
 }